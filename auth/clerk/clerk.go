@@ -6,13 +6,14 @@ import (
 
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/caarlos0/env/v8"
+	"github.com/keloran/go-config/secrets"
 	vaultHelper "github.com/keloran/vault-helper"
 )
 
 type Details struct {
-	Key       string `env:"CLERK_SECRET_KEY" envDefault:""`
-	PublicKey string `env:"NEXT_PUBLIC_CLERK_PUBLISHABLE_KEY" envDefault:""`
-	DevUser   string `env:"CLERK_DEV_USER" envDefault:""`
+	Key       secrets.Secret `env:"CLERK_SECRET_KEY" envDefault:""`
+	PublicKey string         `env:"NEXT_PUBLIC_CLERK_PUBLISHABLE_KEY" envDefault:""`
+	DevUser   string         `env:"CLERK_DEV_USER" envDefault:""`
 }
 
 type System struct {
@@ -73,12 +74,12 @@ func (s *System) buildVault() (*Details, error) {
 		return clerk, nil
 	}
 
-	if s.Details.Key == "" {
+	if s.Details.Key.IsZero() {
 		secret, err := vh.GetSecret("clerk-key")
 		if err != nil {
 			return clerk, logs.Errorf("clerk: unable to get key: %v", err)
 		}
-		clerk.Key = secret
+		clerk.Key = secrets.New(secret)
 	} else {
 		clerk.Key = s.Details.Key
 	}
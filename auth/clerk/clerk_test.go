@@ -20,7 +20,7 @@ func TestBuildGeneric(t *testing.T) {
 	c := NewSystem()
 	ck, err := c.Build()
 	assert.NoError(t, err)
-	assert.Equal(t, "testKey", ck.Key)
+	assert.Equal(t, "testKey", ck.Key.Reveal())
 	assert.Equal(t, "testPublicKey", ck.PublicKey)
 }
 
@@ -39,7 +39,7 @@ func TestBuildVault(t *testing.T) {
 	c.Setup(*vd, mockVault)
 	ck, err := c.Build()
 	assert.NoError(t, err)
-	assert.Equal(t, "testKey", ck.Key)
+	assert.Equal(t, "testKey", ck.Key.Reveal())
 	assert.Equal(t, "testPublicKey", ck.PublicKey)
 }
 
@@ -58,7 +58,7 @@ func TestBuildVaultNoKey(t *testing.T) {
 	c.Setup(*vd, mockVault)
 	ck, err := c.Build()
 	assert.NoError(t, err)
-	assert.Equal(t, "testKey", ck.Key)
+	assert.Equal(t, "testKey", ck.Key.Reveal())
 	assert.Equal(t, "testPublicKey", ck.PublicKey)
 }
 
@@ -77,6 +77,6 @@ func TestBuildVaultNoPublicKey(t *testing.T) {
 	c.Setup(*vd, mockVault)
 	ck, err := c.Build()
 	assert.NoError(t, err)
-	assert.Equal(t, "testKey", ck.Key)
+	assert.Equal(t, "testKey", ck.Key.Reveal())
 	assert.Equal(t, "", ck.PublicKey)
 }
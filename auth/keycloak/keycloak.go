@@ -7,23 +7,31 @@ import (
 	"github.com/Nerzal/gocloak/v13"
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/caarlos0/env/v8"
+	"github.com/keloran/go-config/secrets"
+	"github.com/keloran/go-config/vault"
 	vaultHelper "github.com/keloran/vault-helper"
 )
 
+// DefaultFallbackHost is used when neither KEYCLOAK_HOSTNAME nor the details secret set a host
+const DefaultFallbackHost = "https://keys.chewedfeed.com"
+
 type VaultDetails struct {
 	Address string
-	Token   string
+	Token   secrets.Secret
+
+	DetailsPath string `env:"KEYCLOAK_VAULT_DETAIL_PATH"`
 
-	DetailsPath string `env:"KEYCLOAK_VAULT_DETAIL_PATH" envDefault:"secret/data/chewedfeed/details"`
+	// FallbackHost is used when the details secret has no keycloak-host
+	FallbackHost string `env:"KEYCLOAK_VAULT_FALLBACK_HOSTNAME"`
 
 	Exclusive bool
 }
 
 type Details struct {
-	Client string `env:"KEYCLOAK_CLIENT" envDefault:"" json:"client,omitempty"`
-	Secret string `env:"KEYCLOAK_SECRET" envDefault:"" json:"secret,omitempty"`
-	Realm  string `env:"KEYCLOAK_REALM" envDefault:"" json:"realm,omitempty"`
-	Host   string `env:"KEYCLOAK_HOSTNAME" envDefault:"https://keys.chewedfeed.com" json:"host,omitempty"`
+	Client string         `env:"KEYCLOAK_CLIENT" envDefault:"" json:"client,omitempty"`
+	Secret secrets.Secret `env:"KEYCLOAK_SECRET" envDefault:"" json:"secret,omitempty"`
+	Realm  string         `env:"KEYCLOAK_REALM" envDefault:"" json:"realm,omitempty"`
+	Host   string         `env:"KEYCLOAK_HOSTNAME" json:"host,omitempty"`
 }
 
 type System struct {
@@ -59,11 +67,38 @@ func (s *System) Build() (*Details, error) {
 	return gen, nil
 }
 
+func (vd VaultDetails) fallbackHost() string {
+	if vd.FallbackHost != "" {
+		return vd.FallbackHost
+	}
+
+	return DefaultFallbackHost
+}
+
 func isVaultKeyNotFound(err error) bool {
 	return err != nil && strings.Contains(err.Error(), "not found")
 }
 
+// resolvePaths fills in the vault paths Setup was given without, under the root from VAULT_PATH_PREFIX
+func (s *System) resolvePaths() error {
+	if s.VaultDetails.DetailsPath != "" {
+		return nil
+	}
+
+	root, err := vault.BuildRoot()
+	if err != nil {
+		return logs.Errorf("keycloak: unable to build vault root: %v", err)
+	}
+	s.VaultDetails.DetailsPath = root.Resolve(s.VaultDetails.DetailsPath, "details")
+
+	return nil
+}
+
 func (s *System) buildVault() (*Details, error) {
+	if err := s.resolvePaths(); err != nil {
+		return nil, err
+	}
+
 	key := &Details{}
 	vh := *s.VaultHelper
 
@@ -84,12 +119,12 @@ func (s *System) buildVault() (*Details, error) {
 		key.Client = s.Details.Client
 	}
 
-	if s.Details.Secret == "" {
+	if s.Details.Secret.IsZero() {
 		secret, err := vh.GetSecret("keycloak-secret")
 		if err != nil {
 			return key, logs.Errorf("keycloak: unable to get secret: %v", err)
 		}
-		key.Secret = secret
+		key.Secret = secrets.New(secret)
 	} else {
 		key.Secret = s.Details.Secret
 	}
@@ -110,7 +145,7 @@ func (s *System) buildVault() (*Details, error) {
 			if !isVaultKeyNotFound(err) {
 				return key, logs.Errorf("keycloak: unable to get host: %v", err)
 			}
-			secret = "https://keys.chewedfeed.com"
+			secret = s.VaultDetails.fallbackHost()
 		}
 		key.Host = secret
 	} else {
@@ -126,6 +161,9 @@ func (s *System) buildGeneric() (*Details, error) {
 	if err := env.Parse(key); err != nil {
 		return nil, logs.Errorf("keycloak: unable to parse env: %v", err)
 	}
+	if key.Host == "" {
+		key.Host = DefaultFallbackHost
+	}
 
 	s.Details = *key
 	return key, nil
@@ -133,7 +171,7 @@ func (s *System) buildGeneric() (*Details, error) {
 
 func (s *System) GetClient(ctx context.Context) (*gocloak.GoCloak, *gocloak.JWT, error) {
 	client := gocloak.NewClient(s.Host)
-	token, err := client.LoginClient(ctx, s.Client, s.Secret, s.Realm)
+	token, err := client.LoginClient(ctx, s.Client, s.Secret.Reveal(), s.Realm)
 	if err != nil {
 		return nil, nil, logs.Errorf("keycloak: unable to login client: %v", err)
 	}
@@ -1,6 +1,7 @@
 package keycloak
 
 import (
+	"github.com/keloran/go-config/secrets"
 	vaultHelper "github.com/keloran/vault-helper"
 	"github.com/stretchr/testify/assert"
 	"os"
@@ -24,7 +25,7 @@ func TestBuildVault(t *testing.T) {
 
 	vd := &VaultDetails{
 		Address:     "mockAddress",
-		Token:       "mockToken",
+		Token:       secrets.New("mockToken"),
 		DetailsPath: "tester",
 	}
 	d := NewSystem()
@@ -34,7 +35,7 @@ func TestBuildVault(t *testing.T) {
 	assert.NoError(t, err)
 
 	assert.Equal(t, testClient, kc.Client)
-	assert.Equal(t, testSecret, kc.Secret)
+	assert.Equal(t, testSecret, kc.Secret.Reveal())
 	assert.Equal(t, testRealm, kc.Realm)
 	assert.Equal(t, "https://keys.chewedfeed.com", kc.Host)
 }
@@ -57,7 +58,7 @@ func TestBuildGeneric(t *testing.T) {
 	assert.NoError(t, err)
 
 	assert.Equal(t, testClient, kc.Client)
-	assert.Equal(t, testSecret, kc.Secret)
+	assert.Equal(t, testSecret, kc.Secret.Reveal())
 	assert.Equal(t, testRealm, kc.Realm)
 	assert.Equal(t, "https://keys.chewedfeed.com", kc.Host)
 }
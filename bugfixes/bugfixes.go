@@ -6,13 +6,14 @@ import (
 
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/caarlos0/env/v8"
+	"github.com/keloran/go-config/secrets"
 	vaultHelper "github.com/keloran/vault-helper"
 )
 
 type Details struct {
-	Server      string `env:"BUGFIXES_SERVER" envDefault:"https://api.bugfix.es/v1"`
-	AgentKey    string `env:"BUGFIXES_AGENT_KEY"`
-	AgentSecret string `env:"BUGFIXES_AGENT_SECRET"`
+	Server      string         `env:"BUGFIXES_SERVER" envDefault:"https://api.bugfix.es/v1"`
+	AgentKey    string         `env:"BUGFIXES_AGENT_KEY"`
+	AgentSecret secrets.Secret `env:"BUGFIXES_AGENT_SECRET"`
 }
 
 type System struct {
@@ -89,12 +90,12 @@ func (s *System) buildVault() (*Details, error) {
 		bf.AgentKey = s.Details.AgentKey
 	}
 
-	if s.Details.AgentSecret == "" {
+	if s.Details.AgentSecret.IsZero() {
 		secret, err := vh.GetSecret("bugfixes-secret")
 		if err != nil {
 			return bf, logs.Errorf("bugfixes: unable to get secret: %v", err)
 		}
-		bf.AgentSecret = secret
+		bf.AgentSecret = secrets.New(secret)
 	} else {
 		bf.AgentSecret = s.Details.AgentSecret
 	}
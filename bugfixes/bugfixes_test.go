@@ -25,7 +25,7 @@ func TestBuildGeneric(t *testing.T) {
 	bf, err := b.Build()
 	assert.NoError(t, err)
 	assert.Equal(t, "testKey", bf.AgentKey)
-	assert.Equal(t, "testSecret", bf.AgentSecret)
+	assert.Equal(t, "testSecret", bf.AgentSecret.Reveal())
 	assert.Equal(t, "http://bob.bob", bf.Server)
 }
 
@@ -46,7 +46,7 @@ func TestBuildVault(t *testing.T) {
 	bf, err := b.Build()
 	assert.NoError(t, err)
 	assert.Equal(t, "testKey", bf.AgentKey)
-	assert.Equal(t, "testSecret", bf.AgentSecret)
+	assert.Equal(t, "testSecret", bf.AgentSecret.Reveal())
 	assert.Equal(t, "http://bob.bob", bf.Server)
 }
 
@@ -67,7 +67,7 @@ func TestBuildVaultNoHost(t *testing.T) {
 	bf, err := b.Build()
 	assert.NoError(t, err)
 	assert.Equal(t, "testKey", bf.AgentKey)
-	assert.Equal(t, "testSecret", bf.AgentSecret)
+	assert.Equal(t, "testSecret", bf.AgentSecret.Reveal())
 	assert.Equal(t, "https://api.bugfix.es/v1", bf.Server)
 }
 
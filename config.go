@@ -9,6 +9,7 @@ import (
 	"os"
 
 	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/caarlos0/env/v8"
 	"github.com/joho/godotenv"
 	"github.com/keloran/go-config/auth/keycloak"
 	"github.com/keloran/go-config/bugfixes"
@@ -17,9 +18,14 @@ import (
 	"github.com/keloran/go-config/influx"
 	"github.com/keloran/go-config/local"
 	"github.com/keloran/go-config/rabbit"
+	"github.com/keloran/go-config/telemetry"
 	"github.com/keloran/go-config/vault"
+	"github.com/keloran/go-config/vault/pki"
+	"github.com/keloran/go-config/vault/transit"
 
 	vaultHelper "github.com/keloran/vault-helper"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Config struct {
@@ -38,10 +44,17 @@ type Config struct {
 	Clerk    clerk.System
 	Resend   resend.System
 	Flags    flags.System
+	Transit  transit.System
+	PKI      pki.System
+
+	// Telemetry is set by WithTelemetry and handed to the database subsystems
+	Telemetry *telemetry.Telemetry
 
 	// Project level properties
 	ProjectProperties ProjectProperties
 	ProjectConfig     interface{}
+
+	vaultRecorders map[string]*vault.Recorder
 }
 
 type BuildOption func(*Config) error
@@ -49,7 +62,7 @@ type BuildOption func(*Config) error
 type subsystemConfigurator[T any] struct {
 	name       string
 	system     *T
-	setupVault func(*T, vault.Paths, vaultHelper.VaultHelper)
+	setupVault func(*T, vault.Paths, vaultHelper.VaultHelper) error
 	build      func(*T) error
 	assign     func(*T)
 }
@@ -83,10 +96,87 @@ func Vault(cfg *Config) error {
 
 	cfg.Vault = *v
 	cfg.VaultHelper = &vh
+	if cfg.VaultPaths.Root.IsZero() {
+		cfg.VaultPaths.Root = v.Root
+	}
 
 	return nil
 }
 
+// WithVaultRetry retries vault reads and serves last known good secrets when vault is down,
+// it wraps the helper already on the config so it needs to come after Vault or NewConfig
+func WithVaultRetry(policy vault.RetryPolicy) BuildOption {
+	return func(c *Config) error {
+		if c.VaultHelper == nil {
+			return logs.Error("config: unable to add vault retry without a vault helper")
+		}
+
+		if r, ok := (*c.VaultHelper).(*vault.Resilient); ok {
+			r.Policy = policy
+			return nil
+		}
+
+		var vh vaultHelper.VaultHelper = vault.NewResilient(*c.VaultHelper, policy)
+		c.VaultHelper = &vh
+		return nil
+	}
+}
+
+// WithVaultRetryEvents reports every retry, stale read and breaker change to fn so they can feed metrics,
+// it needs to come after Vault, NewConfig or WithVaultRetry and wraps a plain helper with the env retry policy
+func WithVaultRetryEvents(fn func(vault.RetryEvent)) BuildOption {
+	return func(c *Config) error {
+		if c.VaultHelper == nil {
+			return logs.Error("config: unable to add vault retry events without a vault helper")
+		}
+
+		r, ok := (*c.VaultHelper).(*vault.Resilient)
+		if !ok {
+			policy, err := vault.BuildRetryPolicy()
+			if err != nil {
+				return logs.Errorf("config: unable to build vault retry policy: %v", err)
+			}
+			r = vault.NewResilient(*c.VaultHelper, policy)
+			var vh vaultHelper.VaultHelper = r
+			c.VaultHelper = &vh
+		}
+		r.OnEvent = fn
+
+		return nil
+	}
+}
+
+// WithVaultMount sets the KV mount and base path that every subsystem's default vault paths derive from,
+// it needs to come before the subsystems in the build options
+func WithVaultMount(mount, base string) BuildOption {
+	return func(c *Config) error {
+		root := vault.NewRoot(mount, base)
+		root.KVVersion = c.VaultPaths.Root.KVVersion
+		if root.Mount == "" {
+			return logs.Error("config: unable to use empty vault mount")
+		}
+
+		c.VaultPaths.Root = root
+		return nil
+	}
+}
+
+// WithTelemetry traces the postgres, mysql and mongo clients and reports their pool metrics,
+// it can come before or after the subsystems in the build options, nil providers use the global ones
+func WithTelemetry(tp trace.TracerProvider, mp metric.MeterProvider) BuildOption {
+	return func(c *Config) error {
+		t, err := telemetry.New(tp, mp)
+		if err != nil {
+			return logs.Errorf("config: unable to build telemetry: %v", err)
+		}
+
+		c.Telemetry = t
+		c.Database.Telemetry = t
+		c.Mongo.Telemetry = t
+		return nil
+	}
+}
+
 // Database deprecated: use Postgres instead
 func Database(cfg *Config) error {
 	return Postgres(cfg)
@@ -97,17 +187,18 @@ func Postgres(cfg *Config) error {
 	return buildSubsystem(cfg, subsystemConfigurator[postgres.System]{
 		name:   "database",
 		system: d,
-		setupVault: func(d *postgres.System, paths vault.Paths, vh vaultHelper.VaultHelper) {
+		setupVault: func(d *postgres.System, paths vault.Paths, vh vaultHelper.VaultHelper) error {
 			vd := postgres.VaultDetails{}
-			if paths.Database.Details != "" {
-				vd.DetailsPath = paths.Database.Details
-			}
-			if paths.Database.Credentials != "" {
-				vd.CredPath = paths.Database.Credentials
+			if err := env.Parse(&vd); err != nil {
+				return logs.Errorf("unable to parse vault env: %v", err)
 			}
+			vd.DetailsPath = paths.Root.Resolve(firstSet(paths.Database.Details, vd.DetailsPath), "details")
+			vd.CredPath = paths.Root.Resolve(firstSet(paths.Database.Credentials, vd.CredPath), "postgres")
 			d.Setup(vd, vh)
+			return nil
 		},
 		build: func(d *postgres.System) error {
+			d.Telemetry = cfg.Telemetry
 			_, err := d.Build()
 			return err
 		},
@@ -122,17 +213,19 @@ func Mongo(cfg *Config) error {
 	return buildSubsystem(cfg, subsystemConfigurator[mongo.System]{
 		name:   "mongo",
 		system: m,
-		setupVault: func(m *mongo.System, paths vault.Paths, vh vaultHelper.VaultHelper) {
+		setupVault: func(m *mongo.System, paths vault.Paths, vh vaultHelper.VaultHelper) error {
 			vd := mongo.VaultDetails{}
-			if paths.Mongo.Details != "" {
-				vd.DetailsPath = paths.Mongo.Details
-			}
-			if paths.Mongo.Credentials != "" {
-				vd.CredPath = paths.Mongo.Credentials
+			if err := env.Parse(&vd); err != nil {
+				return logs.Errorf("unable to parse vault env: %v", err)
 			}
+			vd.Path = paths.Root.Resolve(vd.Path, "mongo")
+			vd.DetailsPath = paths.Root.Resolve(firstSet(paths.Mongo.Details, vd.DetailsPath), "details")
+			vd.CredPath = paths.Root.Resolve(firstSet(paths.Mongo.Credentials, vd.CredPath), "mongo")
 			m.Setup(vd, vh)
+			return nil
 		},
 		build: func(m *mongo.System) error {
+			m.Telemetry = cfg.Telemetry
 			_, err := m.Build()
 			return err
 		},
@@ -147,12 +240,14 @@ func Keycloak(cfg *Config) error {
 	return buildSubsystem(cfg, subsystemConfigurator[keycloak.System]{
 		name:   "keycloak",
 		system: k,
-		setupVault: func(k *keycloak.System, paths vault.Paths, vh vaultHelper.VaultHelper) {
+		setupVault: func(k *keycloak.System, paths vault.Paths, vh vaultHelper.VaultHelper) error {
 			vd := keycloak.VaultDetails{}
-			if paths.Keycloak.Details != "" {
-				vd.DetailsPath = paths.Keycloak.Details
+			if err := env.Parse(&vd); err != nil {
+				return logs.Errorf("unable to parse vault env: %v", err)
 			}
+			vd.DetailsPath = paths.Root.Resolve(firstSet(paths.Keycloak.Details, vd.DetailsPath), "details")
 			k.Setup(vd, vh)
+			return nil
 		},
 		build: func(k *keycloak.System) error {
 			_, err := k.Build()
@@ -169,15 +264,19 @@ func Rabbit(cfg *Config) error {
 	return buildSubsystem(cfg, subsystemConfigurator[rabbit.System]{
 		name:   "rabbit",
 		system: r,
-		setupVault: func(r *rabbit.System, paths vault.Paths, vh vaultHelper.VaultHelper) {
+		setupVault: func(r *rabbit.System, paths vault.Paths, vh vaultHelper.VaultHelper) error {
 			vd := rabbit.VaultDetails{}
-			if paths.Rabbit.Details != "" {
-				vd.DetailsPath = paths.Rabbit.Details
+			if err := env.Parse(&vd); err != nil {
+				return logs.Errorf("unable to parse vault env: %v", err)
 			}
-			if paths.Rabbit.Credentials != "" {
-				vd.CredPath = paths.Rabbit.Credentials
+			root := paths.Root
+			if root.IsDefault() {
+				root = vault.NewRoot(rabbit.DefaultMount, vault.DefaultBase)
 			}
+			vd.DetailsPath = root.Resolve(firstSet(paths.Rabbit.Details, vd.DetailsPath), "details")
+			vd.CredPath = root.Resolve(firstSet(paths.Rabbit.Credentials, vd.CredPath), "rabbitmq")
 			r.Setup(vd, vh)
+			return nil
 		},
 		build: func(r *rabbit.System) error {
 			_, err := r.Build()
@@ -194,12 +293,15 @@ func Influx(cfg *Config) error {
 	return buildSubsystem(cfg, subsystemConfigurator[influx.System]{
 		name:   "influx",
 		system: i,
-		setupVault: func(i *influx.System, paths vault.Paths, vh vaultHelper.VaultHelper) {
+		setupVault: func(i *influx.System, paths vault.Paths, vh vaultHelper.VaultHelper) error {
 			vd := influx.VaultDetails{}
-			if paths.Influx.Details != "" {
-				vd.DetailsPath = paths.Influx.Details
+			if err := env.Parse(&vd); err != nil {
+				return logs.Errorf("unable to parse vault env: %v", err)
 			}
+			vd.DetailsPath = paths.Root.Resolve(firstSet(paths.Influx.Details, vd.DetailsPath), "details")
+			vd.CredsPath = paths.Root.Resolve(firstSet(paths.Influx.Credentials, vd.CredsPath), "influx")
 			i.Setup(vd, vh)
+			return nil
 		},
 		build: func(i *influx.System) error {
 			_, err := i.Build()
@@ -216,12 +318,11 @@ func Clerk(cfg *Config) error {
 	return buildSubsystem(cfg, subsystemConfigurator[clerk.System]{
 		name:   "clerk",
 		system: c,
-		setupVault: func(c *clerk.System, paths vault.Paths, vh vaultHelper.VaultHelper) {
+		setupVault: func(c *clerk.System, paths vault.Paths, vh vaultHelper.VaultHelper) error {
 			vd := c.VaultDetails
-			if paths.Clerk.Details != "" {
-				vd.DetailsPath = paths.Clerk.Details
-			}
+			vd.DetailsPath = paths.Root.Resolve(firstSet(paths.Clerk.Details, vd.DetailsPath), "details")
 			c.Setup(vd, vh)
+			return nil
 		},
 		build: func(c *clerk.System) error {
 			_, err := c.Build()
@@ -238,12 +339,11 @@ func Resend(cfg *Config) error {
 	return buildSubsystem(cfg, subsystemConfigurator[resend.System]{
 		name:   "resend",
 		system: r,
-		setupVault: func(r *resend.System, paths vault.Paths, vh vaultHelper.VaultHelper) {
+		setupVault: func(r *resend.System, paths vault.Paths, vh vaultHelper.VaultHelper) error {
 			vd := r.VaultDetails
-			if paths.Resend.Details != "" {
-				vd.DetailsPath = paths.Resend.Details
-			}
+			vd.DetailsPath = paths.Root.Resolve(firstSet(paths.Resend.Details, vd.DetailsPath), "details")
 			r.Setup(vd, vh)
+			return nil
 		},
 		build: func(r *resend.System) error {
 			_, err := r.Build()
@@ -260,12 +360,11 @@ func Bugfixes(cfg *Config) error {
 	return buildSubsystem(cfg, subsystemConfigurator[bugfixes.System]{
 		name:   "bugfixes",
 		system: b,
-		setupVault: func(b *bugfixes.System, paths vault.Paths, vh vaultHelper.VaultHelper) {
+		setupVault: func(b *bugfixes.System, paths vault.Paths, vh vaultHelper.VaultHelper) error {
 			vd := b.VaultDetails
-			if paths.BugFixes.Details != "" {
-				vd.DetailsPath = paths.BugFixes.Details
-			}
+			vd.DetailsPath = paths.Root.Resolve(firstSet(paths.BugFixes.Details, vd.DetailsPath), "details")
 			b.Setup(vd, vh)
+			return nil
 		},
 		build: func(b *bugfixes.System) error {
 			_, err := b.Build()
@@ -274,7 +373,7 @@ func Bugfixes(cfg *Config) error {
 			}
 
 			logger := logs.Local()
-			logger.Setup(b.AgentKey, b.AgentSecret)
+			logger.Setup(b.AgentKey, b.AgentSecret.Reveal())
 			b.Logger = logger
 
 			return nil
@@ -285,6 +384,55 @@ func Bugfixes(cfg *Config) error {
 	})
 }
 
+// Transit needs a vault helper with an api client, e.g. from Vault, and reads VAULT_TRANSIT_KEY and VAULT_TRANSIT_MOUNT
+func Transit(cfg *Config) error {
+	t := transit.NewSystem()
+	return buildSubsystem(cfg, subsystemConfigurator[transit.System]{
+		name:   "transit",
+		system: t,
+		setupVault: func(t *transit.System, paths vault.Paths, vh vaultHelper.VaultHelper) error {
+			client, ok := vault.APIClient(vh)
+			if !ok {
+				return logs.Error("unable to use vault helper without an api client")
+			}
+			t.Setup(client)
+			return nil
+		},
+		build: func(t *transit.System) error {
+			_, err := t.Build()
+			return err
+		},
+		assign: func(t *transit.System) {
+			cfg.Transit = *t
+		},
+	})
+}
+
+// PKI issues the service certificate from VAULT_PKI_ROLE for VAULT_PKI_COMMON_NAME and keeps rotating it,
+// it needs a vault helper with an api client, e.g. from Vault
+func PKI(cfg *Config) error {
+	p := pki.NewSystem()
+	return buildSubsystem(cfg, subsystemConfigurator[pki.System]{
+		name:   "pki",
+		system: p,
+		setupVault: func(p *pki.System, paths vault.Paths, vh vaultHelper.VaultHelper) error {
+			client, ok := vault.APIClient(vh)
+			if !ok {
+				return logs.Error("unable to use vault helper without an api client")
+			}
+			p.Setup(client)
+			return nil
+		},
+		build: func(p *pki.System) error {
+			_, err := p.Build()
+			return err
+		},
+		assign: func(p *pki.System) {
+			cfg.PKI = *p
+		},
+	})
+}
+
 func Flags(cfg *Config) error {
 	f, err := flags.Build()
 	if err != nil {
@@ -306,7 +454,23 @@ func Build(opts ...BuildOption) (*Config, error) {
 
 func buildSubsystem[T any](cfg *Config, subsystem subsystemConfigurator[T]) error {
 	if cfg.VaultHelper != nil && subsystem.setupVault != nil {
-		subsystem.setupVault(subsystem.system, cfg.VaultPaths, *cfg.VaultHelper)
+		if cfg.VaultPaths.Root.IsZero() {
+			root, err := vault.BuildRoot()
+			if err != nil {
+				return logs.Errorf("%s: unable to build vault root: %v", subsystem.name, err)
+			}
+			cfg.VaultPaths.Root = root
+		}
+
+		rec := vault.NewRecorder(*cfg.VaultHelper)
+		if err := subsystem.setupVault(subsystem.system, cfg.VaultPaths, rec); err != nil {
+			return logs.Errorf("%s: unable to setup vault: %v", subsystem.name, err)
+		}
+
+		if cfg.vaultRecorders == nil {
+			cfg.vaultRecorders = make(map[string]*vault.Recorder)
+		}
+		cfg.vaultRecorders[subsystem.name] = rec
 	}
 
 	if err := subsystem.build(subsystem.system); err != nil {
@@ -317,6 +481,27 @@ func buildSubsystem[T any](cfg *Config, subsystem subsystemConfigurator[T]) erro
 	return nil
 }
 
+// SecretVersions reports the vault secret versions each subsystem has loaded, including background refreshes
+func (c *Config) SecretVersions() map[string][]vault.SecretVersion {
+	versions := make(map[string][]vault.SecretVersion, len(c.vaultRecorders))
+	for name, rec := range c.vaultRecorders {
+		versions[name] = rec.Versions()
+	}
+
+	return versions
+}
+
+// firstSet returns the first non-empty path
+func firstSet(paths ...string) string {
+	for _, p := range paths {
+		if p != "" {
+			return p
+		}
+	}
+
+	return ""
+}
+
 func BuildLocal(opts ...BuildOption) (*Config, error) {
 	cfg := &Config{}
 
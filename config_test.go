@@ -6,6 +6,8 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/keloran/go-config/vault"
+	"github.com/keloran/go-config/vault/vaulttest"
 	vaulthelper "github.com/keloran/vault-helper"
 
 	"github.com/stretchr/testify/assert"
@@ -15,12 +17,14 @@ import (
 type MockVaultHelper struct {
 	KVSecrets []vaulthelper.KVSecret
 	Lease     int
+	Requested []string
 }
 
 func (m *MockVaultHelper) GetSecrets(path string) error {
 	if path == "" {
 		return nil
 	}
+	m.Requested = append(m.Requested, path)
 
 	return nil // or simulate an error if needed
 }
@@ -211,6 +215,181 @@ func TestDatabase(t *testing.T) {
 	})
 }
 
+func TestWithVaultMount(t *testing.T) {
+	newMock := func() *MockVaultHelper {
+		return &MockVaultHelper{
+			KVSecrets: []vaulthelper.KVSecret{
+				{Key: "password", Value: "testPassword"},
+				{Key: "username", Value: "testUser"},
+				{Key: "rds-hostname", Value: "testHost"},
+				{Key: "rds-db", Value: "testDB"},
+			},
+		}
+	}
+
+	t.Run("default root", func(t *testing.T) {
+		os.Clearenv()
+		mockVault := newMock()
+		_, err := BuildLocalVH(mockVault, Postgres)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"secret/data/chewedfeed/postgres", "secret/data/chewedfeed/details"}, mockVault.Requested)
+	})
+
+	t.Run("custom mount", func(t *testing.T) {
+		os.Clearenv()
+		mockVault := newMock()
+		_, err := BuildLocalVH(mockVault, WithVaultMount("kv", "team"), Postgres)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"kv/data/team/postgres", "kv/data/team/details"}, mockVault.Requested)
+	})
+
+	t.Run("rabbit keeps its secrets mount on the default root", func(t *testing.T) {
+		os.Clearenv()
+		newRabbitMock := func() *MockVaultHelper {
+			return &MockVaultHelper{
+				KVSecrets: []vaulthelper.KVSecret{
+					{Key: "rabbit-password", Value: "testPassword"},
+					{Key: "rabbit-username", Value: "testUser"},
+					{Key: "rabbit-vhost", Value: "testVhost"},
+					{Key: "rabbit-hostname", Value: ""},
+					{Key: "rabbit-management-hostname", Value: ""},
+					{Key: "rabbit-queue", Value: ""},
+				},
+			}
+		}
+
+		cfg, err := BuildLocalVH(newRabbitMock(), Rabbit)
+		assert.NoError(t, err)
+		assert.Equal(t, "secrets/data/chewedfeed/details", cfg.Rabbit.VaultDetails.DetailsPath)
+		assert.Equal(t, "secrets/data/chewedfeed/rabbitmq", cfg.Rabbit.VaultDetails.CredPath)
+
+		cfg, err = BuildLocalVH(newRabbitMock(), WithVaultMount("kv", "team"), Rabbit)
+		assert.NoError(t, err)
+		assert.Equal(t, "kv/data/team/details", cfg.Rabbit.VaultDetails.DetailsPath)
+		assert.Equal(t, "kv/data/team/rabbitmq", cfg.Rabbit.VaultDetails.CredPath)
+	})
+
+	t.Run("prefix from env kv v1", func(t *testing.T) {
+		os.Clearenv()
+		require.NoError(t, os.Setenv("VAULT_PATH_PREFIX", "kv/team"))
+		require.NoError(t, os.Setenv("VAULT_KV_VERSION", "1"))
+		mockVault := newMock()
+		_, err := BuildLocalVH(mockVault, Postgres)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"kv/team/postgres", "kv/team/details"}, mockVault.Requested)
+	})
+
+	t.Run("explicit paths win", func(t *testing.T) {
+		os.Clearenv()
+		require.NoError(t, os.Setenv("RDS_VAULT_CRED_PATH", "secret/team/pg"))
+		mockVault := newMock()
+		cfg := NewConfig(mockVault)
+		cfg.VaultPaths.Database.Details = "secret/data/other/details"
+		assert.NoError(t, cfg.Build(Postgres))
+		assert.Equal(t, []string{"secret/data/team/pg", "secret/data/other/details"}, mockVault.Requested)
+	})
+}
+
+func TestSecretVersions(t *testing.T) {
+	os.Clearenv()
+	mockVault := &MockVaultHelper{
+		KVSecrets: []vaulthelper.KVSecret{
+			{Key: "password", Value: "testPassword"},
+			{Key: "username", Value: "testUser"},
+			{Key: "rds-hostname", Value: "testHost"},
+			{Key: "rds-db", Value: "testDB"},
+		},
+	}
+
+	cfg := NewConfig(mockVault)
+	cfg.VaultPaths.Database.Details = "secret/data/chewedfeed/details?version=4"
+	require.NoError(t, cfg.Build(Postgres))
+
+	versions := cfg.SecretVersions()
+	assert.Equal(t, []vault.SecretVersion{
+		{Path: "secret/data/chewedfeed/details"},
+		{Path: "secret/data/chewedfeed/postgres"},
+	}, versions["database"])
+	assert.Equal(t, []string{"secret/data/chewedfeed/postgres", "secret/data/chewedfeed/details?version=4"}, mockVault.Requested)
+}
+
+func TestWithVaultRetry(t *testing.T) {
+	os.Clearenv()
+	mockVault := &MockVaultHelper{
+		KVSecrets: []vaulthelper.KVSecret{
+			{Key: "password", Value: "testPassword"},
+			{Key: "username", Value: "testUser"},
+		},
+	}
+
+	policy := vault.RetryPolicy{MaxAttempts: 2}
+	cfg, err := BuildLocalVH(mockVault, WithVaultRetry(policy), Postgres)
+	require.NoError(t, err)
+
+	r, ok := (*cfg.VaultHelper).(*vault.Resilient)
+	require.True(t, ok)
+	assert.Equal(t, policy, r.Policy)
+	assert.Equal(t, "testUser", cfg.Database.User)
+
+	_, err = Build(WithVaultRetry(policy))
+	assert.Error(t, err)
+}
+
+// sealedVaultHelper fails every read the way a sealed vault does
+type sealedVaultHelper struct {
+	MockVaultHelper
+}
+
+func (s *sealedVaultHelper) GetSecrets(string) error {
+	return fmt.Errorf("Code: 503. Errors: vault is sealed")
+}
+
+func TestWithVaultRetryEvents(t *testing.T) {
+	os.Clearenv()
+	var events []vault.RetryEvent
+	onEvent := func(e vault.RetryEvent) {
+		events = append(events, e)
+	}
+
+	_, err := Build(WithVaultRetryEvents(onEvent))
+	assert.Error(t, err)
+
+	cfg, err := BuildLocalVH(&MockVaultHelper{}, WithVaultRetryEvents(onEvent))
+	require.NoError(t, err)
+	r, ok := (*cfg.VaultHelper).(*vault.Resilient)
+	require.True(t, ok)
+	assert.Equal(t, 3, r.Policy.MaxAttempts, "a plain helper is wrapped with the env policy")
+
+	policy := vault.RetryPolicy{MaxAttempts: 1}
+	cfg, err = BuildLocalVH(&MockVaultHelper{}, WithVaultRetry(policy), WithVaultRetryEvents(onEvent))
+	require.NoError(t, err)
+	r, ok = (*cfg.VaultHelper).(*vault.Resilient)
+	require.True(t, ok)
+	assert.Equal(t, policy, r.Policy, "the policy from WithVaultRetry is kept")
+
+	require.NoError(t, r.GetSecrets("tester"))
+	r.VaultHelper = &sealedVaultHelper{}
+	require.NoError(t, r.GetSecrets("tester"))
+	require.Len(t, events, 1)
+	assert.Equal(t, vault.EventStale, events[0].Kind)
+	assert.Equal(t, "tester", events[0].Path)
+}
+
+func TestVaultEndToEnd(t *testing.T) {
+	os.Clearenv()
+	srv := vaulttest.NewServer(t, map[string]map[string]interface{}{
+		"secret/team/postgres": {"username": "pgUser", "password": "pgPass"},
+		"secret/team/details":  {"rds-hostname": "pg.team", "rds-db": "app", "keycloak-client": "client", "keycloak-secret": "secret", "keycloak-realm": "realm"},
+	}, vaulttest.WithLease("secret/team/postgres", 7200))
+
+	cfg, err := BuildLocalVH(srv.Helper(), WithVaultMount("secret", "team"), Postgres, Keycloak)
+	require.NoError(t, err)
+	assert.Equal(t, "pgUser", cfg.Database.User)
+	assert.Equal(t, "pg.team", cfg.Database.Host)
+	assert.Equal(t, "realm", cfg.Keycloak.Realm)
+	assert.Equal(t, 1, cfg.SecretVersions()["database"][0].Version)
+}
+
 func TestKeycloak(t *testing.T) {
 	t.Run("keycloak", func(t *testing.T) {
 		os.Clearenv()
@@ -229,6 +408,30 @@ func TestVault(t *testing.T) {
 	})
 }
 
+func TestWithTelemetry(t *testing.T) {
+	t.Run("before the subsystems", func(t *testing.T) {
+		os.Clearenv()
+		cfg, err := BuildLocal(WithTelemetry(nil, nil), Database, Mongo)
+		require.NoError(t, err)
+		assert.NotNil(t, cfg.Telemetry)
+		assert.Same(t, cfg.Telemetry, cfg.Database.Telemetry)
+		assert.Same(t, cfg.Telemetry, cfg.Mongo.Telemetry)
+	})
+	t.Run("after the subsystems", func(t *testing.T) {
+		os.Clearenv()
+		cfg, err := BuildLocal(Database, Mongo, WithTelemetry(nil, nil))
+		require.NoError(t, err)
+		assert.Same(t, cfg.Telemetry, cfg.Database.Telemetry)
+		assert.Same(t, cfg.Telemetry, cfg.Mongo.Telemetry)
+	})
+	t.Run("off by default", func(t *testing.T) {
+		os.Clearenv()
+		cfg, err := BuildLocal(Database)
+		require.NoError(t, err)
+		assert.Nil(t, cfg.Database.Telemetry)
+	})
+}
+
 func TestMongo(t *testing.T) {
 	mockVault := &MockVaultHelper{
 		KVSecrets: []vaulthelper.KVSecret{
@@ -251,6 +454,7 @@ func TestMongo(t *testing.T) {
 		cfg, err := BuildLocalVH(mockVault, Mongo)
 		assert.NoError(t, err)
 		assert.Equal(t, "testUser", cfg.Mongo.Username)
+		assert.Equal(t, "testHost", cfg.Mongo.Host)
 	})
 }
 
@@ -275,7 +479,7 @@ func TestInflux(t *testing.T) {
 		os.Clearenv()
 		cfg, err := BuildLocalVH(mockVault, Influx)
 		assert.NoError(t, err)
-		assert.Equal(t, "testToken", cfg.Influx.Token)
+		assert.Equal(t, "testToken", cfg.Influx.Token.Reveal())
 	})
 }
 
@@ -325,7 +529,7 @@ func TestClerk(t *testing.T) {
 		cfg, err := BuildLocalVH(mockVault, Clerk)
 		assert.NoError(t, err)
 		assert.Equal(t, "testPublicKey", cfg.Clerk.PublicKey)
-		assert.Equal(t, "testKey", cfg.Clerk.Key)
+		assert.Equal(t, "testKey", cfg.Clerk.Key.Reveal())
 	})
 }
 
@@ -335,7 +539,7 @@ func TestResend(t *testing.T) {
 
 		cfg, err := BuildLocal(Resend)
 		assert.NoError(t, err)
-		assert.Equal(t, "", cfg.Resend.Key)
+		assert.Equal(t, "", cfg.Resend.Key.Reveal())
 	})
 	t.Run("resend with values", func(t *testing.T) {
 		mockVault := &MockVaultHelper{
@@ -347,7 +551,7 @@ func TestResend(t *testing.T) {
 		os.Clearenv()
 		cfg, err := BuildLocalVH(mockVault, Resend)
 		assert.NoError(t, err)
-		assert.Equal(t, "testKey", cfg.Resend.Key)
+		assert.Equal(t, "testKey", cfg.Resend.Key.Reveal())
 	})
 }
 
@@ -0,0 +1,315 @@
+// Package dsn builds and parses connection strings for the database subsystems without string formatting,
+// so credentials with reserved characters, IPv6 hosts, unix sockets and failover host lists survive the trip
+package dsn
+
+import (
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/go-sql-driver/mysql"
+	"github.com/keloran/go-config/secrets"
+)
+
+// Address is one host to connect to, a host starting with "/" is a unix socket,
+// the directory holding it for postgres or the socket file for mysql
+type Address struct {
+	Host string
+	Port int
+}
+
+func (a Address) IsUnix() bool {
+	return strings.HasPrefix(a.Host, "/")
+}
+
+func (a Address) String() string {
+	if a.Port == 0 {
+		return a.Host
+	}
+	if a.IsUnix() {
+		return a.Host + ":" + strconv.Itoa(a.Port)
+	}
+
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+// ParseHosts splits a comma separated host list such as "db1,db2:5433,[::1]:5434,::1,/var/run/postgresql",
+// hosts without a port get defaultPort
+func ParseHosts(hosts string, defaultPort int) ([]Address, error) {
+	var addrs []Address
+	for _, h := range strings.Split(hosts, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+
+		addr, err := parseHost(h, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
+
+func parseHost(h string, defaultPort int) (Address, error) {
+	switch {
+	case strings.HasPrefix(h, "/"):
+		// the port picks the socket file in the directory, "/var/run/postgresql:5433"
+		if i := strings.LastIndex(h, ":"); i > 0 {
+			if p, err := strconv.Atoi(h[i+1:]); err == nil {
+				return Address{Host: h[:i], Port: p}, nil
+			}
+		}
+		return Address{Host: h, Port: defaultPort}, nil
+	case strings.HasPrefix(h, "["):
+		host, port, err := net.SplitHostPort(h)
+		if err != nil {
+			// "[::1]" without a port
+			if strings.HasSuffix(h, "]") {
+				return Address{Host: strings.Trim(h, "[]"), Port: defaultPort}, nil
+			}
+			return Address{}, logs.Errorf("dsn: unable to parse host: %s", h)
+		}
+		return addressWithPort(host, port)
+	case strings.Count(h, ":") > 1:
+		// a bare IPv6 address, ports need brackets
+		return Address{Host: h, Port: defaultPort}, nil
+	case strings.Contains(h, ":"):
+		host, port, _ := strings.Cut(h, ":")
+		return addressWithPort(host, port)
+	}
+
+	return Address{Host: h, Port: defaultPort}, nil
+}
+
+func addressWithPort(host, port string) (Address, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return Address{}, logs.Errorf("dsn: unable to parse port: %s", port)
+	}
+
+	return Address{Host: host, Port: p}, nil
+}
+
+// JoinHosts is the reverse of ParseHosts, ports matching defaultPort are left out
+func JoinHosts(addrs []Address, defaultPort int) string {
+	hosts := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if a.Port == defaultPort {
+			if strings.Contains(a.Host, ":") {
+				hosts = append(hosts, "["+a.Host+"]")
+				continue
+			}
+			hosts = append(hosts, a.Host)
+			continue
+		}
+		hosts = append(hosts, a.String())
+	}
+
+	return strings.Join(hosts, ",")
+}
+
+// Config is everything that goes into a connection string
+type Config struct {
+	User      string
+	Password  secrets.Secret
+	Addresses []Address
+	DBName    string
+	Params    url.Values
+}
+
+// WithAddress is a copy of the config that only connects to addr
+func (c Config) WithAddress(addr Address) Config {
+	c.Addresses = []Address{addr}
+	return c
+}
+
+func (c Config) userinfo() *url.Userinfo {
+	if c.User == "" && c.Password.IsZero() {
+		return nil
+	}
+	if c.Password.IsZero() {
+		return url.User(c.User)
+	}
+
+	return url.UserPassword(c.User, c.Password.Reveal())
+}
+
+// Postgres is a postgres:// URL, hosts go in the authority when url parsing can cope with them
+// and in the host and port params otherwise (unix sockets, several IPv6 hosts)
+func (c Config) Postgres() string {
+	params := url.Values{}
+	for k, v := range c.Params {
+		params[k] = append([]string(nil), v...)
+	}
+
+	u := &url.URL{
+		Scheme: "postgres",
+		User:   c.userinfo(),
+		Path:   "/" + c.DBName,
+	}
+
+	switch {
+	case len(c.Addresses) == 0:
+	case inAuthority(c.Addresses):
+		hosts := make([]string, 0, len(c.Addresses))
+		for _, a := range c.Addresses {
+			hosts = append(hosts, a.String())
+		}
+		u.Host = strings.Join(hosts, ",")
+	default:
+		hosts := make([]string, 0, len(c.Addresses))
+		ports := make([]string, 0, len(c.Addresses))
+		for _, a := range c.Addresses {
+			hosts = append(hosts, a.Host)
+			ports = append(ports, strconv.Itoa(a.Port))
+		}
+		params.Set("host", strings.Join(hosts, ","))
+		params.Set("port", strings.Join(ports, ","))
+	}
+
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+func inAuthority(addrs []Address) bool {
+	ipv6 := 0
+	for _, a := range addrs {
+		if a.IsUnix() {
+			return false
+		}
+		if strings.Contains(a.Host, ":") {
+			ipv6++
+		}
+	}
+
+	return len(addrs) == 1 || ipv6 == 0
+}
+
+// ParsePostgres reads a postgres:// or postgresql:// URL, including host lists in the authority
+// (IPv6 hosts in brackets) and the host and port params
+func ParsePostgres(connStr string, defaultPort int) (Config, error) {
+	return parseURL(connStr, defaultPort, "postgres", "postgresql")
+}
+
+// ParseMySQL reads a mysql:// URL, hosts are read the same way as ParsePostgres
+func ParseMySQL(connStr string, defaultPort int) (Config, error) {
+	return parseURL(connStr, defaultPort, "mysql")
+}
+
+func parseURL(connStr string, defaultPort int, schemes ...string) (Config, error) {
+	scheme, rest, ok := strings.Cut(connStr, "://")
+	if !ok || !slices.Contains(schemes, scheme) {
+		return Config{}, logs.Errorf("dsn: unable to use connection string scheme: %s", scheme)
+	}
+
+	// the authority runs to the first / or ?, the host list in it can be more than url.Parse handles
+	end := strings.IndexAny(rest, "/?")
+	if end < 0 {
+		end = len(rest)
+	}
+	authority, tail := rest[:end], rest[end:]
+	hosts := authority
+	userinfo := ""
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		userinfo, hosts = authority[:at+1], authority[at+1:]
+	}
+
+	u, err := url.Parse(scheme + "://" + userinfo + "placeholder" + tail)
+	if err != nil {
+		return Config{}, logs.Errorf("dsn: unable to parse connection string: %v", err)
+	}
+
+	c := Config{
+		DBName: strings.TrimPrefix(u.Path, "/"),
+		Params: u.Query(),
+	}
+	if u.User != nil {
+		c.User = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			c.Password = secrets.New(p)
+		}
+	}
+
+	if hp := c.Params.Get("host"); hp != "" {
+		hosts = hp
+	}
+	c.Params.Del("host")
+	hostList, err := url.PathUnescape(hosts)
+	if err != nil {
+		return Config{}, logs.Errorf("dsn: unable to parse hosts: %v", err)
+	}
+	if c.Addresses, err = ParseHosts(hostList, defaultPort); err != nil {
+		return Config{}, err
+	}
+
+	if pp := c.Params.Get("port"); pp != "" {
+		ports := strings.Split(pp, ",")
+		for i := range c.Addresses {
+			// libpq reuses a single port for every host
+			port := ports[0]
+			if len(ports) > 1 {
+				if i >= len(ports) {
+					return Config{}, logs.Errorf("dsn: unable to match %d ports to %d hosts", len(ports), len(c.Addresses))
+				}
+				port = ports[i]
+			}
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return Config{}, logs.Errorf("dsn: unable to parse port: %s", port)
+			}
+			c.Addresses[i].Port = p
+		}
+	}
+	c.Params.Del("port")
+
+	return c, nil
+}
+
+// MySQL is a go-sql-driver DSN for the first address, user:password@tcp(host:port)/db?params,
+// formatted by the driver itself so it parses back the way it was built
+func (c Config) MySQL() string {
+	cfg := mysql.NewConfig()
+	cfg.User = c.User
+	cfg.Passwd = c.Password.Reveal()
+	cfg.DBName = c.DBName
+
+	if len(c.Addresses) > 0 {
+		a := c.Addresses[0]
+		cfg.Net = "tcp"
+		cfg.Addr = a.String()
+		if a.IsUnix() {
+			cfg.Net = "unix"
+			cfg.Addr = a.Host
+		}
+	}
+
+	// the driver reads its own settings such as parseTime and loc back out of the formatted params
+	if len(c.Params) > 0 {
+		cfg.Params = make(map[string]string, len(c.Params))
+		for k := range c.Params {
+			cfg.Params[k] = c.Params.Get(k)
+		}
+	}
+
+	return cfg.FormatDSN()
+}
+
+// Mongo is a mongodb:// or mongodb+srv:// URL with every address in the authority, IPv6 hosts in brackets and
+// unix sockets escaped, DBName is the path so it is also the default auth database
+func (c Config) Mongo(scheme string) string {
+	u := &url.URL{
+		Scheme:   scheme,
+		User:     c.userinfo(),
+		Host:     JoinHosts(c.Addresses, 0),
+		Path:     "/" + c.DBName,
+		RawQuery: c.Params.Encode(),
+	}
+
+	return u.String()
+}
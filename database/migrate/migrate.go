@@ -0,0 +1,245 @@
+// Package migrate loads versioned SQL migrations from an fs.FS and plans and runs them against a Store,
+// the postgres and mysql subsystems provide the stores
+package migrate
+
+import (
+	"context"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+)
+
+const DefaultTable = "schema_migrations"
+
+var (
+	fileName   = regexp.MustCompile(`^(\d+)_([^.]+)(\.(up|down))?\.sql$`)
+	identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+type Direction string
+
+const (
+	Up   Direction = "up"
+	Down Direction = "down"
+)
+
+// Migration is one version, "0002_add_orders.up.sql" and "0002_add_orders.down.sql" (or just "0002_add_orders.sql")
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Options struct {
+	Direction Direction
+	// Steps is how many migrations to roll back, 0 rolls back everything, it is ignored going up
+	Steps  int
+	DryRun bool
+	Table  string
+}
+
+type Option func(*Options)
+
+// WithDown rolls back the last steps migrations that were applied, 0 rolls back all of them
+func WithDown(steps int) Option {
+	return func(o *Options) {
+		o.Direction = Down
+		o.Steps = steps
+	}
+}
+
+// WithDryRun plans the run without touching the database
+func WithDryRun() Option {
+	return func(o *Options) {
+		o.DryRun = true
+	}
+}
+
+// WithTable records applied versions in table instead of schema_migrations
+func WithTable(table string) Option {
+	return func(o *Options) {
+		o.Table = table
+	}
+}
+
+func NewOptions(opts ...Option) (Options, error) {
+	o := Options{
+		Direction: Up,
+		Table:     DefaultTable,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if !identifier.MatchString(o.Table) {
+		return o, logs.Errorf("migrate: unable to use table name: %s", o.Table)
+	}
+
+	return o, nil
+}
+
+// Result lists the migrations that ran, or would have on a dry run, in the order they ran
+type Result struct {
+	Direction  Direction
+	DryRun     bool
+	Migrations []Migration
+}
+
+// Store is a database that can hold the lock and the record of applied versions
+type Store interface {
+	// Lock blocks until this process is the only one migrating
+	Lock(ctx context.Context) error
+	Unlock(ctx context.Context) error
+	// Prepare creates the versions table when it doesn't exist
+	Prepare(ctx context.Context) error
+	// Applied lists the recorded versions, none when there is no versions table yet
+	Applied(ctx context.Context) (map[int64]bool, error)
+	// Apply runs the migration's sql for the direction and records it, in one transaction
+	Apply(ctx context.Context, m Migration, d Direction) error
+}
+
+// Load reads the migrations in the root of fsys, use fs.Sub for a directory of an embed.FS
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, logs.Errorf("migrate: unable to read migrations: %v", err)
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		match := fileName.FindStringSubmatch(e.Name())
+		if match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, logs.Errorf("migrate: unable to parse version: %s", e.Name())
+		}
+		body, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, logs.Errorf("migrate: unable to read %s: %v", e.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, logs.Errorf("migrate: unable to use version %d for both %s and %s", version, m.Name, match[2])
+		}
+
+		if match[4] == string(Down) {
+			if m.Down != "" {
+				return nil, logs.Errorf("migrate: unable to use two down migrations for version %d", version)
+			}
+			m.Down = string(body)
+			continue
+		}
+		if m.Up != "" {
+			return nil, logs.Errorf("migrate: unable to use two up migrations for version %d", version)
+		}
+		m.Up = string(body)
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Plan is the migrations to run, pending ones oldest first going up and applied ones newest first going down
+func Plan(migrations []Migration, applied map[int64]bool, o Options) ([]Migration, error) {
+	var plan []Migration
+
+	if o.Direction == Down {
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if !applied[m.Version] {
+				continue
+			}
+			if strings.TrimSpace(m.Down) == "" {
+				return nil, logs.Errorf("migrate: unable to roll back version %d without a down migration", m.Version)
+			}
+			plan = append(plan, m)
+			if o.Steps > 0 && len(plan) == o.Steps {
+				break
+			}
+		}
+
+		return plan, nil
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		if strings.TrimSpace(m.Up) == "" {
+			return nil, logs.Errorf("migrate: unable to apply version %d without an up migration", m.Version)
+		}
+		plan = append(plan, m)
+	}
+
+	return plan, nil
+}
+
+// Run applies the plan while holding the store's lock, stopping at the first migration that fails
+func Run(ctx context.Context, store Store, fsys fs.FS, o Options) (Result, error) {
+	res := Result{Direction: o.Direction, DryRun: o.DryRun}
+
+	migrations, err := Load(fsys)
+	if err != nil {
+		return res, err
+	}
+
+	if err := store.Lock(ctx); err != nil {
+		return res, err
+	}
+	defer func() {
+		if err := store.Unlock(context.WithoutCancel(ctx)); err != nil {
+			logs.Infof("migrate: unable to release lock: %v", err)
+		}
+	}()
+
+	if !o.DryRun {
+		if err := store.Prepare(ctx); err != nil {
+			return res, err
+		}
+	}
+	applied, err := store.Applied(ctx)
+	if err != nil {
+		return res, err
+	}
+	plan, err := Plan(migrations, applied, o)
+	if err != nil {
+		return res, err
+	}
+
+	if o.DryRun {
+		res.Migrations = plan
+		return res, nil
+	}
+
+	for _, m := range plan {
+		if err := store.Apply(ctx, m, o.Direction); err != nil {
+			return res, logs.Errorf("migrate: unable to %s version %d %s: %v", o.Direction, m.Version, m.Name, err)
+		}
+		res.Migrations = append(res.Migrations, m)
+	}
+
+	return res, nil
+}
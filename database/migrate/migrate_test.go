@@ -0,0 +1,153 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var files = fstest.MapFS{
+	"0001_users.up.sql":     {Data: []byte("CREATE TABLE users (id INT);")},
+	"0001_users.down.sql":   {Data: []byte("DROP TABLE users;")},
+	"0002_orders.up.sql":    {Data: []byte("CREATE TABLE orders (id INT);")},
+	"0002_orders.down.sql":  {Data: []byte("DROP TABLE orders;")},
+	"0010_index.sql":        {Data: []byte("CREATE INDEX orders_id ON orders (id);")},
+	"readme.md":             {Data: []byte("not a migration")},
+	"seed/0003_data.up.sql": {Data: []byte("nested files are skipped")},
+}
+
+type fakeStore struct {
+	applied  map[int64]bool
+	ran      []string
+	locked   bool
+	prepared bool
+	failOn   int64
+}
+
+func (f *fakeStore) Lock(context.Context) error {
+	f.locked = true
+	return nil
+}
+
+func (f *fakeStore) Unlock(context.Context) error {
+	f.locked = false
+	return nil
+}
+
+func (f *fakeStore) Prepare(context.Context) error {
+	f.prepared = true
+	return nil
+}
+
+func (f *fakeStore) Applied(context.Context) (map[int64]bool, error) {
+	return f.applied, nil
+}
+
+func (f *fakeStore) Apply(_ context.Context, m Migration, d Direction) error {
+	if !f.locked {
+		return errors.New("not locked")
+	}
+	if m.Version == f.failOn {
+		return errors.New("syntax error")
+	}
+	if d == Down {
+		f.ran = append(f.ran, m.Down)
+		delete(f.applied, m.Version)
+		return nil
+	}
+	f.ran = append(f.ran, m.Up)
+	f.applied[m.Version] = true
+	return nil
+}
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load(files)
+	require.NoError(t, err)
+	require.Len(t, migrations, 3)
+
+	assert.Equal(t, Migration{Version: 1, Name: "users", Up: "CREATE TABLE users (id INT);", Down: "DROP TABLE users;"}, migrations[0])
+	assert.Equal(t, int64(2), migrations[1].Version)
+	assert.Equal(t, int64(10), migrations[2].Version)
+	assert.Equal(t, "index", migrations[2].Name)
+	assert.Empty(t, migrations[2].Down)
+}
+
+func TestLoadDuplicateVersion(t *testing.T) {
+	_, err := Load(fstest.MapFS{
+		"0001_users.up.sql":  {Data: []byte("SELECT 1;")},
+		"0001_orders.up.sql": {Data: []byte("SELECT 2;")},
+	})
+	assert.Error(t, err)
+}
+
+func TestRunUp(t *testing.T) {
+	store := &fakeStore{applied: map[int64]bool{1: true}}
+	o, err := NewOptions()
+	require.NoError(t, err)
+
+	res, err := Run(context.Background(), store, files, o)
+	require.NoError(t, err)
+	assert.Equal(t, Up, res.Direction)
+	require.Len(t, res.Migrations, 2)
+	assert.Equal(t, int64(2), res.Migrations[0].Version)
+	assert.Equal(t, int64(10), res.Migrations[1].Version)
+	assert.Equal(t, []string{"CREATE TABLE orders (id INT);", "CREATE INDEX orders_id ON orders (id);"}, store.ran)
+	assert.True(t, store.prepared)
+	assert.False(t, store.locked)
+}
+
+func TestRunDown(t *testing.T) {
+	store := &fakeStore{applied: map[int64]bool{1: true, 2: true}}
+	o, err := NewOptions(WithDown(1))
+	require.NoError(t, err)
+
+	res, err := Run(context.Background(), store, files, o)
+	require.NoError(t, err)
+	require.Len(t, res.Migrations, 1)
+	assert.Equal(t, []string{"DROP TABLE orders;"}, store.ran)
+	assert.Equal(t, map[int64]bool{1: true}, store.applied)
+
+	o, err = NewOptions(WithDown(0))
+	require.NoError(t, err)
+	store.applied[10] = true
+	_, err = Run(context.Background(), store, files, o)
+	assert.Error(t, err, "version 10 has no down migration")
+}
+
+func TestRunDryRun(t *testing.T) {
+	store := &fakeStore{applied: map[int64]bool{}}
+	o, err := NewOptions(WithDryRun())
+	require.NoError(t, err)
+
+	res, err := Run(context.Background(), store, files, o)
+	require.NoError(t, err)
+	assert.True(t, res.DryRun)
+	assert.Len(t, res.Migrations, 3)
+	assert.Empty(t, store.ran)
+	assert.False(t, store.prepared)
+}
+
+func TestRunStopsOnFailure(t *testing.T) {
+	store := &fakeStore{applied: map[int64]bool{}, failOn: 2}
+	o, err := NewOptions()
+	require.NoError(t, err)
+
+	res, err := Run(context.Background(), store, files, o)
+	assert.Error(t, err)
+	assert.Len(t, res.Migrations, 1)
+	assert.Equal(t, map[int64]bool{1: true}, store.applied)
+	assert.False(t, store.locked)
+}
+
+func TestNewOptionsTable(t *testing.T) {
+	_, err := NewOptions(WithTable("versions; DROP TABLE users"))
+	assert.Error(t, err)
+
+	o, err := NewOptions(WithTable("service_versions"))
+	require.NoError(t, err)
+	assert.Equal(t, "service_versions", o.Table)
+}
@@ -0,0 +1,45 @@
+package mongo
+
+import (
+	"context"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Client is the system's managed client, connected on first use and replaced when the vault credentials change,
+// every copy of the system and every repository shares it, so close it with System.Disconnect rather than on the client
+func (s *System) Client() (*mongo.Client, error) {
+	if s.managed == nil {
+		return nil, logs.Error("mongo: unable to get client without building the system")
+	}
+
+	return s.managed.GetMongoClient(*s)
+}
+
+// Disconnect closes the managed client for every copy of the system, the next use by any of them connects again
+func (s *System) Disconnect(ctx context.Context) error {
+	if s.managed == nil {
+		return nil
+	}
+
+	return s.managed.Disconnect(ctx)
+}
+
+// collection is a logical collection from Details.Collections on the managed client, inside WithTransaction it is
+// on the session's client so the transaction stays on one client even if a refresh swaps the managed one
+func (s *System) collection(ctx context.Context, logical string) (*mongo.Collection, error) {
+	if s.managed == nil {
+		return nil, logs.Error("mongo: unable to get collection without building the system")
+	}
+
+	c, err := s.managed.logicalCollection(*s, logical)
+	if err != nil {
+		return nil, err
+	}
+	if sess := mongo.SessionFromContext(ctx); sess != nil && sess.Client() != c.Database().Client() {
+		return sess.Client().Database(c.Database().Name()).Collection(c.Name()), nil
+	}
+
+	return c, nil
+}
@@ -2,31 +2,53 @@ package mongo
 
 import (
 	"context"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/caarlos0/env/v8"
+	"github.com/keloran/go-config/database/dsn"
+	"github.com/keloran/go-config/secrets"
+	"github.com/keloran/go-config/telemetry"
+	"github.com/keloran/go-config/vault"
 	vaultHelper "github.com/keloran/vault-helper"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
+const (
+	schemeMongo = "mongodb"
+	schemeSRV   = "mongodb+srv"
+)
+
 type VaultDetails struct {
-	Path        string `env:"MONGO_VAULT_PATH" envDefault:"secret/data/chewedfeed/mongo"`
-	CredPath    string `env:"MONGO_VAULT_CRED_PATH" envDefault:"secret/data/chewedfeed/mongo"`
-	DetailsPath string `env:"MONGO_VAULT_DETAILS_PATH" envDefault:"secret/data/chewedfeed/details"`
+	Path        string `env:"MONGO_VAULT_PATH"`
+	CredPath    string `env:"MONGO_VAULT_CRED_PATH"`
+	DetailsPath string `env:"MONGO_VAULT_DETAILS_PATH"`
 
 	ExpireTime time.Time
+	// refreshAt is when a rebuild should fetch new credentials, ahead of ExpireTime
+	refreshAt time.Time
 }
 
 type Details struct {
-	Host     string `env:"MONGO_HOST" envDefault:"localhost"`
-	Username string `env:"MONGO_USER" envDefault:""`
-	Password string `env:"MONGO_PASS" envDefault:""`
-	Database string `env:"MONGO_DB" envDefault:""`
-	RawURL   string `env:"MONGO_URL" envDefault:"mongodb://localhost:27017"`
+	// Host is a comma separated list of hosts, a port is optional, with mongodb+srv it is the one SRV name
+	Host     string         `env:"MONGO_HOST" envDefault:"localhost"`
+	Username string         `env:"MONGO_USER" envDefault:""`
+	Password secrets.Secret `env:"MONGO_PASS" envDefault:""`
+	Database string         `env:"MONGO_DB" envDefault:""`
+	// RawURL is used as it is when set, apart from the credentials which Username and Password replace
+	RawURL string `env:"MONGO_URL"`
+
+	Scheme     string `env:"MONGO_SCHEME" envDefault:"mongodb"`
+	ReplicaSet string `env:"MONGO_REPLICA_SET"`
+	AuthSource string `env:"MONGO_AUTH_SOURCE"`
+	TLS        bool   `env:"MONGO_TLS"`
+	TLSCAFile  string `env:"MONGO_TLS_CA_FILE"`
+	// Options are any other URI options as a query string, "w=majority&retryWrites=false", they win over the fields
+	Options string `env:"MONGO_OPTIONS"`
 
 	Collections map[string]string
 	Collection  string
@@ -41,6 +63,17 @@ type System struct {
 
 	VaultDetails
 	VaultHelper *vaultHelper.VaultHelper
+
+	// Telemetry traces every command when set
+	Telemetry *telemetry.Telemetry
+
+	// Schemas are the indexes and validators EnsureSchema applies, keyed by logical collection
+	Schemas map[string]Schema
+
+	// env is what Build found in env, vault rebuilds only fill in what it left unset
+	env *Details
+	// managed is the client behind Client and the repositories, every copy of the system shares it
+	managed *RealMongoOperations
 }
 
 type MungoOperations interface {
@@ -65,6 +98,7 @@ type MungoClient interface {
 func NewSystem() *System {
 	return &System{
 		Context: context.Background(),
+		managed: &RealMongoOperations{},
 	}
 }
 
@@ -74,6 +108,10 @@ func (s *System) Setup(vd VaultDetails, vh vaultHelper.VaultHelper) {
 }
 
 func (s *System) Build() (*Details, error) {
+	if s.managed == nil {
+		s.managed = &RealMongoOperations{}
+	}
+
 	gen, err := s.buildGeneric()
 	if err != nil {
 		return nil, err
@@ -86,9 +124,49 @@ func (s *System) Build() (*Details, error) {
 	return gen, nil
 }
 
+// configured is the details before vault filled them in, so a refresh reads new credentials rather than keeping the old ones
+func (s *System) configured() Details {
+	if s.env != nil {
+		return *s.env
+	}
+
+	return s.Details
+}
+
+// resolvePaths fills in the vault paths Setup was given without, under the root from VAULT_PATH_PREFIX
+func (s *System) resolvePaths() error {
+	if s.VaultDetails.Path != "" && s.VaultDetails.CredPath != "" && s.VaultDetails.DetailsPath != "" {
+		return nil
+	}
+
+	root, err := vault.BuildRoot()
+	if err != nil {
+		return logs.Errorf("mongo: unable to build vault root: %v", err)
+	}
+	s.VaultDetails.Path = root.Resolve(s.VaultDetails.Path, "mongo")
+	s.VaultDetails.CredPath = root.Resolve(s.VaultDetails.CredPath, "mongo")
+	s.VaultDetails.DetailsPath = root.Resolve(s.VaultDetails.DetailsPath, "details")
+
+	return nil
+}
+
 func (s *System) buildVault() (*Details, error) {
-	rab := &Details{}
+	if err := s.resolvePaths(); err != nil {
+		return nil, err
+	}
+
 	vh := *s.VaultHelper
+	// vault only holds credentials and where to connect, how to connect stays as env set it
+	set := s.configured()
+	rab := &Details{
+		RawURL:     set.RawURL,
+		Scheme:     set.Scheme,
+		ReplicaSet: set.ReplicaSet,
+		AuthSource: set.AuthSource,
+		TLS:        set.TLS,
+		TLSCAFile:  set.TLSCAFile,
+		Options:    set.Options,
+	}
 
 	// Credentials
 	if err := vh.GetSecrets(s.VaultDetails.CredPath); err != nil {
@@ -98,24 +176,24 @@ func (s *System) buildVault() (*Details, error) {
 		return nil, logs.Error("mongo: unable to find credential secrets")
 	}
 
-	if s.Details.Username == "" {
+	if set.Username == "" {
 		secret, err := vh.GetSecret("username")
 		if err != nil {
 			return nil, logs.Errorf("mongo: unable to get username: %v", err)
 		}
 		rab.Username = secret
 	} else {
-		rab.Username = s.Details.Username
+		rab.Username = set.Username
 	}
 
-	if s.Details.Password == "" {
+	if set.Password.IsZero() {
 		secret, err := vh.GetSecret("password")
 		if err != nil {
 			return nil, logs.Errorf("mongo: unable to get password: %v", err)
 		}
-		rab.Password = secret
+		rab.Password = secrets.New(secret)
 	} else {
-		rab.Password = s.Details.Password
+		rab.Password = set.Password
 	}
 
 	// Details
@@ -126,24 +204,26 @@ func (s *System) buildVault() (*Details, error) {
 		return nil, logs.Error("mongo: unable to find detail secrets")
 	}
 
-	if s.Details.Host == "" {
+	// get the host based on the username, since host has a default in env
+	rab.Host = set.Host
+	if set.Username == "" {
 		secret, err := vh.GetSecret("mongo-hostname")
-		if err != nil {
+		if err != nil && !strings.Contains(err.Error(), "not found") {
 			return nil, logs.Errorf("mongo: unable to get hostname: %v", err)
 		}
-		rab.Host = secret
-	} else {
-		rab.Host = s.Details.Host
+		if secret != "" {
+			rab.Host = secret
+		}
 	}
 
-	if s.Details.Database == "" {
+	if set.Database == "" {
 		secret, err := vh.GetSecret("mongo-db")
 		if err != nil {
 			return nil, logs.Errorf("mongo: unable to get database: %v", err)
 		}
 		rab.Database = secret
 	} else {
-		rab.Database = s.Details.Database
+		rab.Database = set.Database
 	}
 
 	preCollections, err := vh.GetSecret("mongo-collections")
@@ -161,10 +241,37 @@ func (s *System) buildVault() (*Details, error) {
 	}
 	rab.Collections = rabCollections
 
+	s.setLease(time.Duration(vh.LeaseDuration()) * time.Second)
 	s.Details = *rab
 
 	return rab, nil
+}
 
+// setLease schedules the next refresh half way through a short lease and an hour before a long one ends,
+// static secrets have no lease and are re-read every hour so rotated credentials are still picked up
+func (s *System) setLease(lease time.Duration) {
+	now := time.Now()
+	if lease <= 0 {
+		s.ExpireTime = time.Time{}
+		s.refreshAt = now.Add(vaultRefreshBuffer * time.Second)
+		return
+	}
+
+	s.ExpireTime = now.Add(lease)
+	s.refreshAt = s.ExpireTime.Add(-min(vaultRefreshBuffer*time.Second, lease/2))
+}
+
+// needsRefresh is whether the vault credentials are due to be read again
+func (s *System) needsRefresh() bool {
+	if s.VaultHelper == nil {
+		return false
+	}
+	if s.refreshAt.IsZero() {
+		// never built from vault here, fall back to the expire time
+		return time.Now().Unix() > s.ExpireTime.Unix()-vaultRefreshBuffer
+	}
+
+	return !time.Now().Before(s.refreshAt)
 }
 
 func (s *System) buildGeneric() (*Details, error) {
@@ -178,10 +285,105 @@ func (s *System) buildGeneric() (*Details, error) {
 	rab.Collections = BuildCollections()
 
 	s.Details = *rab
+	set := s.Details
+	s.env = &set
 
 	return rab, nil
 }
 
+// ConnectionString is RawURL with Username and Password in place of its credentials when it is set, otherwise
+// it is built from the parts with every part escaped
+func (d Details) ConnectionString() (string, error) {
+	if d.RawURL != "" {
+		return d.withCredentials(d.RawURL)
+	}
+
+	if d.Scheme != schemeMongo && d.Scheme != schemeSRV {
+		return "", logs.Errorf("mongo: unable to use scheme: %s", d.Scheme)
+	}
+
+	addrs, err := dsn.ParseHosts(d.Host, 0)
+	if err != nil {
+		return "", logs.Errorf("mongo: unable to parse hosts: %v", err)
+	}
+	if len(addrs) == 0 {
+		return "", logs.Error("mongo: unable to connect without a host")
+	}
+	if d.Scheme == schemeSRV && (len(addrs) > 1 || addrs[0].Port != 0) {
+		return "", logs.Errorf("mongo: unable to use %s with more than one host or a port: %s", schemeSRV, d.Host)
+	}
+
+	params, err := d.params()
+	if err != nil {
+		return "", err
+	}
+
+	c := dsn.Config{
+		Addresses: addrs,
+		Params:    params,
+	}
+	if d.Username != "" {
+		c.User = d.Username
+		c.Password = d.Password
+	}
+
+	return c.Mongo(d.Scheme), nil
+}
+
+// params are the URI options from the fields with Options on top
+func (d Details) params() (url.Values, error) {
+	params := url.Values{}
+	if d.ReplicaSet != "" {
+		params.Set("replicaSet", d.ReplicaSet)
+	}
+	if d.AuthSource != "" {
+		params.Set("authSource", d.AuthSource)
+	}
+	if d.TLS {
+		params.Set("tls", "true")
+	}
+	if d.TLSCAFile != "" {
+		params.Set("tlsCAFile", d.TLSCAFile)
+	}
+
+	extra, err := url.ParseQuery(d.Options)
+	if err != nil {
+		return nil, logs.Errorf("mongo: unable to parse options: %v", err)
+	}
+	for k, v := range extra {
+		params[k] = v
+	}
+
+	return params, nil
+}
+
+// withCredentials swaps the credentials in rawURL for Username and Password, the rest of it is left as it is
+func (d Details) withCredentials(rawURL string) (string, error) {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok || scheme != schemeMongo && scheme != schemeSRV {
+		return "", logs.Errorf("mongo: unable to use connection string scheme: %s", scheme)
+	}
+	if d.Username == "" {
+		return rawURL, nil
+	}
+
+	// the authority runs to the first / or ?, the password in it may have an @ so the hosts start after the last one
+	end := strings.IndexAny(rest, "/?")
+	if end < 0 {
+		end = len(rest)
+	}
+	if at := strings.LastIndex(rest[:end], "@"); at >= 0 {
+		rest = rest[at+1:]
+	}
+
+	user := url.User(d.Username)
+	if !d.Password.IsZero() {
+		user = url.UserPassword(d.Username, d.Password.Reveal())
+	}
+
+	return scheme + "://" + user.String() + "@" + rest, nil
+}
+
 func BuildCollections() map[string]string {
 	col := make(map[string]string)
 	for _, e := range os.Environ() {
@@ -5,13 +5,18 @@ package mongo
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/mongodb"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
 func setupMongo(ctx context.Context) (*mongodb.MongoDBContainer, error) {
@@ -67,3 +72,292 @@ func TestMockMungoClient_Connect(t *testing.T) {
 	}()
 	assert.NotNil(t, conn)
 }
+
+type testUser struct {
+	ID    bson.ObjectID `bson:"_id,omitempty"`
+	Name  string        `bson:"name"`
+	Age   int           `bson:"age"`
+	Group string        `bson:"group"`
+}
+
+func TestRepository(t *testing.T) {
+	os.Clearenv()
+	ctx := context.Background()
+	m, err := setupMongo(ctx)
+	require.NoError(t, err)
+	defer func() {
+		if err := shutdownMongo(ctx, m); err != nil {
+			t.Logf("failed to shutdown mongo: %v", err)
+		}
+	}()
+
+	connectionString, err := m.ConnectionString(ctx)
+	require.NoError(t, err)
+	require.NoError(t, os.Setenv("MONGO_URL", connectionString))
+	require.NoError(t, os.Setenv("MONGO_DB", "test"))
+	require.NoError(t, os.Setenv("MONGO_COLLECTION_USERS", "users"))
+
+	s := NewSystem()
+	_, err = s.Build()
+	require.NoError(t, err)
+	defer func() {
+		_ = s.Disconnect(ctx)
+	}()
+
+	users, err := NewRepository[testUser](s, "users")
+	require.NoError(t, err)
+
+	ids, err := users.Insert(ctx,
+		testUser{Name: "alice", Age: 30, Group: "a"},
+		testUser{Name: "bob", Age: 25, Group: "b"},
+		testUser{Name: "carol", Age: 35, Group: "a"},
+	)
+	require.NoError(t, err)
+	assert.Len(t, ids, 3)
+
+	alice, err := users.FindOne(ctx, bson.M{"name": "alice"})
+	require.NoError(t, err)
+	assert.Equal(t, 30, alice.Age)
+	_, err = users.FindOne(ctx, bson.M{"name": "nobody"})
+	assert.ErrorIs(t, err, mongo.ErrNoDocuments)
+
+	page, err := users.Find(ctx, nil, WithSort(bson.D{{Key: "age", Value: 1}}), WithPage(2, 2))
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	assert.Equal(t, "carol", page[0].Name)
+
+	names, err := users.Find(ctx, bson.M{"group": "a"}, WithProjection(bson.M{"name": 1}))
+	require.NoError(t, err)
+	require.Len(t, names, 2)
+	assert.Zero(t, names[0].Age)
+
+	res, err := users.Update(ctx, bson.M{"group": "a"}, bson.M{"$inc": bson.M{"age": 1}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), res.ModifiedCount)
+
+	res, err = users.Upsert(ctx, bson.M{"name": "dave"}, testUser{Name: "dave", Age: 40, Group: "b"})
+	require.NoError(t, err)
+	assert.NotNil(t, res.UpsertedID)
+
+	n, err := users.Count(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+
+	type groupAge struct {
+		Group string `bson:"_id"`
+		Total int    `bson:"total"`
+	}
+	groups, err := AggregateAs[groupAge](ctx, users, mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$group"}, {Key: "total", Value: bson.D{{Key: "$sum", Value: "$age"}}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []groupAge{{"a", 67}, {"b", 65}}, groups)
+
+	deleted, err := users.Delete(ctx, bson.M{"group": "b"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+}
+
+func TestWithTransaction(t *testing.T) {
+	os.Clearenv()
+	ctx := context.Background()
+	// transactions need a replica set
+	m, err := mongodb.Run(ctx, "mongo:latest", mongodb.WithReplicaSet("rs0"))
+	require.NoError(t, err)
+	defer func() {
+		if err := shutdownMongo(ctx, m); err != nil {
+			t.Logf("failed to shutdown mongo: %v", err)
+		}
+	}()
+
+	connectionString, err := m.ConnectionString(ctx)
+	require.NoError(t, err)
+	require.NoError(t, os.Setenv("MONGO_URL", connectionString))
+	require.NoError(t, os.Setenv("MONGO_DB", "test"))
+	require.NoError(t, os.Setenv("MONGO_COLLECTION_USERS", "users"))
+
+	s := NewSystem()
+	_, err = s.Build()
+	require.NoError(t, err)
+	defer func() {
+		_ = s.Disconnect(ctx)
+	}()
+
+	users, err := NewRepository[testUser](s, "users")
+	require.NoError(t, err)
+	// collections can't be created inside a transaction on older servers
+	_, err = users.Insert(ctx, testUser{Name: "seed"})
+	require.NoError(t, err)
+
+	err = s.WithTransaction(ctx, func(ctx context.Context) error {
+		if _, err := users.Insert(ctx, testUser{Name: "alice"}, testUser{Name: "bob"}); err != nil {
+			return err
+		}
+		// not visible outside the transaction until it commits
+		n, err := users.Count(context.Background(), bson.M{"name": "alice"})
+		require.NoError(t, err)
+		assert.Zero(t, n)
+		return nil
+	})
+	require.NoError(t, err)
+	n, err := users.Count(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	failed := errors.New("rollback")
+	err = s.WithTransaction(ctx, func(ctx context.Context) error {
+		if _, err := users.Delete(ctx, nil); err != nil {
+			return err
+		}
+		return failed
+	})
+	assert.ErrorIs(t, err, failed)
+	n, err = users.Count(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+}
+
+func TestEnsureSchema(t *testing.T) {
+	os.Clearenv()
+	ctx := context.Background()
+	m, err := setupMongo(ctx)
+	require.NoError(t, err)
+	defer func() {
+		if err := shutdownMongo(ctx, m); err != nil {
+			t.Logf("failed to shutdown mongo: %v", err)
+		}
+	}()
+
+	connectionString, err := m.ConnectionString(ctx)
+	require.NoError(t, err)
+	require.NoError(t, os.Setenv("MONGO_URL", connectionString))
+	require.NoError(t, os.Setenv("MONGO_DB", "test"))
+	require.NoError(t, os.Setenv("MONGO_COLLECTION_USERS", "users"))
+
+	s := NewSystem()
+	_, err = s.Build()
+	require.NoError(t, err)
+	defer func() {
+		_ = s.Disconnect(ctx)
+	}()
+
+	s.Schemas = map[string]Schema{
+		"users": {
+			Indexes: []Index{
+				{Keys: bson.D{{Key: "name", Value: 1}}, Unique: true},
+				{Keys: bson.D{{Key: "seen", Value: 1}}, TTL: time.Hour},
+				{Keys: bson.D{{Key: "group", Value: 1}}, PartialFilter: bson.M{"age": bson.M{"$gt": 18}}},
+			},
+			Validator: bson.M{"bsonType": "object", "required": bson.A{"name"}},
+		},
+	}
+
+	report, err := s.EnsureSchema(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"users", "users.name_1", "users.seen_1", "users.group_1"}, report.Created)
+	assert.Empty(t, report.Drift)
+
+	// running again changes nothing
+	report, err = s.EnsureSchema(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, report.Created)
+	assert.Empty(t, report.Updated)
+	assert.Empty(t, report.Drift)
+
+	users, err := NewRepository[bson.M](s, "users")
+	require.NoError(t, err)
+	_, err = users.Insert(ctx, bson.M{"age": 1})
+	assert.Error(t, err, "the validator requires a name")
+
+	c, err := s.collection(ctx, "users")
+	require.NoError(t, err)
+	_, err = c.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "age", Value: 1}}})
+	require.NoError(t, err)
+
+	schema := s.Schemas["users"]
+	schema.Indexes[0].Unique = false
+	schema.Indexes[1].TTL = 2 * time.Hour
+	schema.ValidationAction = "warn"
+	s.Schemas["users"] = schema
+
+	report, err = s.EnsureSchema(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, report.Created)
+	assert.ElementsMatch(t, []string{"users: validator", "users.seen_1: ttl"}, report.Updated)
+	assert.ElementsMatch(t, []string{"users.name_1: unique is true, declared false", "users.age_1: index is not declared"}, report.Drift)
+}
+
+func TestWatch(t *testing.T) {
+	os.Clearenv()
+	ctx := context.Background()
+	// change streams need a replica set
+	m, err := mongodb.Run(ctx, "mongo:latest", mongodb.WithReplicaSet("rs0"))
+	require.NoError(t, err)
+	defer func() {
+		if err := shutdownMongo(ctx, m); err != nil {
+			t.Logf("failed to shutdown mongo: %v", err)
+		}
+	}()
+
+	connectionString, err := m.ConnectionString(ctx)
+	require.NoError(t, err)
+	require.NoError(t, os.Setenv("MONGO_URL", connectionString))
+	require.NoError(t, os.Setenv("MONGO_DB", "test"))
+	require.NoError(t, os.Setenv("MONGO_COLLECTION_USERS", "users"))
+	require.NoError(t, os.Setenv("MONGO_COLLECTION_TOKENS", "tokens"))
+
+	s := NewSystem()
+	_, err = s.Build()
+	require.NoError(t, err)
+	defer func() {
+		_ = s.Disconnect(ctx)
+	}()
+
+	users, err := NewRepository[testUser](s, "users")
+	require.NoError(t, err)
+	store := NewCollectionTokenStore(s, "tokens")
+
+	receive := func(events <-chan ChangeEvent) testUser {
+		t.Helper()
+		select {
+		case ev, ok := <-events:
+			require.True(t, ok, "watch closed")
+			var u testUser
+			require.NoError(t, ev.Decode(&u))
+			return u
+		case <-time.After(10 * time.Second):
+			t.Fatal("no change event")
+		}
+		return testUser{}
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	events, err := s.Watch(watchCtx, "users", mongo.Pipeline{{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}, WithTokenStore(store, "test"))
+	require.NoError(t, err)
+
+	_, err = users.Insert(ctx, testUser{Name: "alice"})
+	require.NoError(t, err)
+	assert.Equal(t, "alice", receive(events).Name)
+
+	cancel()
+	for range events {
+	}
+
+	// changes made while nothing is watching are picked up from the saved token
+	_, err = users.Insert(ctx, testUser{Name: "bob"}, testUser{Name: "carol"})
+	require.NoError(t, err)
+
+	watchCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	events, err = s.Watch(watchCtx, "users", nil, WithTokenStore(store, "test"))
+	require.NoError(t, err)
+	assert.Equal(t, "bob", receive(events).Name)
+	assert.Equal(t, "carol", receive(events).Name)
+
+	// a broken stream is resumed
+	require.NoError(t, s.Disconnect(ctx))
+	_, err = users.Insert(ctx, testUser{Name: "dave"})
+	require.NoError(t, err)
+	assert.Equal(t, "dave", receive(events).Name)
+}
@@ -2,7 +2,7 @@ package mongo
 
 import (
 	"context"
-	"fmt"
+	"sync"
 	"time"
 
 	"github.com/bugfixes/go-bugfixes/logs"
@@ -11,105 +11,269 @@ import (
 	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
 )
 
-const vaultRefreshBuffer = 3600
+const (
+	vaultRefreshBuffer = 3600
 
+	// disconnectTimeout is how long a replaced client has to finish the operations still using it
+	disconnectTimeout = 30 * time.Second
+)
+
+// RealMongoOperations keeps one client for the system it was first given, rebuilding the details from vault
+// when the lease is close to ending and swapping the client when the credentials change
 type RealMongoOperations struct {
 	Client     *mongo.Client
 	Collection *mongo.Collection
 	Database   *mongo.Database
+
+	mu sync.Mutex
+	// system is the latest build, it carries the refreshed credentials and lease between calls
+	system *System
 }
 
-func (r *RealMongoOperations) GetMongoClient(m System) (*mongo.Client, error) {
-	if m.VaultHelper != nil && time.Now().Unix() > (m.VaultDetails.ExpireTime.Unix()-vaultRefreshBuffer) {
-		mr := NewSystem()
-		mr.Setup(m.VaultDetails, *mr.VaultHelper)
-		_, err := mr.Build()
-		if err != nil {
-			return nil, logs.Errorf("mongo: unable to rebuild config: %v", err)
-		}
-		m = *mr
+// refresh takes m unless the last build is a newer one of the same vault system, rebuilds it from vault when the
+// lease is due, and reports whether where it connects changed
+func (r *RealMongoOperations) refresh(m System) (bool, error) {
+	next := r.system
+	if next == nil || m.VaultHelper == nil || next.VaultHelper != m.VaultHelper || m.refreshAt.After(next.refreshAt) {
+		next = &m
+	}
+
+	s, err := rebuild(*next)
+	if err != nil {
+		return false, err
+	}
+
+	changed := r.system != nil && r.system.url() != s.url()
+	r.system = &s
+	return changed, nil
+}
+
+// rebuild reads the vault credentials again once they are due, the system is a copy so callers' stay as they are
+func rebuild(s System) (System, error) {
+	if !s.needsRefresh() {
+		return s, nil
+	}
+
+	if _, err := s.buildVault(); err != nil {
+		return s, logs.Errorf("mongo: unable to rebuild vault config: %v", err)
+	}
+	logs.Infof("mongo: vault refreshed, new expire time is %v", s.ExpireTime)
+
+	return s, nil
+}
+
+// url tells whether a refresh changed where to connect, an unusable connection string fails in connect
+func (d Details) url() string {
+	u, _ := d.ConnectionString()
+	return u
+}
+
+func connect(m System) (*mongo.Client, error) {
+	connStr, err := m.ConnectionString()
+	if err != nil {
+		return nil, err
 	}
 
-	url := fmt.Sprintf("mongodb://%s:%s@%s", m.Username, m.Password, m.Host)
-	if m.RawURL != "" {
-		url = m.RawURL
+	opts := options.Client().ApplyURI(connStr).SetServerAPIOptions(options.ServerAPI(options.ServerAPIVersion1)).SetReadPreference(readpref.SecondaryPreferred())
+	if m.Telemetry != nil {
+		opts.SetMonitor(m.Telemetry.MongoMonitor())
 	}
 
-	client, err := mongo.Connect(options.Client().ApplyURI(url).SetServerAPIOptions(options.ServerAPI(options.ServerAPIVersion1)), options.Client().SetReadPreference(readpref.SecondaryPreferred()))
+	client, err := mongo.Connect(opts)
 	if err != nil {
 		return nil, logs.Errorf("mongo: unable to connect: %v", err)
 	}
 
-	r.Client = client
 	return client, nil
 }
 
-func (r *RealMongoOperations) GetMongoDatabase(m System) (*mongo.Database, error) {
-	if m.VaultHelper != nil && time.Now().Unix() > (m.VaultDetails.ExpireTime.Unix()-vaultRefreshBuffer) {
-		mr := NewSystem()
-		mr.Setup(m.VaultDetails, *mr.VaultHelper)
-		_, err := mr.Build()
-		if err != nil {
-			return nil, logs.Errorf("mongo: unable to rebuild config: %v", err)
-		}
-		m = *mr
+// reconnect swaps in a client with the current credentials, the database and collection are moved over to it
+// and the old client is closed in the background once its operations finish
+func (r *RealMongoOperations) reconnect() error {
+	client, err := connect(*r.system)
+	if err != nil {
+		return err
 	}
 
-	if r.Client == nil {
-		return nil, logs.Error("mongo: unable to get database without client")
+	old := r.Client
+	r.Client = client
+	if r.Database != nil {
+		r.Database = client.Database(r.Database.Name())
+	}
+	if r.Collection != nil {
+		r.Collection = client.Database(r.Collection.Database().Name()).Collection(r.Collection.Name())
+	}
+
+	if old != nil {
+		go disconnect(old)
+	}
+
+	return nil
+}
+
+func disconnect(client *mongo.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+	defer cancel()
+
+	if err := client.Disconnect(ctx); err != nil {
+		logs.Infof("mongo: unable to disconnect old client: %v", err)
+	}
+}
+
+// GetMongoClient connects on the first call and hands back the same client after that, a new one once the
+// vault credentials change. The client is shared with everyone using these operations, so don't call Disconnect
+// on it, close it once on shutdown with Disconnect here or System.Disconnect
+func (r *RealMongoOperations) GetMongoClient(m System) (*mongo.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.connect(m); err != nil {
+		return nil, err
+	}
+
+	return r.Client, nil
+}
+
+// connect refreshes the details and connects when there is no client yet or the credentials changed
+func (r *RealMongoOperations) connect(m System) error {
+	changed, err := r.refresh(m)
+	if err != nil {
+		return err
+	}
+	if r.Client != nil && !changed {
+		return nil
+	}
+
+	return r.reconnect()
+}
+
+// logicalCollection is a logical collection from Details.Collections on the current client, it leaves Database
+// and Collection alone so callers on different collections can share the operations
+func (r *RealMongoOperations) logicalCollection(m System, logical string) (*mongo.Collection, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.connect(m); err != nil {
+		return nil, err
+	}
+
+	name, ok := r.system.Collections[logical]
+	if !ok {
+		return nil, logs.Errorf("mongo: unable to find collection: %s", logical)
 	}
 
-	r.Database = r.Client.Database(m.Details.Database)
+	return r.Client.Database(r.system.Database).Collection(name), nil
+}
+
+// GetMongoDatabase is the details' database on the shared client, GetMongoClient owns the client it is on
+func (r *RealMongoOperations) GetMongoDatabase(m System) (*mongo.Database, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.refreshClient(m); err != nil {
+		return nil, err
+	}
+
+	r.Database = r.Client.Database(r.system.Details.Database)
 	return r.Database, nil
 }
 
+// GetMongoCollection is a logical collection on the shared client, GetMongoClient owns the client it is on
 func (r *RealMongoOperations) GetMongoCollection(m System, collection string) (*mongo.Collection, error) {
-	if m.VaultHelper != nil && time.Now().Unix() > (m.VaultDetails.ExpireTime.Unix()-vaultRefreshBuffer) {
-		mr := NewSystem()
-		mr.Setup(m.VaultDetails, *mr.VaultHelper)
-		_, err := mr.Build()
-		if err != nil {
-			return nil, logs.Errorf("mongo: unable to rebuild config: %v", err)
-		}
-		m = *mr
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.refreshClient(m); err != nil {
+		return nil, err
 	}
 
-	r.Collection = r.Client.Database(m.Details.Database).Collection(m.Details.Collections[collection])
+	r.Collection = r.Client.Database(r.system.Details.Database).Collection(r.system.Details.Collections[collection])
 	return r.Collection, nil
 }
 
+// refreshClient refreshes the details and reconnects when they changed, it needs GetMongoClient to have connected
+func (r *RealMongoOperations) refreshClient(m System) error {
+	if r.Client == nil {
+		return logs.Error("mongo: unable to get database without client")
+	}
+
+	changed, err := r.refresh(m)
+	if err != nil {
+		return err
+	}
+	if changed {
+		return r.reconnect()
+	}
+
+	return nil
+}
+
+// collection is the current collection, the lease is checked first so long running services pick up new
+// credentials, a failed refresh keeps the old client since its credentials are still good until the lease ends
+func (r *RealMongoOperations) collection() *mongo.Collection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.system == nil {
+		return r.Collection
+	}
+
+	changed, err := r.refresh(*r.system)
+	if err != nil {
+		logs.Infof("mongo: keeping current client: %v", err)
+		return r.Collection
+	}
+	if changed && r.Client != nil {
+		if err := r.reconnect(); err != nil {
+			logs.Infof("mongo: keeping current client: %v", err)
+		}
+	}
+
+	return r.Collection
+}
+
+// Disconnect closes the shared client, anyone still using the operations gets a new one on their next call
 func (r *RealMongoOperations) Disconnect(ctx context.Context) error {
-	return r.Client.Disconnect(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Client == nil {
+		return nil
+	}
+
+	err := r.Client.Disconnect(ctx)
+	r.Client, r.Database, r.Collection = nil, nil, nil
+	return err
 }
 
 func (r *RealMongoOperations) InsertOne(ctx context.Context, document interface{}) (*mongo.InsertOneResult, error) {
-	return r.Collection.InsertOne(ctx, document)
+	return r.collection().InsertOne(ctx, document)
 }
 
 func (r *RealMongoOperations) InsertMany(ctx context.Context, documents []interface{}) (*mongo.InsertManyResult, error) {
-	return r.Collection.InsertMany(ctx, documents)
+	return r.collection().InsertMany(ctx, documents)
 }
 
 func (r *RealMongoOperations) FindOne(ctx context.Context, filter interface{}) *mongo.SingleResult {
-	return r.Collection.FindOne(ctx, filter)
+	return r.collection().FindOne(ctx, filter)
 }
 
 func (r *RealMongoOperations) Find(ctx context.Context, filter interface{}) (*mongo.Cursor, error) {
-	return r.Collection.Find(ctx, filter)
+	return r.collection().Find(ctx, filter)
 }
 
 func (r *RealMongoOperations) UpdateOne(ctx context.Context, filter interface{}, update interface{}) (*mongo.UpdateResult, error) {
-	return r.Collection.UpdateOne(ctx, filter, update)
+	return r.collection().UpdateOne(ctx, filter, update)
 }
 
 func (r *RealMongoOperations) UpdateMany(ctx context.Context, filter interface{}, update interface{}) (*mongo.UpdateResult, error) {
-	return r.Collection.UpdateMany(ctx, filter, update)
+	return r.collection().UpdateMany(ctx, filter, update)
 }
 
 func (r *RealMongoOperations) DeleteOne(ctx context.Context, filter interface{}) (*mongo.DeleteResult, error) {
-	return r.Collection.DeleteOne(ctx, filter)
+	return r.collection().DeleteOne(ctx, filter)
 }
 
 func (r *RealMongoOperations) DeleteMany(ctx context.Context, filter interface{}) (*mongo.DeleteResult, error) {
-	return r.Collection.DeleteMany(ctx, filter)
+	return r.collection().DeleteMany(ctx, filter)
 }
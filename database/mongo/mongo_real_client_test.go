@@ -0,0 +1,133 @@
+package mongo
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	vaultHelper "github.com/keloran/vault-helper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func vaultSystem(t *testing.T, mockVault *vaultHelper.MockVaultHelper) *System {
+	t.Helper()
+	os.Clearenv()
+
+	s := NewSystem()
+	s.Setup(VaultDetails{CredPath: "tester", DetailsPath: "tester"}, mockVault)
+	_, err := s.Build()
+	require.NoError(t, err)
+
+	return s
+}
+
+func mongoVault(password string, lease int) *vaultHelper.MockVaultHelper {
+	return &vaultHelper.MockVaultHelper{
+		Lease: lease,
+		KVSecrets: []vaultHelper.KVSecret{
+			{Key: "username", Value: "testUser"},
+			{Key: "password", Value: password},
+			{Key: "mongo-db", Value: "testDB"},
+			{Key: "mongo-collections", Value: "bob:bill"},
+		},
+	}
+}
+
+func TestBuildVaultLease(t *testing.T) {
+	tests := []struct {
+		name   string
+		lease  int
+		expire time.Duration
+		buffer time.Duration
+	}{
+		{"long lease", 7200, 2 * time.Hour, time.Hour},
+		{"short lease", 600, 10 * time.Minute, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := vaultSystem(t, mongoVault("testPassword", tt.lease))
+
+			assert.WithinDuration(t, time.Now().Add(tt.expire), s.ExpireTime, time.Minute)
+			assert.Equal(t, tt.buffer, s.ExpireTime.Sub(s.refreshAt))
+			assert.False(t, s.needsRefresh())
+		})
+	}
+
+	t.Run("static secret", func(t *testing.T) {
+		s := vaultSystem(t, mongoVault("testPassword", 0))
+
+		assert.True(t, s.ExpireTime.IsZero())
+		assert.WithinDuration(t, time.Now().Add(time.Hour), s.refreshAt, time.Minute)
+		assert.False(t, s.needsRefresh())
+	})
+}
+
+func TestRealMongoOperationsRefresh(t *testing.T) {
+	mockVault := mongoVault("testPassword", 7200)
+	s := vaultSystem(t, mockVault)
+
+	r := &RealMongoOperations{}
+	client, err := r.GetMongoClient(*s)
+	require.NoError(t, err)
+	again, err := r.GetMongoClient(*s)
+	require.NoError(t, err)
+	assert.Same(t, client, again)
+
+	col, err := r.GetMongoCollection(*s, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, "bill", col.Name())
+
+	// the lease is due and vault has rotated the password
+	mockVault.KVSecrets[1].Value = "rotatedPassword"
+	s.refreshAt = time.Now().Add(-time.Second)
+	r.system.refreshAt = s.refreshAt
+
+	col, err = r.GetMongoCollection(*s, "bob")
+	require.NoError(t, err)
+	assert.NotSame(t, client, r.Client)
+	assert.Same(t, r.Client, col.Database().Client())
+	assert.Equal(t, "rotatedPassword", r.system.Password.Reveal())
+	assert.False(t, r.system.needsRefresh())
+	// the caller's stale copy doesn't undo the refresh
+	assert.Equal(t, "testPassword", s.Password.Reveal())
+	current, err := r.GetMongoClient(*s)
+	require.NoError(t, err)
+	assert.Same(t, r.Client, current)
+
+	require.NoError(t, r.Disconnect(context.Background()))
+	assert.Nil(t, r.Client)
+	reconnected, err := r.GetMongoClient(*s)
+	require.NoError(t, err)
+	assert.NotSame(t, current, reconnected)
+	require.NoError(t, r.Disconnect(context.Background()))
+}
+
+func TestRealMongoOperationsRefreshUnchanged(t *testing.T) {
+	s := vaultSystem(t, mongoVault("testPassword", 7200))
+
+	r := &RealMongoOperations{}
+	client, err := r.GetMongoClient(*s)
+	require.NoError(t, err)
+	col, err := r.GetMongoCollection(*s, "bob")
+	require.NoError(t, err)
+
+	r.system.refreshAt = time.Now().Add(-time.Second)
+	assert.Same(t, col, r.collection())
+	assert.Same(t, client, r.Client)
+	assert.False(t, r.system.needsRefresh())
+	require.NoError(t, r.Disconnect(context.Background()))
+}
+
+func TestRealMongoOperationsNoClient(t *testing.T) {
+	s := vaultSystem(t, mongoVault("testPassword", 7200))
+
+	r := &RealMongoOperations{}
+	_, err := r.GetMongoDatabase(*s)
+	assert.Error(t, err)
+	_, err = r.GetMongoCollection(*s, "bob")
+	assert.Error(t, err)
+	assert.NoError(t, r.Disconnect(context.Background()))
+}
@@ -0,0 +1,337 @@
+// Package mongotest is an in-memory MungoOperations for unit tests, it keeps the documents and understands enough
+// of the query language ($eq, $ne, $in, $nin, $gt, $gte, $lt, $lte, $exists, $and, $or, $nor) and of updates
+// ($set, $unset, $inc, $push) for services to be tested without a server. Anything else is an error rather than
+// a guess, so a test never passes on behaviour the server wouldn't have
+package mongotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/keloran/go-config/database/mongo"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	mongodriver "go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// codeDuplicateKey is the server's duplicate key error, mongo.IsDuplicateKeyError recognises it
+const codeDuplicateKey = 11000
+
+var _ mongo.MungoOperations = (*Fake)(nil)
+
+// Fake keeps collections of documents in memory, like the real operations the CRUD calls work on the collection
+// GetMongoCollection last selected. It is safe to share between goroutines
+type Fake struct {
+	mu          sync.Mutex
+	collections map[string][]bson.D
+	current     string
+}
+
+func New() *Fake {
+	return &Fake{
+		collections: make(map[string][]bson.D),
+	}
+}
+
+// GetMongoClient is nil, there is no server behind the fake
+func (f *Fake) GetMongoClient(_ mongo.System) (*mongodriver.Client, error) {
+	return nil, nil
+}
+
+// GetMongoDatabase is nil, there is no server behind the fake
+func (f *Fake) GetMongoDatabase(_ mongo.System) (*mongodriver.Database, error) {
+	return nil, nil
+}
+
+// GetMongoCollection selects the collection Details.Collections maps the logical name to, or the logical name
+// itself when it isn't mapped, the returned collection is nil
+func (f *Fake) GetMongoCollection(m mongo.System, collection string) (*mongodriver.Collection, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.current = collection
+	if name := m.Collections[collection]; name != "" {
+		f.current = name
+	}
+
+	return nil, nil
+}
+
+// Seed adds documents to collection, the name GetMongoCollection selects, without going through InsertMany
+func (f *Fake) Seed(collection string, docs ...any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, doc := range docs {
+		if _, err := f.insert(collection, doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Documents is a copy of what collection holds, in the order it was inserted
+func (f *Fake) Documents(collection string) []bson.D {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	docs := make([]bson.D, 0, len(f.collections[collection]))
+	for _, doc := range f.collections[collection] {
+		c, _ := document(doc)
+		docs = append(docs, c)
+	}
+
+	return docs
+}
+
+// selected is the collection GetMongoCollection selected
+func (f *Fake) selected() (string, error) {
+	if f.current == "" {
+		return "", fmt.Errorf("mongotest: unable to use a collection, GetMongoCollection hasn't been called")
+	}
+
+	return f.current, nil
+}
+
+// insert stores a copy of doc, adding an _id when it hasn't one and refusing one already used
+func (f *Fake) insert(collection string, doc any) (any, error) {
+	d, err := document(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	id, ok := lookup(d, "_id")
+	if !ok {
+		id = bson.NewObjectID()
+		d = append(bson.D{{Key: "_id", Value: id}}, d...)
+	}
+	for _, existing := range f.collections[collection] {
+		if have, _ := lookup(existing, "_id"); equal(have, id) {
+			return nil, mongodriver.WriteException{
+				WriteErrors: []mongodriver.WriteError{{
+					Code:    codeDuplicateKey,
+					Message: fmt.Sprintf("E11000 duplicate key error collection: %s index: _id_ dup key: { _id: %v }", collection, id),
+				}},
+			}
+		}
+	}
+
+	f.collections[collection] = append(f.collections[collection], d)
+	return id, nil
+}
+
+// matching is the positions of the documents matching filter, only the first when one is set
+func (f *Fake) matching(collection string, filter any, one bool) ([]int, error) {
+	if filter == nil {
+		return nil, fmt.Errorf("mongotest: unable to use a nil filter")
+	}
+	fd, err := document(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []int
+	for i, doc := range f.collections[collection] {
+		ok, err := match(doc, fd)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = append(found, i)
+			if one {
+				break
+			}
+		}
+	}
+
+	return found, nil
+}
+
+func (f *Fake) InsertOne(_ context.Context, document any) (*mongodriver.InsertOneResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	collection, err := f.selected()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := f.insert(collection, document)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mongodriver.InsertOneResult{InsertedID: id, Acknowledged: true}, nil
+}
+
+// InsertMany inserts in order and stops at the first failure, the documents before it stay inserted
+func (f *Fake) InsertMany(_ context.Context, documents []any) (*mongodriver.InsertManyResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	collection, err := f.selected()
+	if err != nil {
+		return nil, err
+	}
+	if len(documents) == 0 {
+		return nil, fmt.Errorf("mongotest: unable to insert no documents")
+	}
+
+	res := &mongodriver.InsertManyResult{Acknowledged: true}
+	for n, doc := range documents {
+		id, err := f.insert(collection, doc)
+		if err != nil {
+			var we mongodriver.WriteException
+			if errors.As(err, &we) {
+				return res, mongodriver.BulkWriteException{
+					WriteErrors: []mongodriver.BulkWriteError{{WriteError: mongodriver.WriteError{
+						Index:   n,
+						Code:    we.WriteErrors[0].Code,
+						Message: we.WriteErrors[0].Message,
+					}}},
+				}
+			}
+			return res, err
+		}
+		res.InsertedIDs = append(res.InsertedIDs, id)
+	}
+
+	return res, nil
+}
+
+// FindOne is the first matching document in insertion order, mongo.ErrNoDocuments when there isn't one
+func (f *Fake) FindOne(_ context.Context, filter any) *mongodriver.SingleResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	collection, err := f.selected()
+	if err != nil {
+		return mongodriver.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	found, err := f.matching(collection, filter, true)
+	if err != nil {
+		return mongodriver.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	if len(found) == 0 {
+		return mongodriver.NewSingleResultFromDocument(bson.D{}, mongodriver.ErrNoDocuments, nil)
+	}
+
+	return mongodriver.NewSingleResultFromDocument(f.collections[collection][found[0]], nil, nil)
+}
+
+// Find is a cursor over copies of the matching documents in insertion order
+func (f *Fake) Find(_ context.Context, filter any) (*mongodriver.Cursor, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	collection, err := f.selected()
+	if err != nil {
+		return nil, err
+	}
+	found, err := f.matching(collection, filter, false)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]any, 0, len(found))
+	for _, i := range found {
+		docs = append(docs, f.collections[collection][i])
+	}
+
+	return mongodriver.NewCursorFromDocuments(docs, nil, nil)
+}
+
+func (f *Fake) UpdateOne(_ context.Context, filter, update any) (*mongodriver.UpdateResult, error) {
+	return f.update(filter, update, true)
+}
+
+func (f *Fake) UpdateMany(_ context.Context, filter, update any) (*mongodriver.UpdateResult, error) {
+	return f.update(filter, update, false)
+}
+
+// update applies update to the matching documents, like the server ModifiedCount leaves out those it didn't change,
+// and when any document fails to update none of them are
+func (f *Fake) update(filter, update any, one bool) (*mongodriver.UpdateResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	collection, err := f.selected()
+	if err != nil {
+		return nil, err
+	}
+	if update == nil {
+		return nil, fmt.Errorf("mongotest: unable to use a nil update")
+	}
+	ud, err := document(update)
+	if err != nil {
+		return nil, err
+	}
+	found, err := f.matching(collection, filter, one)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := f.collections[collection]
+	updated := make(map[int]bson.D, len(found))
+	for _, i := range found {
+		doc, err := apply(docs[i], ud)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(doc, docs[i]) {
+			updated[i] = doc
+		}
+	}
+	for i, doc := range updated {
+		docs[i] = doc
+	}
+
+	return &mongodriver.UpdateResult{
+		MatchedCount:  int64(len(found)),
+		ModifiedCount: int64(len(updated)),
+		Acknowledged:  true,
+	}, nil
+}
+
+func (f *Fake) DeleteOne(_ context.Context, filter any) (*mongodriver.DeleteResult, error) {
+	return f.delete(filter, true)
+}
+
+func (f *Fake) DeleteMany(_ context.Context, filter any) (*mongodriver.DeleteResult, error) {
+	return f.delete(filter, false)
+}
+
+func (f *Fake) delete(filter any, one bool) (*mongodriver.DeleteResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	collection, err := f.selected()
+	if err != nil {
+		return nil, err
+	}
+	found, err := f.matching(collection, filter, one)
+	if err != nil {
+		return nil, err
+	}
+
+	remove := make(map[int]bool, len(found))
+	for _, i := range found {
+		remove[i] = true
+	}
+	kept := make([]bson.D, 0, len(f.collections[collection])-len(found))
+	for i, doc := range f.collections[collection] {
+		if !remove[i] {
+			kept = append(kept, doc)
+		}
+	}
+	f.collections[collection] = kept
+
+	return &mongodriver.DeleteResult{DeletedCount: int64(len(found)), Acknowledged: true}, nil
+}
+
+// Disconnect keeps the documents, a test can disconnect and still check what was written
+func (f *Fake) Disconnect(_ context.Context) error {
+	return nil
+}
@@ -0,0 +1,264 @@
+package mongotest
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/keloran/go-config/database/mongo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	mongodriver "go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+type user struct {
+	ID    string   `bson:"_id"`
+	Name  string   `bson:"name"`
+	Age   int      `bson:"age"`
+	Tags  []string `bson:"tags,omitempty"`
+	Email string   `bson:"email,omitempty"`
+}
+
+func setupFake(t *testing.T) *Fake {
+	t.Helper()
+
+	f := New()
+	m := mongo.System{Details: mongo.Details{Collections: map[string]string{"users": "app_users"}}}
+	_, err := f.GetMongoCollection(m, "users")
+	require.NoError(t, err)
+	require.NoError(t, f.Seed("app_users",
+		user{ID: "1", Name: "alice", Age: 30, Tags: []string{"admin", "ops"}, Email: "alice@example.com"},
+		user{ID: "2", Name: "bob", Age: 25, Tags: []string{"ops"}},
+		user{ID: "3", Name: "carol", Age: 41},
+	))
+
+	return f
+}
+
+func names(t *testing.T, f *Fake, filter any) []string {
+	t.Helper()
+
+	cur, err := f.Find(context.Background(), filter)
+	require.NoError(t, err)
+	var users []user
+	require.NoError(t, cur.All(context.Background(), &users))
+
+	found := []string{}
+	for _, u := range users {
+		found = append(found, u.Name)
+	}
+	return found
+}
+
+func TestFind(t *testing.T) {
+	f := setupFake(t)
+
+	tests := []struct {
+		name   string
+		filter any
+		want   []string
+	}{
+		{"everything", bson.D{}, []string{"alice", "bob", "carol"}},
+		{"equal", bson.D{{Key: "name", Value: "bob"}}, []string{"bob"}},
+		{"map filter", bson.M{"age": 41}, []string{"carol"}},
+		{"$eq", bson.D{{Key: "age", Value: bson.D{{Key: "$eq", Value: int64(30)}}}}, []string{"alice"}},
+		{"$ne", bson.D{{Key: "name", Value: bson.D{{Key: "$ne", Value: "bob"}}}}, []string{"alice", "carol"}},
+		{"$in", bson.D{{Key: "name", Value: bson.D{{Key: "$in", Value: bson.A{"alice", "carol"}}}}}, []string{"alice", "carol"}},
+		{"$nin", bson.D{{Key: "name", Value: bson.D{{Key: "$nin", Value: bson.A{"alice", "carol"}}}}}, []string{"bob"}},
+		{"$gt", bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: 25}}}}, []string{"alice", "carol"}},
+		{"$gte and $lt", bson.D{{Key: "age", Value: bson.D{{Key: "$gte", Value: 25}, {Key: "$lt", Value: 41.0}}}}, []string{"alice", "bob"}},
+		{"$lte", bson.D{{Key: "age", Value: bson.D{{Key: "$lte", Value: 25}}}}, []string{"bob"}},
+		{"array element", bson.D{{Key: "tags", Value: "ops"}}, []string{"alice", "bob"}},
+		{"array index", bson.D{{Key: "tags.0", Value: "ops"}}, []string{"bob"}},
+		{"$exists", bson.D{{Key: "email", Value: bson.D{{Key: "$exists", Value: true}}}}, []string{"alice"}},
+		{"missing is null", bson.D{{Key: "email", Value: nil}}, []string{"bob", "carol"}},
+		{"$or", bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "name", Value: "bob"}},
+			bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: 40}}}},
+		}}}, []string{"bob", "carol"}},
+		{"$and", bson.D{{Key: "$and", Value: bson.A{
+			bson.D{{Key: "tags", Value: "ops"}},
+			bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: 26}}}},
+		}}}, []string{"alice"}},
+		{"$nor", bson.D{{Key: "$nor", Value: bson.A{bson.D{{Key: "tags", Value: "ops"}}}}}, []string{"carol"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, names(t, f, tt.filter))
+		})
+	}
+}
+
+func TestFindUnsupported(t *testing.T) {
+	f := setupFake(t)
+
+	_, err := f.Find(context.Background(), bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: "^a"}}}})
+	assert.ErrorContains(t, err, "$regex")
+
+	_, err = f.Find(context.Background(), bson.D{{Key: "$where", Value: "true"}})
+	assert.ErrorContains(t, err, "$where")
+}
+
+func TestFindOne(t *testing.T) {
+	f := setupFake(t)
+	ctx := context.Background()
+
+	var u user
+	require.NoError(t, f.FindOne(ctx, bson.D{{Key: "_id", Value: "2"}}).Decode(&u))
+	assert.Equal(t, "bob", u.Name)
+
+	err := f.FindOne(ctx, bson.D{{Key: "_id", Value: "9"}}).Decode(&u)
+	assert.True(t, errors.Is(err, mongodriver.ErrNoDocuments))
+}
+
+func TestInsert(t *testing.T) {
+	f := setupFake(t)
+	ctx := context.Background()
+
+	res, err := f.InsertOne(ctx, bson.D{{Key: "name", Value: "dave"}})
+	require.NoError(t, err)
+	assert.True(t, res.Acknowledged)
+	assert.IsType(t, bson.ObjectID{}, res.InsertedID)
+
+	var got bson.D
+	require.NoError(t, f.FindOne(ctx, bson.D{{Key: "_id", Value: res.InsertedID}}).Decode(&got))
+	assert.Equal(t, "dave", got[1].Value)
+
+	_, err = f.InsertOne(ctx, user{ID: "1", Name: "again"})
+	assert.True(t, mongodriver.IsDuplicateKeyError(err))
+
+	many, err := f.InsertMany(ctx, []any{user{ID: "4", Name: "erin"}, user{ID: "2", Name: "again"}, user{ID: "5", Name: "frank"}})
+	assert.True(t, mongodriver.IsDuplicateKeyError(err))
+	assert.Equal(t, []any{"4"}, many.InsertedIDs)
+	assert.Len(t, f.Documents("app_users"), 5)
+}
+
+func TestUpdate(t *testing.T) {
+	f := setupFake(t)
+	ctx := context.Background()
+
+	res, err := f.UpdateOne(ctx, bson.D{{Key: "_id", Value: "2"}}, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "name", Value: "robert"}, {Key: "address.city", Value: "leeds"}}},
+		{Key: "$inc", Value: bson.D{{Key: "age", Value: 1}, {Key: "logins", Value: 1}}},
+		{Key: "$push", Value: bson.D{{Key: "tags", Value: bson.D{{Key: "$each", Value: bson.A{"dev", "qa"}}}}}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &mongodriver.UpdateResult{MatchedCount: 1, ModifiedCount: 1, Acknowledged: true}, res)
+
+	var got bson.D
+	require.NoError(t, f.FindOne(ctx, bson.D{{Key: "_id", Value: "2"}}).Decode(&got))
+	for path, want := range map[string]any{
+		"name":         "robert",
+		"address.city": "leeds",
+		"age":          int32(26),
+		"logins":       int32(1),
+		"tags":         bson.A{"ops", "dev", "qa"},
+	} {
+		v, _ := lookup(got, path)
+		assert.Equal(t, want, v, path)
+	}
+
+	res, err = f.UpdateMany(ctx, bson.D{{Key: "tags", Value: "ops"}}, bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: "robert"}}}})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, res.MatchedCount)
+	assert.EqualValues(t, 1, res.ModifiedCount, "bob is already robert")
+
+	res, err = f.UpdateMany(ctx, bson.D{{Key: "name", Value: "nobody"}}, bson.D{{Key: "$set", Value: bson.D{{Key: "age", Value: 1}}}})
+	require.NoError(t, err)
+	assert.Zero(t, res.MatchedCount)
+
+	_, err = f.UpdateOne(ctx, bson.D{{Key: "_id", Value: "1"}}, bson.D{{Key: "name", Value: "replaced"}})
+	assert.Error(t, err, "a replacement isn't an update")
+	_, err = f.UpdateOne(ctx, bson.D{{Key: "_id", Value: "1"}}, bson.D{{Key: "$inc", Value: bson.D{{Key: "name", Value: 1}}}})
+	assert.Error(t, err)
+	_, err = f.UpdateOne(ctx, bson.D{{Key: "_id", Value: "1"}}, bson.D{{Key: "$rename", Value: bson.D{{Key: "name", Value: "n"}}}})
+	assert.ErrorContains(t, err, "$rename")
+}
+
+func TestDelete(t *testing.T) {
+	f := setupFake(t)
+	ctx := context.Background()
+
+	res, err := f.DeleteOne(ctx, bson.D{{Key: "tags", Value: "ops"}})
+	require.NoError(t, err)
+	assert.Equal(t, &mongodriver.DeleteResult{DeletedCount: 1, Acknowledged: true}, res)
+	assert.Equal(t, []string{"bob", "carol"}, names(t, f, bson.D{}))
+
+	res, err = f.DeleteMany(ctx, bson.D{})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, res.DeletedCount)
+	assert.Empty(t, f.Documents("app_users"))
+}
+
+func TestNoCollection(t *testing.T) {
+	f := New()
+
+	_, err := f.InsertOne(context.Background(), bson.D{})
+	assert.Error(t, err)
+	assert.Error(t, f.FindOne(context.Background(), bson.D{}).Err())
+}
+
+func TestIncIntegers(t *testing.T) {
+	tests := []struct {
+		name string
+		cur  any
+		by   any
+		want any
+	}{
+		{"int32", int32(1), int32(2), int32(3)},
+		{"int32 overflow promotes", int32(math.MaxInt32), int32(1), int64(math.MaxInt32) + 1},
+		{"int32 underflow promotes", int32(math.MinInt32), int32(-1), int64(math.MinInt32) - 1},
+		{"int64 above 2^53", int64(1<<53 + 1), int32(2), int64(1<<53 + 3)},
+		{"int64 near the max", int64(math.MaxInt64 - 1), int64(1), int64(math.MaxInt64)},
+		{"double", int32(1), 0.5, 1.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := inc(bson.D{{Key: "n", Value: tt.cur}}, "n", tt.by)
+			require.NoError(t, err)
+			got, _ := lookup(doc, "n")
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := inc(bson.D{{Key: "n", Value: int64(math.MaxInt64)}}, "n", int32(1))
+	assert.Error(t, err, "int64 overflow")
+	_, err = inc(bson.D{{Key: "n", Value: int64(math.MinInt64)}}, "n", int64(-1))
+	assert.Error(t, err, "int64 underflow")
+}
+
+func TestCompareLargeIntegers(t *testing.T) {
+	big := int64(1<<53 + 1)
+
+	assert.False(t, equal(big, int64(1<<53)), "float64 would round both to 2^53")
+	assert.True(t, equal(big, big))
+	assert.True(t, equal(int32(7), int64(7)))
+	assert.True(t, equal(int64(7), 7.0))
+	assert.False(t, equal(big, float64(1<<53)))
+
+	c, ok := compare(big, int64(1<<53))
+	assert.True(t, ok)
+	assert.Equal(t, 1, c)
+	c, _ = compare(float64(1<<53), big)
+	assert.Equal(t, -1, c)
+	c, _ = compare(int64(2), 2.5)
+	assert.Equal(t, -1, c)
+	c, _ = compare(int64(-2), -2.5)
+	assert.Equal(t, 1, c)
+	c, _ = compare(int64(math.MaxInt64), math.Inf(1))
+	assert.Equal(t, -1, c)
+
+	f := New()
+	m := mongo.System{Details: mongo.Details{Collections: map[string]string{"counters": "counters"}}}
+	_, err := f.GetMongoCollection(m, "counters")
+	require.NoError(t, err)
+	require.NoError(t, f.Seed("counters", bson.D{{Key: "_id", Value: big}}, bson.D{{Key: "_id", Value: big - 1}}))
+
+	var got bson.D
+	require.NoError(t, f.FindOne(context.Background(), bson.D{{Key: "_id", Value: big}}).Decode(&got))
+	id, _ := lookup(got, "_id")
+	assert.Equal(t, big, id)
+}
@@ -0,0 +1,501 @@
+package mongotest
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// document is v marshalled and read back, so structs, maps and bson.D all look the same and the fake keeps a copy
+func document(v any) (bson.D, error) {
+	if v == nil {
+		return nil, fmt.Errorf("mongotest: unable to use a nil document")
+	}
+
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("mongotest: unable to marshal document: %w", err)
+	}
+	var d bson.D
+	if err := bson.Unmarshal(b, &d); err != nil {
+		return nil, fmt.Errorf("mongotest: unable to unmarshal document: %w", err)
+	}
+
+	return d, nil
+}
+
+// lookup is the value at a dotted path, numeric parts index into arrays
+func lookup(doc bson.D, path string) (any, bool) {
+	var cur any = doc
+	for _, part := range strings.Split(path, ".") {
+		switch v := cur.(type) {
+		case bson.D:
+			found := false
+			for _, e := range v {
+				if e.Key == part {
+					cur, found = e.Value, true
+					break
+				}
+			}
+			if !found {
+				return nil, false
+			}
+		case bson.A:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			cur = v[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return cur, true
+}
+
+// match is whether doc matches filter, for the operators the fake understands
+func match(doc, filter bson.D) (bool, error) {
+	for _, e := range filter {
+		ok, err := matchElement(doc, e)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func matchElement(doc bson.D, e bson.E) (bool, error) {
+	switch e.Key {
+	case "$and", "$or", "$nor":
+		clauses, ok := e.Value.(bson.A)
+		if !ok || len(clauses) == 0 {
+			return false, fmt.Errorf("mongotest: unable to use %s without an array of filters", e.Key)
+		}
+		matched := 0
+		for _, clause := range clauses {
+			f, ok := clause.(bson.D)
+			if !ok {
+				return false, fmt.Errorf("mongotest: unable to use %s clause %v", e.Key, clause)
+			}
+			ok, err := match(doc, f)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				matched++
+			}
+		}
+		switch e.Key {
+		case "$and":
+			return matched == len(clauses), nil
+		case "$or":
+			return matched > 0, nil
+		}
+		return matched == 0, nil
+	}
+	if strings.HasPrefix(e.Key, "$") {
+		return false, fmt.Errorf("mongotest: unable to use operator %s", e.Key)
+	}
+
+	v, exists := lookup(doc, e.Key)
+	ops, ok := e.Value.(bson.D)
+	if !ok || len(ops) == 0 || !strings.HasPrefix(ops[0].Key, "$") {
+		return matchEq(v, exists, e.Value), nil
+	}
+
+	for _, op := range ops {
+		ok, err := matchOperator(v, exists, op)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func matchOperator(v any, exists bool, op bson.E) (bool, error) {
+	switch op.Key {
+	case "$eq":
+		return matchEq(v, exists, op.Value), nil
+	case "$ne":
+		return !matchEq(v, exists, op.Value), nil
+	case "$in", "$nin":
+		values, ok := op.Value.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("mongotest: unable to use %s without an array", op.Key)
+		}
+		in := false
+		for _, want := range values {
+			if matchEq(v, exists, want) {
+				in = true
+				break
+			}
+		}
+		return in == (op.Key == "$in"), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		if !exists {
+			return false, nil
+		}
+		return anyElement(v, func(el any) bool {
+			c, ok := compare(el, op.Value)
+			if !ok {
+				return false
+			}
+			switch op.Key {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			}
+			return c <= 0
+		}), nil
+	case "$exists":
+		want, ok := op.Value.(bool)
+		if !ok {
+			return false, fmt.Errorf("mongotest: unable to use $exists without a bool")
+		}
+		return exists == want, nil
+	}
+
+	return false, fmt.Errorf("mongotest: unable to use operator %s", op.Key)
+}
+
+// matchEq is the server's equality, a missing field equals null and an array matches when any element does
+func matchEq(v any, exists bool, want any) bool {
+	if !exists {
+		return want == nil
+	}
+	if equal(v, want) {
+		return true
+	}
+	if _, isArray := want.(bson.A); isArray {
+		return false
+	}
+
+	arr, ok := v.(bson.A)
+	return ok && anyElement(arr, func(el any) bool { return equal(el, want) })
+}
+
+// anyElement is f on v, or on any of its elements when v is an array
+func anyElement(v any, f func(any) bool) bool {
+	arr, ok := v.(bson.A)
+	if !ok {
+		return f(v)
+	}
+	for _, el := range arr {
+		if f(el) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func number(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+
+	return 0, false
+}
+
+// integer is an int32 or int64 widened to int64, so integer maths and comparisons stay exact past 2^53
+func integer(v any) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+
+	return 0, false
+}
+
+// compare orders two values of the same kind, numbers of any type compare with each other
+func compare(a, b any) (int, bool) {
+	if x, ok := integer(a); ok {
+		if y, ok := integer(b); ok {
+			return compareInt(x, y), true
+		}
+		if y, ok := b.(float64); ok {
+			return compareIntFloat(x, y), true
+		}
+		return 0, false
+	}
+	if x, ok := a.(float64); ok {
+		if y, ok := integer(b); ok {
+			return -compareIntFloat(y, x), true
+		}
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case bson.DateTime:
+		if y, ok := b.(bson.DateTime); ok {
+			return compareInt(int64(x), int64(y)), true
+		}
+	case bson.ObjectID:
+		if y, ok := b.(bson.ObjectID); ok {
+			return bytes.Compare(x[:], y[:]), true
+		}
+	}
+
+	return 0, false
+}
+
+func compareInt(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+
+	return 0
+}
+
+// compareIntFloat orders an integer against a double without rounding the integer to a double first,
+// NaN sorts below every number the way the server has it
+func compareIntFloat(x int64, y float64) int {
+	switch {
+	case math.IsNaN(y):
+		return 1
+	case y >= math.MaxInt64:
+		return -1
+	case y < math.MinInt64:
+		return 1
+	}
+
+	whole := math.Trunc(y)
+	if c := compareInt(x, int64(whole)); c != 0 {
+		return c
+	}
+	switch {
+	case y > whole:
+		return -1
+	case y < whole:
+		return 1
+	}
+
+	return 0
+}
+
+func equal(a, b any) bool {
+	if c, ok := compare(a, b); ok {
+		return c == 0
+	}
+
+	switch x := a.(type) {
+	case bson.D:
+		y, ok := b.(bson.D)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if x[i].Key != y[i].Key || !equal(x[i].Value, y[i].Value) {
+				return false
+			}
+		}
+		return true
+	case bson.A:
+		y, ok := b.(bson.A)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// apply runs the update operators on a copy of doc
+func apply(doc, update bson.D) (bson.D, error) {
+	if len(update) == 0 {
+		return nil, fmt.Errorf("mongotest: unable to update with an empty update document")
+	}
+
+	out, err := document(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range update {
+		fields, ok := op.Value.(bson.D)
+		if !strings.HasPrefix(op.Key, "$") || !ok {
+			return nil, fmt.Errorf("mongotest: unable to update with %s, an update document only holds operators", op.Key)
+		}
+
+		for _, f := range fields {
+			if f.Key == "_id" {
+				return nil, fmt.Errorf("mongotest: unable to %s the immutable field _id", op.Key)
+			}
+
+			var err error
+			switch op.Key {
+			case "$set":
+				out, err = setPath(out, f.Key, f.Value)
+			case "$unset":
+				out = unsetPath(out, f.Key)
+			case "$inc":
+				out, err = inc(out, f.Key, f.Value)
+			case "$push":
+				out, err = push(out, f.Key, f.Value)
+			default:
+				err = fmt.Errorf("mongotest: unable to use operator %s", op.Key)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// setPath sets the value at a dotted path, creating the documents along the way
+func setPath(doc bson.D, path string, value any) (bson.D, error) {
+	key, rest, nested := strings.Cut(path, ".")
+	for i, e := range doc {
+		if e.Key != key {
+			continue
+		}
+		if !nested {
+			doc[i].Value = value
+			return doc, nil
+		}
+
+		child, ok := e.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("mongotest: unable to set %s, %s is not a document", path, key)
+		}
+		child, err := setPath(child, rest, value)
+		if err != nil {
+			return nil, err
+		}
+		doc[i].Value = child
+		return doc, nil
+	}
+
+	if !nested {
+		return append(doc, bson.E{Key: key, Value: value}), nil
+	}
+	child, err := setPath(bson.D{}, rest, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(doc, bson.E{Key: key, Value: child}), nil
+}
+
+func unsetPath(doc bson.D, path string) bson.D {
+	key, rest, nested := strings.Cut(path, ".")
+	for i, e := range doc {
+		if e.Key != key {
+			continue
+		}
+		if !nested {
+			return append(doc[:i], doc[i+1:]...)
+		}
+		if child, ok := e.Value.(bson.D); ok {
+			doc[i].Value = unsetPath(child, rest)
+		}
+		return doc
+	}
+
+	return doc
+}
+
+// inc adds by to the number at path, keeping integers as integers the way the server does,
+// an int32 that overflows becomes an int64 and an int64 that overflows is an error
+func inc(doc bson.D, path string, by any) (bson.D, error) {
+	step, ok := number(by)
+	if !ok {
+		return nil, fmt.Errorf("mongotest: unable to $inc %s by %v, it isn't a number", path, by)
+	}
+
+	cur, exists := lookup(doc, path)
+	if !exists {
+		return setPath(doc, path, by)
+	}
+	n, ok := number(cur)
+	if !ok {
+		return nil, fmt.Errorf("mongotest: unable to $inc %s, it holds %T", path, cur)
+	}
+
+	x, curInt := integer(cur)
+	y, byInt := integer(by)
+	if !curInt || !byInt {
+		return setPath(doc, path, n+step)
+	}
+
+	if (y > 0 && x > math.MaxInt64-y) || (y < 0 && x < math.MinInt64-y) {
+		return nil, fmt.Errorf("mongotest: unable to $inc %s by %d, it overflows a 64-bit integer", path, y)
+	}
+	sum := x + y
+	if isType[int32](cur) && isType[int32](by) && sum >= math.MinInt32 && sum <= math.MaxInt32 {
+		return setPath(doc, path, int32(sum))
+	}
+
+	return setPath(doc, path, sum)
+}
+
+func isType[T any](v any) bool {
+	_, ok := v.(T)
+	return ok
+}
+
+// push appends to the array at path, {"$each": [...]} appends several
+func push(doc bson.D, path string, value any) (bson.D, error) {
+	values := bson.A{value}
+	if d, ok := value.(bson.D); ok && len(d) == 1 && d[0].Key == "$each" {
+		each, ok := d[0].Value.(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("mongotest: unable to $push %s, $each needs an array", path)
+		}
+		values = each
+	}
+
+	cur, exists := lookup(doc, path)
+	if !exists {
+		return setPath(doc, path, values)
+	}
+	arr, ok := cur.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("mongotest: unable to $push to %s, it holds %T", path, cur)
+	}
+
+	return setPath(doc, path, append(append(bson.A{}, arr...), values...))
+}
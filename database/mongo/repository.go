@@ -0,0 +1,262 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Repository is typed access to one logical collection from Details.Collections on the system's managed client,
+// the collection is looked up on every call so it follows vault refreshes, and there is no other state so one
+// repository can be shared between goroutines
+type Repository[T any] struct {
+	s    *System
+	name string
+}
+
+// NewRepository is a repository for the logical collection, the name is the key in Details.Collections
+// (MONGO_COLLECTION_<NAME> or mongo-collections in vault) rather than the collection itself
+func NewRepository[T any](s *System, collection string) (*Repository[T], error) {
+	if _, ok := s.Collections[collection]; !ok {
+		return nil, logs.Errorf("mongo: unable to find collection: %s", collection)
+	}
+
+	return &Repository[T]{
+		s:    s,
+		name: collection,
+	}, nil
+}
+
+type findOptions struct {
+	sort       any
+	projection any
+	skip       int64
+	limit      int64
+}
+
+type FindOption func(*findOptions)
+
+// WithSort orders the results, bson.D{{Key: "createdAt", Value: -1}}
+func WithSort(sort any) FindOption {
+	return func(o *findOptions) {
+		o.sort = sort
+	}
+}
+
+// WithProjection limits the fields decoded into T
+func WithProjection(projection any) FindOption {
+	return func(o *findOptions) {
+		o.projection = projection
+	}
+}
+
+func WithSkip(n int64) FindOption {
+	return func(o *findOptions) {
+		o.skip = n
+	}
+}
+
+func WithLimit(n int64) FindOption {
+	return func(o *findOptions) {
+		o.limit = n
+	}
+}
+
+// WithPage is page (counting from 1) of size documents, sort as well so the pages are stable
+func WithPage(page, size int64) FindOption {
+	return func(o *findOptions) {
+		o.skip = max(page-1, 0) * size
+		o.limit = size
+	}
+}
+
+func newFindOptions(opts []FindOption) findOptions {
+	o := findOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// orEmpty matches everything for a nil filter, the driver refuses nil
+func orEmpty(filter any) any {
+	if filter == nil {
+		return bson.D{}
+	}
+
+	return filter
+}
+
+// FindOne is the first document matching filter, mongo.ErrNoDocuments when there isn't one
+func (r *Repository[T]) FindOne(ctx context.Context, filter any, opts ...FindOption) (*T, error) {
+	c, err := r.s.collection(ctx, r.name)
+	if err != nil {
+		return nil, err
+	}
+
+	o := newFindOptions(opts)
+	fo := options.FindOne()
+	if o.sort != nil {
+		fo.SetSort(o.sort)
+	}
+	if o.projection != nil {
+		fo.SetProjection(o.projection)
+	}
+	if o.skip > 0 {
+		fo.SetSkip(o.skip)
+	}
+
+	var doc T
+	if err := c.FindOne(ctx, orEmpty(filter), fo).Decode(&doc); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+		return nil, logs.Errorf("mongo: unable to find in %s: %w", r.name, err)
+	}
+
+	return &doc, nil
+}
+
+// Find is every document matching filter, WithPage or WithSkip and WithLimit to page through them
+func (r *Repository[T]) Find(ctx context.Context, filter any, opts ...FindOption) ([]T, error) {
+	c, err := r.s.collection(ctx, r.name)
+	if err != nil {
+		return nil, err
+	}
+
+	o := newFindOptions(opts)
+	fo := options.Find()
+	if o.sort != nil {
+		fo.SetSort(o.sort)
+	}
+	if o.projection != nil {
+		fo.SetProjection(o.projection)
+	}
+	if o.skip > 0 {
+		fo.SetSkip(o.skip)
+	}
+	if o.limit > 0 {
+		fo.SetLimit(o.limit)
+	}
+
+	cur, err := c.Find(ctx, orEmpty(filter), fo)
+	if err != nil {
+		return nil, logs.Errorf("mongo: unable to find in %s: %w", r.name, err)
+	}
+
+	docs := []T{}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, logs.Errorf("mongo: unable to decode %s: %w", r.name, err)
+	}
+
+	return docs, nil
+}
+
+// Insert adds the documents and returns their ids in the same order
+func (r *Repository[T]) Insert(ctx context.Context, docs ...T) ([]any, error) {
+	if len(docs) == 0 {
+		return nil, nil
+	}
+
+	c, err := r.s.collection(ctx, r.name)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.InsertMany(ctx, docs)
+	if err != nil {
+		return nil, logs.Errorf("mongo: unable to insert into %s: %w", r.name, err)
+	}
+
+	return res.InsertedIDs, nil
+}
+
+// Update applies update, "$set" and the like, to every document matching filter
+func (r *Repository[T]) Update(ctx context.Context, filter, update any) (*mongo.UpdateResult, error) {
+	c, err := r.s.collection(ctx, r.name)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.UpdateMany(ctx, orEmpty(filter), update)
+	if err != nil {
+		return nil, logs.Errorf("mongo: unable to update %s: %w", r.name, err)
+	}
+
+	return res, nil
+}
+
+// Upsert replaces the document matching filter with doc, inserting doc when nothing matches
+func (r *Repository[T]) Upsert(ctx context.Context, filter any, doc T) (*mongo.UpdateResult, error) {
+	c, err := r.s.collection(ctx, r.name)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.ReplaceOne(ctx, orEmpty(filter), doc, options.Replace().SetUpsert(true))
+	if err != nil {
+		return nil, logs.Errorf("mongo: unable to upsert into %s: %w", r.name, err)
+	}
+
+	return res, nil
+}
+
+// Delete removes every document matching filter and returns how many went
+func (r *Repository[T]) Delete(ctx context.Context, filter any) (int64, error) {
+	c, err := r.s.collection(ctx, r.name)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := c.DeleteMany(ctx, orEmpty(filter))
+	if err != nil {
+		return 0, logs.Errorf("mongo: unable to delete from %s: %w", r.name, err)
+	}
+
+	return res.DeletedCount, nil
+}
+
+func (r *Repository[T]) Count(ctx context.Context, filter any) (int64, error) {
+	c, err := r.s.collection(ctx, r.name)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := c.CountDocuments(ctx, orEmpty(filter))
+	if err != nil {
+		return 0, logs.Errorf("mongo: unable to count %s: %w", r.name, err)
+	}
+
+	return n, nil
+}
+
+// Aggregate runs pipeline and decodes the results as T, AggregateAs decodes them as something else
+func (r *Repository[T]) Aggregate(ctx context.Context, pipeline any) ([]T, error) {
+	return AggregateAs[T](ctx, r, pipeline)
+}
+
+// AggregateAs runs pipeline on the repository's collection and decodes the results as R,
+// for stages such as $group whose output isn't shaped like the documents
+func AggregateAs[R, T any](ctx context.Context, r *Repository[T], pipeline any) ([]R, error) {
+	c, err := r.s.collection(ctx, r.name)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := c.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, logs.Errorf("mongo: unable to aggregate %s: %w", r.name, err)
+	}
+
+	results := []R{}
+	if err := cur.All(ctx, &results); err != nil {
+		return nil, logs.Errorf("mongo: unable to decode %s: %w", r.name, err)
+	}
+
+	return results, nil
+}
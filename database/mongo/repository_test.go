@@ -0,0 +1,112 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func TestNewRepository(t *testing.T) {
+	s := NewSystem()
+	s.Host = "localhost"
+	s.Scheme = schemeMongo
+	s.Database = "testDB"
+	s.Collections = map[string]string{"users": "app_users", "orders": "app_orders"}
+
+	_, err := NewRepository[struct{}](s, "missing")
+	assert.Error(t, err)
+
+	users, err := NewRepository[struct{}](s, "users")
+	require.NoError(t, err)
+	orders, err := NewRepository[struct{}](s, "orders")
+	require.NoError(t, err)
+	defer func() {
+		_ = s.Disconnect(context.Background())
+	}()
+
+	// repositories on different collections share the client without clobbering each other
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, want := users, "app_users"
+			if i%2 == 1 {
+				r, want = orders, "app_orders"
+			}
+			c, err := r.s.collection(context.Background(), r.name)
+			if assert.NoError(t, err) {
+				assert.Equal(t, want, c.Name())
+				assert.Equal(t, "testDB", c.Database().Name())
+			}
+		}()
+	}
+	wg.Wait()
+
+	client, err := s.Client()
+	require.NoError(t, err)
+	c, err := s.collection(context.Background(), "users")
+	require.NoError(t, err)
+	assert.Same(t, client, c.Database().Client())
+}
+
+func TestDisconnectSharedClient(t *testing.T) {
+	s := NewSystem()
+	s.Host = "localhost"
+	s.Scheme = schemeMongo
+	s.Database = "testDB"
+	s.Collections = map[string]string{"users": "app_users"}
+	other := *s
+
+	users, err := NewRepository[struct{}](&other, "users")
+	require.NoError(t, err)
+	first, err := s.Client()
+	require.NoError(t, err)
+
+	// one holder shutting down closes the shared client, the others connect again on their next call
+	require.NoError(t, s.Disconnect(context.Background()))
+	assert.ErrorIs(t, first.Disconnect(context.Background()), mongo.ErrClientDisconnected)
+
+	c, err := users.s.collection(context.Background(), "users")
+	require.NoError(t, err)
+	assert.NotSame(t, first, c.Database().Client())
+	current, err := other.Client()
+	require.NoError(t, err)
+	assert.Same(t, current, c.Database().Client())
+	assert.NoError(t, other.Disconnect(context.Background()))
+}
+
+func TestSystemWithoutBuild(t *testing.T) {
+	s := &System{}
+	_, err := s.Client()
+	assert.Error(t, err)
+	_, err = s.collection(context.Background(), "users")
+	assert.Error(t, err)
+	assert.NoError(t, s.Disconnect(context.Background()))
+}
+
+func TestFindOptions(t *testing.T) {
+	tests := []struct {
+		opts  []FindOption
+		skip  int64
+		limit int64
+	}{
+		{nil, 0, 0},
+		{[]FindOption{WithSkip(5), WithLimit(10)}, 5, 10},
+		{[]FindOption{WithPage(3, 25)}, 50, 25},
+		{[]FindOption{WithPage(0, 25)}, 0, 25},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d/%d", tt.skip, tt.limit), func(t *testing.T) {
+			o := newFindOptions(tt.opts)
+			assert.Equal(t, tt.skip, o.skip)
+			assert.Equal(t, tt.limit, o.limit)
+		})
+	}
+}
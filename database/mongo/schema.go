@@ -0,0 +1,375 @@
+package mongo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Index is an index to declare on a collection
+type Index struct {
+	// Name defaults to the name the server would give the keys, "email_1" or "tenant_1_createdAt_-1"
+	Name string
+	// Keys in order, the values are 1, -1 or an index type such as "text" or "2dsphere"
+	Keys   bson.D
+	Unique bool
+	Sparse bool
+	// TTL removes documents this long after the time in the index's one key, it is rounded down to seconds
+	TTL time.Duration
+	// PartialFilter only indexes the documents matching it
+	PartialFilter any
+}
+
+// Schema is what EnsureSchema keeps a collection in line with
+type Schema struct {
+	Indexes []Index
+	// Validator is the $jsonSchema the documents are checked against, bson.M{"bsonType": "object", "required": ...}
+	Validator any
+	// ValidationLevel is strict (the default) or moderate, ValidationAction is error (the default) or warn
+	ValidationLevel  string
+	ValidationAction string
+}
+
+// SchemaReport is what EnsureSchema did, and the differences it found but left for a person to sort out
+type SchemaReport struct {
+	Created []string
+	Updated []string
+	// Drift is indexes that exist with other options, indexes and validators that aren't declared,
+	// changing an index's keys or options means rebuilding it so that is left to a migration
+	Drift []string
+}
+
+// EnsureSchema creates the collections, indexes and validators declared in Schemas, and updates validators and TTLs
+// that have changed, so it can run at every startup. Indexes are never dropped, what differs is reported as drift
+func (s *System) EnsureSchema(ctx context.Context) (*SchemaReport, error) {
+	for _, logical := range slices.Sorted(maps.Keys(s.Schemas)) {
+		if err := s.Schemas[logical].validate(logical); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &SchemaReport{}
+	for _, logical := range slices.Sorted(maps.Keys(s.Schemas)) {
+		c, err := s.collection(ctx, logical)
+		if err != nil {
+			return report, err
+		}
+
+		schema := s.Schemas[logical]
+		if err := ensureCollection(ctx, c, schema, report); err != nil {
+			return report, err
+		}
+		if err := ensureIndexes(ctx, c, schema.Indexes, report); err != nil {
+			return report, err
+		}
+	}
+
+	for _, d := range report.Drift {
+		logs.Infof("mongo: schema drift, %s", d)
+	}
+
+	return report, nil
+}
+
+func (sc Schema) validate(logical string) error {
+	names := map[string]bool{}
+	for _, i := range sc.Indexes {
+		if len(i.Keys) == 0 {
+			return logs.Errorf("mongo: unable to declare an index without keys on %s", logical)
+		}
+		// the server only expires documents from single field indexes, and counts in whole seconds
+		if i.TTL != 0 && (len(i.Keys) != 1 || i.TTL < time.Second) {
+			return logs.Errorf("mongo: unable to declare ttl on %s, it needs one key and at least a second: %v", logical, i.Keys)
+		}
+
+		name, err := i.name()
+		if err != nil {
+			return err
+		}
+		if names[name] {
+			return logs.Errorf("mongo: unable to declare index %s twice on %s", name, logical)
+		}
+		names[name] = true
+	}
+
+	return nil
+}
+
+// name is Name or the server's name for the keys, the way the driver builds it
+func (i Index) name() (string, error) {
+	if i.Name != "" {
+		return i.Name, nil
+	}
+
+	parts := make([]string, 0, len(i.Keys)*2)
+	for _, k := range i.Keys {
+		switch v := k.Value.(type) {
+		case int, int32, int64, string:
+			parts = append(parts, k.Key, fmt.Sprint(v))
+		default:
+			return "", logs.Errorf("mongo: unable to use %T for index key %s, it needs an int or string", k.Value, k.Key)
+		}
+	}
+
+	return strings.Join(parts, "_"), nil
+}
+
+func (sc Schema) validator() bson.D {
+	return bson.D{{Key: "$jsonSchema", Value: sc.Validator}}
+}
+
+func orDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+
+	return v
+}
+
+type collectionOptions struct {
+	Validator        bson.Raw `bson:"validator"`
+	ValidationLevel  string   `bson:"validationLevel"`
+	ValidationAction string   `bson:"validationAction"`
+}
+
+// ensureCollection creates the collection with its validator, or brings the validator of an existing one up to date
+func ensureCollection(ctx context.Context, c *mongo.Collection, schema Schema, report *SchemaReport) error {
+	specs, err := c.Database().ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: c.Name()}})
+	if err != nil {
+		return logs.Errorf("mongo: unable to list collection %s: %v", c.Name(), err)
+	}
+
+	if len(specs) == 0 {
+		opts := options.CreateCollection()
+		if schema.Validator != nil {
+			opts.SetValidator(schema.validator()).
+				SetValidationLevel(orDefault(schema.ValidationLevel, "strict")).
+				SetValidationAction(orDefault(schema.ValidationAction, "error"))
+		}
+		if err := c.Database().CreateCollection(ctx, c.Name(), opts); err != nil {
+			return logs.Errorf("mongo: unable to create collection %s: %v", c.Name(), err)
+		}
+		report.Created = append(report.Created, c.Name())
+		return nil
+	}
+
+	var have collectionOptions
+	if len(specs[0].Options) > 0 {
+		if err := bson.Unmarshal(specs[0].Options, &have); err != nil {
+			return logs.Errorf("mongo: unable to read options of %s: %v", c.Name(), err)
+		}
+	}
+
+	if schema.Validator == nil {
+		if len(have.Validator) > 0 {
+			report.Drift = append(report.Drift, c.Name()+": validator is not declared")
+		}
+		return nil
+	}
+
+	level, action := orDefault(schema.ValidationLevel, "strict"), orDefault(schema.ValidationAction, "error")
+	if sameDocument(schema.validator(), have.Validator) && level == orDefault(have.ValidationLevel, "strict") && action == orDefault(have.ValidationAction, "error") {
+		return nil
+	}
+
+	cmd := bson.D{
+		{Key: "collMod", Value: c.Name()},
+		{Key: "validator", Value: schema.validator()},
+		{Key: "validationLevel", Value: level},
+		{Key: "validationAction", Value: action},
+	}
+	if err := c.Database().RunCommand(ctx, cmd).Err(); err != nil {
+		return logs.Errorf("mongo: unable to update validator of %s: %v", c.Name(), err)
+	}
+	report.Updated = append(report.Updated, c.Name()+": validator")
+
+	return nil
+}
+
+// indexSpec is an index as listIndexes describes it
+type indexSpec struct {
+	Name                    string   `bson:"name"`
+	Key                     bson.D   `bson:"key"`
+	Unique                  bool     `bson:"unique"`
+	Sparse                  bool     `bson:"sparse"`
+	ExpireAfterSeconds      *int64   `bson:"expireAfterSeconds"`
+	PartialFilterExpression bson.Raw `bson:"partialFilterExpression"`
+}
+
+func ensureIndexes(ctx context.Context, c *mongo.Collection, indexes []Index, report *SchemaReport) error {
+	cur, err := c.Indexes().List(ctx)
+	if err != nil {
+		return logs.Errorf("mongo: unable to list indexes of %s: %v", c.Name(), err)
+	}
+	var specs []indexSpec
+	if err := cur.All(ctx, &specs); err != nil {
+		return logs.Errorf("mongo: unable to read indexes of %s: %v", c.Name(), err)
+	}
+	existing := map[string]indexSpec{}
+	for _, spec := range specs {
+		existing[spec.Name] = spec
+	}
+
+	declared := map[string]bool{"_id_": true}
+	var missing []mongo.IndexModel
+	for _, i := range indexes {
+		name, _ := i.name()
+		declared[name] = true
+
+		have, ok := existing[name]
+		if !ok {
+			missing = append(missing, i.model(name))
+			continue
+		}
+
+		ttlChanged, drift := i.compare(have)
+		for _, d := range drift {
+			report.Drift = append(report.Drift, fmt.Sprintf("%s.%s: %s", c.Name(), name, d))
+		}
+		if ttlChanged && len(drift) == 0 {
+			cmd := bson.D{
+				{Key: "collMod", Value: c.Name()},
+				{Key: "index", Value: bson.D{{Key: "name", Value: name}, {Key: "expireAfterSeconds", Value: int64(i.TTL.Seconds())}}},
+			}
+			if err := c.Database().RunCommand(ctx, cmd).Err(); err != nil {
+				return logs.Errorf("mongo: unable to update ttl of %s.%s: %v", c.Name(), name, err)
+			}
+			report.Updated = append(report.Updated, fmt.Sprintf("%s.%s: ttl", c.Name(), name))
+		}
+	}
+
+	if len(missing) > 0 {
+		names, err := c.Indexes().CreateMany(ctx, missing)
+		if err != nil {
+			return logs.Errorf("mongo: unable to create indexes on %s: %v", c.Name(), err)
+		}
+		for _, name := range names {
+			report.Created = append(report.Created, c.Name()+"."+name)
+		}
+	}
+
+	for _, spec := range specs {
+		if !declared[spec.Name] {
+			report.Drift = append(report.Drift, fmt.Sprintf("%s.%s: index is not declared", c.Name(), spec.Name))
+		}
+	}
+
+	return nil
+}
+
+func (i Index) model(name string) mongo.IndexModel {
+	opts := options.Index().SetName(name)
+	if i.Unique {
+		opts.SetUnique(true)
+	}
+	if i.Sparse {
+		opts.SetSparse(true)
+	}
+	if i.TTL != 0 {
+		opts.SetExpireAfterSeconds(int32(i.TTL.Seconds()))
+	}
+	if i.PartialFilter != nil {
+		opts.SetPartialFilterExpression(i.PartialFilter)
+	}
+
+	return mongo.IndexModel{Keys: i.Keys, Options: opts}
+}
+
+// compare is how an existing index differs from the declaration, a different ttl can be changed in place,
+// anything else needs the index rebuilding
+func (i Index) compare(have indexSpec) (bool, []string) {
+	var drift []string
+	if !sameKeys(i.Keys, have.Key) {
+		drift = append(drift, fmt.Sprintf("keys are %v, declared %v", have.Key, i.Keys))
+	}
+	if i.Unique != have.Unique {
+		drift = append(drift, fmt.Sprintf("unique is %t, declared %t", have.Unique, i.Unique))
+	}
+	if i.Sparse != have.Sparse {
+		drift = append(drift, fmt.Sprintf("sparse is %t, declared %t", have.Sparse, i.Sparse))
+	}
+	if (i.PartialFilter == nil) != (len(have.PartialFilterExpression) == 0) ||
+		i.PartialFilter != nil && !sameDocument(i.PartialFilter, have.PartialFilterExpression) {
+		drift = append(drift, "partial filter differs")
+	}
+
+	ttl := int64(i.TTL.Seconds())
+	switch {
+	case have.ExpireAfterSeconds == nil && ttl != 0:
+		drift = append(drift, "is not a ttl index")
+	case have.ExpireAfterSeconds != nil && ttl == 0:
+		drift = append(drift, "is a ttl index")
+	case have.ExpireAfterSeconds != nil && *have.ExpireAfterSeconds != ttl:
+		return true, drift
+	}
+
+	return false, drift
+}
+
+// sameKeys compares index keys in order, the server can hand back 1 as an int32 or a double
+func sameKeys(want, have bson.D) bool {
+	if len(want) != len(have) {
+		return false
+	}
+	for n := range want {
+		if want[n].Key != have[n].Key || fmt.Sprint(keyValue(want[n].Value)) != fmt.Sprint(keyValue(have[n].Value)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func keyValue(v any) any {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	}
+
+	return v
+}
+
+// sameDocument compares two documents the way the server treats them, ignoring key order and number types
+func sameDocument(a, b any) bool {
+	na, err := normalise(a)
+	if err != nil {
+		return false
+	}
+	nb, err := normalise(b)
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(na, nb)
+}
+
+func normalise(doc any) (any, error) {
+	if raw, ok := doc.(bson.Raw); ok && len(raw) == 0 {
+		return nil, nil
+	}
+
+	b, err := bson.MarshalExtJSON(doc, false, false)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
@@ -0,0 +1,119 @@
+package mongo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestIndexName(t *testing.T) {
+	tests := []struct {
+		index Index
+		want  string
+	}{
+		{Index{Keys: bson.D{{Key: "email", Value: 1}}}, "email_1"},
+		{Index{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "createdAt", Value: int32(-1)}}}, "tenant_1_createdAt_-1"},
+		{Index{Keys: bson.D{{Key: "body", Value: "text"}}}, "body_text"},
+		{Index{Name: "by_email", Keys: bson.D{{Key: "email", Value: 1}}}, "by_email"},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.index.name()
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, got)
+	}
+
+	_, err := Index{Keys: bson.D{{Key: "email", Value: 1.5}}}.name()
+	assert.Error(t, err)
+}
+
+func TestSchemaValidate(t *testing.T) {
+	email := Index{Keys: bson.D{{Key: "email", Value: 1}}}
+
+	assert.NoError(t, Schema{Indexes: []Index{email, {Keys: bson.D{{Key: "seen", Value: 1}}, TTL: time.Hour}}}.validate("users"))
+	assert.Error(t, Schema{Indexes: []Index{{}}}.validate("users"))
+	assert.Error(t, Schema{Indexes: []Index{email, email}}.validate("users"))
+	assert.Error(t, Schema{Indexes: []Index{{Keys: bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 1}}, TTL: time.Hour}}}.validate("users"))
+	assert.Error(t, Schema{Indexes: []Index{{Keys: bson.D{{Key: "seen", Value: 1}}, TTL: time.Millisecond}}}.validate("users"))
+
+	s := &System{Schemas: map[string]Schema{"users": {Indexes: []Index{{}}}}}
+	_, err := s.EnsureSchema(context.Background())
+	assert.Error(t, err)
+}
+
+func TestIndexCompare(t *testing.T) {
+	ttl := int64(3600)
+	other := int64(60)
+
+	tests := []struct {
+		name       string
+		index      Index
+		have       indexSpec
+		ttlChanged bool
+		drift      int
+	}{
+		{
+			name:  "same",
+			index: Index{Keys: bson.D{{Key: "email", Value: 1}}, Unique: true},
+			have:  indexSpec{Key: bson.D{{Key: "email", Value: 1.0}}, Unique: true},
+		},
+		{
+			name:  "unique and keys",
+			index: Index{Keys: bson.D{{Key: "email", Value: 1}}, Unique: true},
+			have:  indexSpec{Key: bson.D{{Key: "email", Value: int32(-1)}}},
+			drift: 2,
+		},
+		{
+			name:       "ttl",
+			index:      Index{Keys: bson.D{{Key: "seen", Value: 1}}, TTL: time.Hour},
+			have:       indexSpec{Key: bson.D{{Key: "seen", Value: int32(1)}}, ExpireAfterSeconds: &other},
+			ttlChanged: true,
+		},
+		{
+			name:  "not ttl",
+			index: Index{Keys: bson.D{{Key: "seen", Value: 1}}},
+			have:  indexSpec{Key: bson.D{{Key: "seen", Value: int32(1)}}, ExpireAfterSeconds: &ttl},
+			drift: 1,
+		},
+		{
+			name:  "same partial filter",
+			index: Index{Keys: bson.D{{Key: "email", Value: 1}}, PartialFilter: bson.M{"active": true, "age": bson.M{"$gt": 18}}},
+			have:  indexSpec{Key: bson.D{{Key: "email", Value: int32(1)}}, PartialFilterExpression: mustMarshal(t, bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: int64(18)}}}, {Key: "active", Value: true}})},
+		},
+		{
+			name:  "missing partial filter",
+			index: Index{Keys: bson.D{{Key: "email", Value: 1}}, PartialFilter: bson.M{"active": true}},
+			have:  indexSpec{Key: bson.D{{Key: "email", Value: int32(1)}}},
+			drift: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttlChanged, drift := tt.index.compare(tt.have)
+			assert.Equal(t, tt.ttlChanged, ttlChanged)
+			assert.Len(t, drift, tt.drift, drift)
+		})
+	}
+}
+
+func TestSameDocument(t *testing.T) {
+	validator := Schema{Validator: bson.M{"bsonType": "object", "required": []string{"email"}}}.validator()
+	stored := mustMarshal(t, bson.D{{Key: "$jsonSchema", Value: bson.D{{Key: "required", Value: bson.A{"email"}}, {Key: "bsonType", Value: "object"}}}})
+
+	assert.True(t, sameDocument(validator, stored))
+	assert.False(t, sameDocument(validator, mustMarshal(t, bson.D{{Key: "$jsonSchema", Value: bson.D{{Key: "bsonType", Value: "object"}}}})))
+	assert.False(t, sameDocument(validator, bson.Raw(nil)))
+}
+
+func mustMarshal(t *testing.T, doc any) bson.Raw {
+	t.Helper()
+
+	b, err := bson.Marshal(doc)
+	require.NoError(t, err)
+	return b
+}
@@ -0,0 +1,82 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	labelTransient     = "TransientTransactionError"
+	labelUnknownCommit = "UnknownTransactionCommitResult"
+
+	// transactionRetryLimit is how long a transaction keeps being retried, the same limit the driver uses
+	transactionRetryLimit = 120 * time.Second
+)
+
+// WithTransaction runs fn in a transaction on a session of the managed client and commits it when fn returns nil.
+// Repository calls made with the ctx fn is given take part in the transaction. The whole transaction runs again when
+// it fails with a TransientTransactionError and the commit is retried on an UnknownTransactionCommitResult, for up to
+// two minutes, so fn can run more than once and shouldn't have side effects outside the database
+func (s *System) WithTransaction(ctx context.Context, fn func(ctx context.Context) error, opts ...options.Lister[options.TransactionOptions]) error {
+	client, err := s.Client()
+	if err != nil {
+		return err
+	}
+
+	sess, err := client.StartSession()
+	if err != nil {
+		return logs.Errorf("mongo: unable to start session: %v", err)
+	}
+	defer sess.EndSession(context.WithoutCancel(ctx))
+
+	deadline := time.Now().Add(transactionRetryLimit)
+	for {
+		err := runTransaction(ctx, sess, fn, deadline, opts)
+		if err == nil {
+			return nil
+		}
+		if !hasErrorLabel(err, labelTransient) || !retryable(ctx, deadline) {
+			return err
+		}
+		logs.Infof("mongo: retrying transaction: %v", err)
+	}
+}
+
+// runTransaction is one attempt at the transaction, the commit is retried on its own when its result is unknown
+func runTransaction(ctx context.Context, sess *mongo.Session, fn func(ctx context.Context) error, deadline time.Time, opts []options.Lister[options.TransactionOptions]) error {
+	if err := sess.StartTransaction(opts...); err != nil {
+		return logs.Errorf("mongo: unable to start transaction: %v", err)
+	}
+
+	if err := fn(mongo.NewSessionContext(ctx, sess)); err != nil {
+		// aborting on a context that isn't done, so a cancelled caller doesn't leave the transaction holding locks
+		_ = sess.AbortTransaction(context.WithoutCancel(ctx))
+		return err
+	}
+
+	for {
+		err := sess.CommitTransaction(ctx)
+		if err == nil {
+			return nil
+		}
+		// a commit that timed out would only time out again
+		if hasErrorLabel(err, labelUnknownCommit) && !mongo.IsTimeout(err) && retryable(ctx, deadline) {
+			continue
+		}
+		return logs.Errorf("mongo: unable to commit transaction: %w", err)
+	}
+}
+
+func hasErrorLabel(err error, label string) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorLabel(label)
+}
+
+func retryable(ctx context.Context, deadline time.Time) bool {
+	return ctx.Err() == nil && time.Now().Before(deadline)
+}
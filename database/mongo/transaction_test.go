@@ -0,0 +1,75 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func TestHasErrorLabel(t *testing.T) {
+	transient := mongo.CommandError{Code: 251, Labels: []string{labelTransient}}
+
+	assert.True(t, hasErrorLabel(transient, labelTransient))
+	assert.True(t, hasErrorLabel(fmt.Errorf("mongo: unable to insert into users: %w", transient), labelTransient))
+	assert.False(t, hasErrorLabel(transient, labelUnknownCommit))
+	assert.False(t, hasErrorLabel(fmt.Errorf("mongo: unable to insert into users: %v", transient), labelTransient))
+	assert.False(t, hasErrorLabel(nil, labelTransient))
+}
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, retryable(context.Background(), time.Now().Add(time.Minute)))
+	assert.False(t, retryable(context.Background(), time.Now().Add(-time.Second)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, retryable(ctx, time.Now().Add(time.Minute)))
+}
+
+func TestWithTransactionWithoutBuild(t *testing.T) {
+	s := &System{}
+	called := false
+	err := s.WithTransaction(context.Background(), func(context.Context) error {
+		called = true
+		return nil
+	})
+	assert.Error(t, err)
+	assert.False(t, called)
+}
+
+func TestCollectionInSession(t *testing.T) {
+	s := NewSystem()
+	s.Host = "localhost"
+	s.Scheme = schemeMongo
+	s.Database = "testDB"
+	s.Collections = map[string]string{"users": "app_users"}
+	defer func() {
+		_ = s.Disconnect(context.Background())
+	}()
+
+	// a session from a client the managed one has since replaced
+	other, err := connect(*s)
+	require.NoError(t, err)
+	defer func() {
+		_ = other.Disconnect(context.Background())
+	}()
+	sess, err := other.StartSession()
+	require.NoError(t, err)
+	defer sess.EndSession(context.Background())
+
+	c, err := s.collection(mongo.NewSessionContext(context.Background(), sess), "users")
+	require.NoError(t, err)
+	assert.Same(t, other, c.Database().Client())
+	assert.Equal(t, "app_users", c.Name())
+	assert.Equal(t, "testDB", c.Database().Name())
+
+	managed, err := s.Client()
+	require.NoError(t, err)
+	c, err = s.collection(context.Background(), "users")
+	require.NoError(t, err)
+	assert.Same(t, managed, c.Database().Client())
+}
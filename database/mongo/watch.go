@@ -0,0 +1,390 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	reconnectInitialBackoff = 200 * time.Millisecond
+	reconnectMaxBackoff     = 30 * time.Second
+
+	// eventBuffer lets a burst of changes queue up while the receiver is busy
+	eventBuffer = 64
+	// watchPoll is how long a quiet stream waits on the server before checking the client hasn't been replaced
+	watchPoll = time.Second
+	// codeHistoryLost is the server no longer having the oplog entry a resume token points at
+	codeHistoryLost = 286
+)
+
+// ChangeEvent is one change from a change stream, ID is its resume token
+type ChangeEvent struct {
+	ID            bson.Raw       `bson:"_id"`
+	OperationType string         `bson:"operationType"`
+	ClusterTime   bson.Timestamp `bson:"clusterTime"`
+	Namespace     struct {
+		Database   string `bson:"db"`
+		Collection string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey bson.Raw `bson:"documentKey"`
+	// FullDocument is the document after the change, for updates only when the full document is looked up
+	FullDocument      bson.Raw `bson:"fullDocument"`
+	UpdateDescription bson.Raw `bson:"updateDescription"`
+}
+
+// Decode decodes the full document into v
+func (e ChangeEvent) Decode(v any) error {
+	if len(e.FullDocument) == 0 {
+		return logs.Errorf("mongo: unable to decode %s event without a full document", e.OperationType)
+	}
+	if err := bson.Unmarshal(e.FullDocument, v); err != nil {
+		return logs.Errorf("mongo: unable to decode %s event: %v", e.OperationType, err)
+	}
+
+	return nil
+}
+
+// TokenStore keeps the resume token of the last event handed over, so a restarted watch carries on from there
+type TokenStore interface {
+	// Load is the token saved for key, nil when there isn't one
+	Load(ctx context.Context, key string) (bson.Raw, error)
+	Save(ctx context.Context, key string, token bson.Raw) error
+}
+
+type watchOptions struct {
+	store        TokenStore
+	key          string
+	fullDocument options.FullDocument
+}
+
+type WatchOption func(*watchOptions)
+
+// WithTokenStore saves the resume token under key after every event and resumes from it when the watch starts,
+// key tells apart watches sharing a store so use one per consumer
+func WithTokenStore(store TokenStore, key string) WatchOption {
+	return func(o *watchOptions) {
+		o.store = store
+		o.key = key
+	}
+}
+
+// WithFullDocument changes what updates carry, options.UpdateLookup (the default) reads the document as it is now,
+// options.Default leaves it out and saves the lookup
+func WithFullDocument(fd options.FullDocument) WatchOption {
+	return func(o *watchOptions) {
+		o.fullDocument = fd
+	}
+}
+
+// Watch opens a change stream on the logical collection, filtered by pipeline (nil for every change), and keeps it
+// open until ctx ends. When the stream breaks, or a vault refresh replaces the client, it reconnects with backoff
+// and resumes after the last event handed over, so nothing is missed unless the oplog has moved past it.
+// Events are delivered at least once, a restart resumes from the token store and may repeat the last one.
+// Change streams need a replica set or sharded cluster. The returned channel is closed once ctx ends
+func (s *System) Watch(ctx context.Context, logical string, pipeline any, opts ...WatchOption) (<-chan ChangeEvent, error) {
+	o := watchOptions{fullDocument: options.UpdateLookup}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if pipeline == nil {
+		pipeline = mongo.Pipeline{}
+	}
+
+	w := &watcher{
+		source:   collectionSource{s: s, logical: logical},
+		logical:  logical,
+		pipeline: pipeline,
+		opts:     o,
+	}
+
+	return w.start(ctx)
+}
+
+// changeStream is the part of *mongo.ChangeStream the watcher uses
+type changeStream interface {
+	TryNext(ctx context.Context) bool
+	Decode(v any) error
+	ResumeToken() bson.Raw
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// streamSource opens change streams on the managed client, the watcher only sees the streams and which client they are on
+type streamSource interface {
+	Watch(ctx context.Context, pipeline any, opts *options.ChangeStreamOptionsBuilder) (changeStream, *mongo.Client, error)
+	// Client is the current client, a stream on any other one is on a client a vault refresh has replaced
+	Client(ctx context.Context) (*mongo.Client, error)
+}
+
+// collectionSource watches the logical collection on whichever client the system currently manages
+type collectionSource struct {
+	s       *System
+	logical string
+}
+
+func (c collectionSource) Watch(ctx context.Context, pipeline any, opts *options.ChangeStreamOptionsBuilder) (changeStream, *mongo.Client, error) {
+	col, err := c.s.collection(ctx, c.logical)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cs, err := col.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cs, col.Database().Client(), nil
+}
+
+func (c collectionSource) Client(ctx context.Context) (*mongo.Client, error) {
+	col, err := c.s.collection(ctx, c.logical)
+	if err != nil {
+		return nil, err
+	}
+
+	return col.Database().Client(), nil
+}
+
+type watcher struct {
+	source   streamSource
+	logical  string
+	pipeline any
+	opts     watchOptions
+	// token is the resume token of the last event handed over
+	token bson.Raw
+}
+
+// start loads the saved token, opens the stream and hands events over until ctx ends
+func (w *watcher) start(ctx context.Context) (<-chan ChangeEvent, error) {
+	if w.opts.store != nil {
+		token, err := w.opts.store.Load(ctx, w.opts.key)
+		if err != nil {
+			return nil, logs.Errorf("mongo: unable to load resume token for %s: %v", w.opts.key, err)
+		}
+		w.token = token
+	}
+
+	cs, client, err := w.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan ChangeEvent, eventBuffer)
+	go w.run(ctx, cs, client, out)
+
+	return out, nil
+}
+
+// open starts the stream after the last token on the current client, a token the oplog has moved past is dropped
+// and the stream starts from now, since retrying it would never succeed
+func (w *watcher) open(ctx context.Context) (changeStream, *mongo.Client, error) {
+	csOpts := options.ChangeStream().SetFullDocument(w.opts.fullDocument).SetMaxAwaitTime(watchPoll)
+	if w.token != nil {
+		csOpts.SetResumeAfter(w.token)
+	}
+
+	cs, client, err := w.source.Watch(ctx, w.pipeline, csOpts)
+	if err != nil && w.token != nil && isHistoryLost(err) {
+		logs.Infof("mongo: resume token for %s is too old, changes since it are lost, watching from now", w.logical)
+		w.token = nil
+		return w.open(ctx)
+	}
+	if err != nil {
+		return nil, nil, logs.Errorf("mongo: unable to watch %s: %v", w.logical, err)
+	}
+
+	return cs, client, nil
+}
+
+func (w *watcher) run(ctx context.Context, cs changeStream, client *mongo.Client, out chan<- ChangeEvent) {
+	defer close(out)
+
+	for {
+		if cs.TryNext(ctx) {
+			var ev ChangeEvent
+			if err := cs.Decode(&ev); err != nil {
+				logs.Infof("mongo: unable to decode change on %s: %v", w.logical, err)
+				continue
+			}
+
+			select {
+			case out <- ev:
+				w.save(ctx, slices.Clone(cs.ResumeToken()))
+				continue
+			case <-ctx.Done():
+			}
+		}
+
+		err := cs.Err()
+		if ctx.Err() != nil {
+			closeStream(ctx, cs)
+			return
+		}
+
+		if err == nil {
+			if !w.replaced(ctx, client) {
+				continue
+			}
+			logs.Infof("mongo: client replaced, resuming watch on %s", w.logical)
+		} else {
+			logs.Infof("mongo: change stream on %s lost, reconnecting: %v", w.logical, err)
+		}
+
+		closeStream(ctx, cs)
+		if cs, client = w.reconnect(ctx); cs == nil {
+			return
+		}
+	}
+}
+
+// replaced is whether the managed client has moved on from the one the stream is on, after a vault refresh
+func (w *watcher) replaced(ctx context.Context, client *mongo.Client) bool {
+	current, err := w.source.Client(ctx)
+	if err != nil {
+		return false
+	}
+
+	return current != client
+}
+
+func (w *watcher) save(ctx context.Context, token bson.Raw) {
+	w.token = token
+	if w.opts.store == nil {
+		return
+	}
+
+	if err := w.opts.store.Save(ctx, w.opts.key, token); err != nil && ctx.Err() == nil {
+		logs.Infof("mongo: unable to save resume token for %s: %v", w.opts.key, err)
+	}
+}
+
+// reconnect keeps opening the stream with backoff until it succeeds, it gives up with nil once ctx ends
+func (w *watcher) reconnect(ctx context.Context) (changeStream, *mongo.Client) {
+	for attempt := 1; ; attempt++ {
+		timer := time.NewTimer(reconnectBackoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil
+		case <-timer.C:
+		}
+
+		cs, client, err := w.open(ctx)
+		if err == nil {
+			return cs, client
+		}
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		logs.Infof("mongo: unable to reconnect watch on %s, attempt %d: %v", w.logical, attempt, err)
+	}
+}
+
+// reconnectBackoff doubles from the initial backoff up to the max, spread by up to a fifth either way
+func reconnectBackoff(attempt int) time.Duration {
+	wait := reconnectInitialBackoff
+	for i := 1; i < attempt && wait < reconnectMaxBackoff; i++ {
+		wait *= 2
+	}
+	wait = min(wait, reconnectMaxBackoff)
+	spread := (rand.Float64()*2 - 1) * 0.2
+
+	return time.Duration(float64(wait) * (1 + spread))
+}
+
+// closeStream closes a stream that may already be broken, with a context that isn't done so the close is sent
+func closeStream(ctx context.Context, cs changeStream) {
+	closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+	defer cancel()
+
+	_ = cs.Close(closeCtx)
+}
+
+func isHistoryLost(err error) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorCode(codeHistoryLost)
+}
+
+// MemoryTokenStore keeps resume tokens in the process, so a watch resumes across reconnects but not restarts
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]bson.Raw
+}
+
+func (m *MemoryTokenStore) Load(_ context.Context, key string) (bson.Raw, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.tokens[key], nil
+}
+
+func (m *MemoryTokenStore) Save(_ context.Context, key string, token bson.Raw) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.tokens == nil {
+		m.tokens = make(map[string]bson.Raw)
+	}
+	m.tokens[key] = token
+
+	return nil
+}
+
+// CollectionTokenStore keeps resume tokens in a logical collection, one document per key
+type CollectionTokenStore struct {
+	s       *System
+	logical string
+}
+
+func NewCollectionTokenStore(s *System, collection string) *CollectionTokenStore {
+	return &CollectionTokenStore{
+		s:       s,
+		logical: collection,
+	}
+}
+
+type storedToken struct {
+	Key       string    `bson:"_id"`
+	Token     bson.Raw  `bson:"token"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
+
+func (c *CollectionTokenStore) Load(ctx context.Context, key string) (bson.Raw, error) {
+	col, err := c.s.collection(ctx, c.logical)
+	if err != nil {
+		return nil, err
+	}
+
+	var st storedToken
+	if err := col.FindOne(ctx, bson.D{{Key: "_id", Value: key}}).Decode(&st); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, logs.Errorf("mongo: unable to load resume token %s: %v", key, err)
+	}
+
+	return st.Token, nil
+}
+
+func (c *CollectionTokenStore) Save(ctx context.Context, key string, token bson.Raw) error {
+	col, err := c.s.collection(ctx, c.logical)
+	if err != nil {
+		return err
+	}
+
+	st := storedToken{Key: key, Token: token, UpdatedAt: time.Now()}
+	if _, err := col.ReplaceOne(ctx, bson.D{{Key: "_id", Value: key}}, st, options.Replace().SetUpsert(true)); err != nil {
+		return logs.Errorf("mongo: unable to save resume token %s: %v", key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,333 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	for attempt, base := range map[int]time.Duration{
+		1:   reconnectInitialBackoff,
+		2:   2 * reconnectInitialBackoff,
+		4:   8 * reconnectInitialBackoff,
+		20:  reconnectMaxBackoff,
+		100: reconnectMaxBackoff,
+	} {
+		wait := reconnectBackoff(attempt)
+		assert.GreaterOrEqual(t, wait, time.Duration(float64(base)*0.8), "attempt %d", attempt)
+		assert.LessOrEqual(t, wait, time.Duration(float64(base)*1.2), "attempt %d", attempt)
+	}
+}
+
+func TestChangeEventDecode(t *testing.T) {
+	raw := mustMarshal(t, bson.D{
+		{Key: "_id", Value: bson.D{{Key: "_data", Value: "8263"}}},
+		{Key: "operationType", Value: "insert"},
+		{Key: "ns", Value: bson.D{{Key: "db", Value: "test"}, {Key: "coll", Value: "users"}}},
+		{Key: "documentKey", Value: bson.D{{Key: "_id", Value: "u1"}}},
+		{Key: "fullDocument", Value: bson.D{{Key: "_id", Value: "u1"}, {Key: "name", Value: "alice"}}},
+	})
+
+	var ev ChangeEvent
+	require.NoError(t, bson.Unmarshal(raw, &ev))
+	assert.Equal(t, "insert", ev.OperationType)
+	assert.Equal(t, "users", ev.Namespace.Collection)
+	assert.Equal(t, "8263", ev.ID.Lookup("_data").StringValue())
+
+	var user struct {
+		Name string `bson:"name"`
+	}
+	require.NoError(t, ev.Decode(&user))
+	assert.Equal(t, "alice", user.Name)
+
+	assert.Error(t, ChangeEvent{OperationType: "delete"}.Decode(&user))
+}
+
+func TestMemoryTokenStore(t *testing.T) {
+	ctx := context.Background()
+	store := &MemoryTokenStore{}
+
+	token, err := store.Load(ctx, "users")
+	require.NoError(t, err)
+	assert.Nil(t, token)
+
+	saved := mustMarshal(t, bson.D{{Key: "_data", Value: "8263"}})
+	require.NoError(t, store.Save(ctx, "users", saved))
+	token, err = store.Load(ctx, "users")
+	require.NoError(t, err)
+	assert.Equal(t, saved, token)
+
+	token, err = store.Load(ctx, "orders")
+	require.NoError(t, err)
+	assert.Nil(t, token)
+}
+
+type failingStore struct{}
+
+func (failingStore) Load(context.Context, string) (bson.Raw, error) {
+	return nil, errors.New("unavailable")
+}
+
+func (failingStore) Save(context.Context, string, bson.Raw) error {
+	return errors.New("unavailable")
+}
+
+func TestWatchTokenStoreError(t *testing.T) {
+	s := NewSystem()
+	_, err := s.Watch(context.Background(), "users", nil, WithTokenStore(failingStore{}, "users"))
+	assert.Error(t, err)
+}
+
+func TestIsHistoryLost(t *testing.T) {
+	lost := mongo.CommandError{Code: codeHistoryLost, Name: "ChangeStreamHistoryLost"}
+
+	assert.True(t, isHistoryLost(lost))
+	assert.True(t, isHistoryLost(fmt.Errorf("watch: %w", lost)))
+	assert.False(t, isHistoryLost(mongo.CommandError{Code: 11600}))
+	assert.False(t, isHistoryLost(errors.New("history lost")))
+}
+
+// fakeStream hands over its events then reports err, with no err it stays open and quiet like an idle stream
+type fakeStream struct {
+	mu      sync.Mutex
+	events  []ChangeEvent
+	current ChangeEvent
+	err     error
+	closed  bool
+}
+
+func (f *fakeStream) TryNext(ctx context.Context) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.events) == 0 {
+		if f.err == nil {
+			// stands in for the server's max await time
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Millisecond):
+			}
+		}
+		return false
+	}
+
+	f.current, f.events = f.events[0], f.events[1:]
+	return true
+}
+
+func (f *fakeStream) Decode(v any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	*v.(*ChangeEvent) = f.current
+
+	return nil
+}
+
+func (f *fakeStream) ResumeToken() bson.Raw {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.current.ID
+}
+
+func (f *fakeStream) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.events) > 0 {
+		return nil
+	}
+
+	return f.err
+}
+
+func (f *fakeStream) Close(context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+
+	return nil
+}
+
+func (f *fakeStream) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.closed
+}
+
+// fakeSource hands out its streams in order, an error in errs is returned by the open at the same position instead
+type fakeSource struct {
+	mu      sync.Mutex
+	client  *mongo.Client
+	streams []*fakeStream
+	errs    []error
+	// resumed is the resume token each open asked for
+	resumed []bson.Raw
+}
+
+func (f *fakeSource) Watch(_ context.Context, _ any, opts *options.ChangeStreamOptionsBuilder) (changeStream, *mongo.Client, error) {
+	var o options.ChangeStreamOptions
+	for _, set := range opts.List() {
+		_ = set(&o)
+	}
+	token, _ := o.ResumeAfter.(bson.Raw)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resumed = append(f.resumed, token)
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(f.streams) == 0 {
+		return nil, nil, errors.New("no more streams")
+	}
+	cs := f.streams[0]
+	f.streams = f.streams[1:]
+
+	return cs, f.client, nil
+}
+
+func (f *fakeSource) Client(context.Context) (*mongo.Client, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.client, nil
+}
+
+func (f *fakeSource) replaceClient() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.client = &mongo.Client{}
+}
+
+func (f *fakeSource) tokens() []bson.Raw {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]bson.Raw(nil), f.resumed...)
+}
+
+func changeEvent(t *testing.T, id string) ChangeEvent {
+	t.Helper()
+
+	return ChangeEvent{ID: token(t, id), OperationType: "insert"}
+}
+
+func token(t *testing.T, data string) bson.Raw {
+	t.Helper()
+
+	return mustMarshal(t, bson.D{{Key: "_data", Value: data}})
+}
+
+func receive(t *testing.T, events <-chan ChangeEvent) ChangeEvent {
+	t.Helper()
+
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change event")
+		return ChangeEvent{}
+	}
+}
+
+func TestWatcherResumesAfterLostStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := &fakeStream{events: []ChangeEvent{changeEvent(t, "1"), changeEvent(t, "2")}, err: errors.New("connection reset")}
+	second := &fakeStream{events: []ChangeEvent{changeEvent(t, "3")}}
+	source := &fakeSource{client: &mongo.Client{}, streams: []*fakeStream{first, second}}
+	store := &MemoryTokenStore{}
+
+	w := &watcher{source: source, logical: "users", opts: watchOptions{store: store, key: "users"}}
+	events, err := w.start(ctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, token(t, "1"), receive(t, events).ID)
+	assert.Equal(t, token(t, "2"), receive(t, events).ID)
+	assert.Equal(t, token(t, "3"), receive(t, events).ID)
+	assert.True(t, first.isClosed())
+	assert.Equal(t, []bson.Raw{nil, token(t, "2")}, source.tokens(), "the new stream resumes after the last event handed over")
+
+	saved, err := store.Load(ctx, "users")
+	require.NoError(t, err)
+	assert.Equal(t, token(t, "3"), saved)
+
+	cancel()
+	_, open := <-events
+	assert.False(t, open)
+	assert.Eventually(t, second.isClosed, time.Second, 10*time.Millisecond)
+}
+
+func TestWatcherResumesFromTokenStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := &MemoryTokenStore{}
+	require.NoError(t, store.Save(ctx, "users", token(t, "7")))
+	source := &fakeSource{client: &mongo.Client{}, streams: []*fakeStream{{events: []ChangeEvent{changeEvent(t, "8")}}}}
+
+	w := &watcher{source: source, logical: "users", opts: watchOptions{store: store, key: "users"}}
+	events, err := w.start(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, token(t, "8"), receive(t, events).ID)
+	assert.Equal(t, []bson.Raw{token(t, "7")}, source.tokens())
+}
+
+func TestWatcherHistoryLost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := &MemoryTokenStore{}
+	require.NoError(t, store.Save(ctx, "users", token(t, "old")))
+	source := &fakeSource{
+		client:  &mongo.Client{},
+		streams: []*fakeStream{{events: []ChangeEvent{changeEvent(t, "9")}}},
+		errs:    []error{mongo.CommandError{Code: codeHistoryLost, Name: "ChangeStreamHistoryLost"}},
+	}
+
+	w := &watcher{source: source, logical: "users", opts: watchOptions{store: store, key: "users"}}
+	events, err := w.start(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, token(t, "9"), receive(t, events).ID)
+	assert.Equal(t, []bson.Raw{token(t, "old"), nil}, source.tokens(), "a token the oplog has moved past is dropped")
+
+	failing := &fakeSource{client: &mongo.Client{}, errs: []error{errors.New("not a replica set")}}
+	w = &watcher{source: failing, logical: "users"}
+	_, err = w.start(ctx)
+	assert.Error(t, err)
+	assert.Len(t, failing.tokens(), 1, "other errors are not retried without the token")
+}
+
+func TestWatcherClientReplaced(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := &fakeStream{events: []ChangeEvent{changeEvent(t, "1")}}
+	second := &fakeStream{events: []ChangeEvent{changeEvent(t, "2")}}
+	source := &fakeSource{client: &mongo.Client{}, streams: []*fakeStream{first, second}}
+
+	w := &watcher{source: source, logical: "users"}
+	events, err := w.start(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, token(t, "1"), receive(t, events).ID)
+
+	source.replaceClient()
+	assert.Equal(t, token(t, "2"), receive(t, events).ID)
+	assert.True(t, first.isClosed(), "the stream on the old client is closed")
+	assert.Equal(t, []bson.Raw{nil, token(t, "1")}, source.tokens())
+}
@@ -4,30 +4,70 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/caarlos0/env/v8"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/keloran/go-config/database/dsn"
+	"github.com/keloran/go-config/secrets"
+	"github.com/keloran/go-config/telemetry"
+	"github.com/keloran/go-config/vault"
 	vaultHelper "github.com/keloran/vault-helper"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
 )
 
-const vaultRefreshBuffer = 3600
+const (
+	vaultRefreshBuffer = 3600
+	defaultPort        = 3306
+
+	// DefaultHost and DefaultDB are used when RDS_HOSTNAME and RDS_DB aren't set,
+	// DefaultFallbackHost and DefaultFallbackDB when the details secret has no rds-hostname or rds-db
+	DefaultHost         = "mysql.chewedfeed"
+	DefaultDB           = "chewedfeed"
+	DefaultFallbackHost = "db.chewed-k8s.net"
+	DefaultFallbackDB   = "chewedfeed"
+)
 
 type VaultDetails struct {
-	CredPath    string `env:"RDS_VAULT_CRED_PATH" envDefault:"secret/data/chewedfeed/mysql"`
-	DetailsPath string `env:"RDS_VAULT_DETAIL_PATH" envDefault:"secret/data/chewedfeed/details"`
+	CredPath    string `env:"RDS_VAULT_CRED_PATH"`
+	DetailsPath string `env:"RDS_VAULT_DETAIL_PATH"`
+
+	// FallbackHost and FallbackDB are used when the details secret has no rds-hostname or rds-db
+	FallbackHost string `env:"RDS_VAULT_FALLBACK_HOSTNAME"`
+	FallbackDB   string `env:"RDS_VAULT_FALLBACK_DB"`
 
 	ExpireTime time.Time
 }
 
 type Details struct {
-	Host     string `env:"RDS_HOSTNAME" envDefault:"mysql.chewedfeed"`
-	Port     int    `env:"RDS_PORT" envDefault:"3306"`
-	User     string `env:"RDS_USERNAME"`
-	Password string `env:"RDS_PASSWORD"`
-	DBName   string `env:"RDS_DB" envDefault:"chewedfeed"`
+	Host     string         `env:"RDS_HOSTNAME"`
+	Port     int            `env:"RDS_PORT" envDefault:"3306"`
+	User     string         `env:"RDS_USERNAME"`
+	Password secrets.Secret `env:"RDS_PASSWORD"`
+	DBName   string         `env:"RDS_DB"`
+	// RawURL is a mysql:// URL or a go-sql-driver DSN, anything in it wins over the fields
+	RawURL      string `env:"MYSQL_URL"`
+	ExtraParams string
+
+	// TLS is true, false, skip-verify or preferred, SSLRootCert, SSLCert and SSLKey take either a file path or the PEM content
+	TLS         string         `env:"RDS_TLS"`
+	SSLRootCert string         `env:"RDS_SSLROOTCERT"`
+	SSLCert     string         `env:"RDS_SSLCERT"`
+	SSLKey      secrets.Secret `env:"RDS_SSLKEY"`
+
+	Charset   string `env:"RDS_CHARSET"`
+	Collation string `env:"RDS_COLLATION"`
+	ParseTime bool   `env:"RDS_PARSE_TIME"`
+
+	// ConnectionTimeout is the dial timeout, the read and write timeouts are off when zero
+	ConnectionTimeout time.Duration `env:"RDS_CONNECTION_TIMEOUT" envDefault:"10s"`
+	ReadTimeout       time.Duration `env:"RDS_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `env:"RDS_WRITE_TIMEOUT"`
 }
 
 type System struct {
@@ -37,6 +77,12 @@ type System struct {
 
 	VaultDetails
 	VaultHelper *vaultHelper.VaultHelper
+
+	// Telemetry traces every query and reports pool metrics when set
+	Telemetry *telemetry.Telemetry
+
+	// env is what Build found in env, vault rebuilds only fill in what it left unset
+	env *Details
 }
 
 func NewSystem() *System {
@@ -68,18 +114,81 @@ func (s *System) buildGeneric() (*Details, error) {
 	if err := env.Parse(rds); err != nil {
 		return rds, logs.Errorf("mysql: unable to parse env: %v", err)
 	}
+	if rds.Host == "" {
+		rds.Host = DefaultHost
+	}
+	if rds.DBName == "" {
+		rds.DBName = DefaultDB
+	}
 
 	s.Details = *rds
 
+	if rds.RawURL != "" {
+		if err := s.ParseConnectionString(rds.RawURL); err != nil {
+			return nil, err
+		}
+		*rds = s.Details
+	}
+
+	set := s.Details
+	s.env = &set
+
 	return rds, nil
 }
 
+// configured is the details before vault filled them in, so a refresh reads new credentials rather than keeping the old ones
+func (s *System) configured() Details {
+	if s.env != nil {
+		return *s.env
+	}
+
+	return s.Details
+}
+
+func (vd VaultDetails) fallbackHost() string {
+	if vd.FallbackHost != "" {
+		return vd.FallbackHost
+	}
+
+	return DefaultFallbackHost
+}
+
+func (vd VaultDetails) fallbackDB() string {
+	if vd.FallbackDB != "" {
+		return vd.FallbackDB
+	}
+
+	return DefaultFallbackDB
+}
+
 func isVaultKeyNotFound(err error) bool {
 	return err != nil && strings.Contains(err.Error(), "not found")
 }
 
+// resolvePaths fills in the vault paths Setup was given without, under the root from VAULT_PATH_PREFIX
+func (s *System) resolvePaths() error {
+	if s.VaultDetails.CredPath != "" && s.VaultDetails.DetailsPath != "" {
+		return nil
+	}
+
+	root, err := vault.BuildRoot()
+	if err != nil {
+		return logs.Errorf("mysql: unable to build vault root: %v", err)
+	}
+	s.VaultDetails.CredPath = root.Resolve(s.VaultDetails.CredPath, "mysql")
+	s.VaultDetails.DetailsPath = root.Resolve(s.VaultDetails.DetailsPath, "details")
+
+	return nil
+}
+
 func (s *System) buildVault() (*Details, error) {
-	rds := &Details{}
+	if err := s.resolvePaths(); err != nil {
+		return nil, err
+	}
+
+	// vault only holds credentials and where to connect, how to connect stays as env set it
+	set := s.configured()
+	rds := set.settings()
 	vh := *s.VaultHelper
 
 	// Get Credentials
@@ -90,24 +199,24 @@ func (s *System) buildVault() (*Details, error) {
 		return rds, logs.Error("mysql: unable to find credential secrets")
 	}
 
-	if s.Details.User == "" {
+	if set.User == "" {
 		secret, err := vh.GetSecret("username")
 		if err != nil {
 			return nil, logs.Errorf("mysql: unable to get username: %v", err)
 		}
 		rds.User = secret
 	} else {
-		rds.User = s.Details.User
+		rds.User = set.User
 	}
 
-	if s.Details.Password == "" {
+	if set.Password.IsZero() {
 		secret, err := vh.GetSecret("password")
 		if err != nil {
 			return nil, logs.Errorf("mysql: unable to get password: %v", err)
 		}
-		rds.Password = secret
+		rds.Password = secrets.New(secret)
 	} else {
-		rds.Password = s.Details.Password
+		rds.Password = set.Password
 	}
 
 	// Get Details
@@ -119,7 +228,7 @@ func (s *System) buildVault() (*Details, error) {
 	}
 
 	// get the port based on the username, since port has a default in env
-	if s.Details.User == "" && s.Details.Port == 3306 {
+	if set.User == "" && set.Port == 3306 {
 		secret, err := vh.GetSecret("rds-port")
 		if err != nil {
 			if !isVaultKeyNotFound(err) {
@@ -135,35 +244,35 @@ func (s *System) buildVault() (*Details, error) {
 			rds.Port = iport
 		}
 	} else {
-		rds.Port = s.Details.Port
+		rds.Port = set.Port
 	}
 
 	// get the db based on the username, since db has a default in env
-	if s.Details.User == "" {
+	if set.User == "" {
 		secret, err := vh.GetSecret("rds-db")
 		if err != nil {
 			if !isVaultKeyNotFound(err) {
 				return nil, logs.Errorf("mysql: unable to get database: %v", err)
 			}
-			secret = "chewedfeed"
+			secret = s.VaultDetails.fallbackDB()
 		}
 		rds.DBName = secret
 	} else {
-		rds.DBName = s.Details.DBName
+		rds.DBName = set.DBName
 	}
 
 	// get the host based on the username, since host has a default in env
-	if s.Details.User == "" {
+	if set.User == "" {
 		secret, err := vh.GetSecret("rds-hostname")
 		if err != nil {
 			if !isVaultKeyNotFound(err) {
 				return nil, logs.Errorf("mysql: unable to get hostname: %v", err)
 			}
-			secret = "db.chewed-k8s.net"
+			secret = s.VaultDetails.fallbackHost()
 		}
 		rds.Host = secret
 	} else {
-		rds.Host = s.Details.Host
+		rds.Host = set.Host
 	}
 
 	s.ExpireTime = time.Now().Add(time.Duration(vh.LeaseDuration()) * time.Second)
@@ -172,7 +281,39 @@ func (s *System) buildVault() (*Details, error) {
 	return rds, nil
 }
 
+// settings is a copy of the details with only how to connect, not who as or where to
+func (d Details) settings() *Details {
+	return &Details{
+		RawURL:            d.RawURL,
+		ExtraParams:       d.ExtraParams,
+		TLS:               d.TLS,
+		SSLRootCert:       d.SSLRootCert,
+		SSLCert:           d.SSLCert,
+		SSLKey:            d.SSLKey,
+		Charset:           d.Charset,
+		Collation:         d.Collation,
+		ParseTime:         d.ParseTime,
+		ConnectionTimeout: d.ConnectionTimeout,
+		ReadTimeout:       d.ReadTimeout,
+		WriteTimeout:      d.WriteTimeout,
+	}
+}
+
 func (s *System) GetMySQLClient(ctx context.Context) (*sql.DB, error) {
+	client, err := s.openClient(ctx, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	client.SetConnMaxLifetime(s.ExpireTime.Sub(time.Now()))
+	client.SetMaxIdleConns(10)
+	client.SetMaxOpenConns(10)
+
+	return client, nil
+}
+
+// openClient rebuilds the vault details when the lease is close to expiring and opens a client with any extra params,
+// observed clients report their pool metrics until they are closed
+func (s *System) openClient(ctx context.Context, params url.Values, observe bool) (*sql.DB, error) {
 	if s.VaultHelper != nil && time.Now().Unix() > (s.VaultDetails.ExpireTime.Unix()-vaultRefreshBuffer) {
 		_, err := s.buildVault()
 		if err != nil {
@@ -180,15 +321,233 @@ func (s *System) GetMySQLClient(ctx context.Context) (*sql.DB, error) {
 		}
 	}
 
-	client, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", s.Details.User, s.Details.Password, s.Details.Host, s.Details.Port, s.Details.DBName))
+	c, err := s.Details.dsnConfig()
 	if err != nil {
-		return nil, logs.Errorf("mysql: unable to connect: %v", err)
+		return nil, err
+	}
+	for k, v := range params {
+		c.Params[k] = v
 	}
-	client.SetConnMaxLifetime(s.ExpireTime.Sub(time.Now()))
-	client.SetMaxIdleConns(10)
-	client.SetMaxOpenConns(10)
 
-	return client, nil
+	name := ""
+	if observe {
+		name = fmt.Sprintf("%s:%d/%s", s.Details.Host, s.Details.Port, s.Details.DBName)
+	}
+
+	return open(ctx, c, s.Telemetry, name)
+}
+
+func (d Details) dsnConfig() (dsn.Config, error) {
+	addrs, err := dsn.ParseHosts(d.Host, d.Port)
+	if err != nil {
+		return dsn.Config{}, logs.Errorf("mysql: unable to parse hosts: %v", err)
+	}
+	if len(addrs) == 0 {
+		return dsn.Config{}, logs.Error("mysql: unable to connect without a host")
+	}
+
+	params, err := d.params()
+	if err != nil {
+		return dsn.Config{}, err
+	}
+
+	return dsn.Config{
+		User:      d.User,
+		Password:  d.Password,
+		Addresses: addrs,
+		DBName:    d.DBName,
+		Params:    params,
+	}, nil
+}
+
+// params are the driver params for the details on top of the extra params, the extra params win
+func (d Details) params() (url.Values, error) {
+	params, err := url.ParseQuery(d.ExtraParams)
+	if err != nil {
+		return nil, logs.Errorf("mysql: unable to parse extra params: %v", err)
+	}
+
+	tlsParam, err := d.tlsParam()
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range map[string]string{
+		"tls":          tlsParam,
+		"charset":      d.Charset,
+		"collation":    d.Collation,
+		"parseTime":    formatBool(d.ParseTime),
+		"timeout":      formatDuration(d.ConnectionTimeout),
+		"readTimeout":  formatDuration(d.ReadTimeout),
+		"writeTimeout": formatDuration(d.WriteTimeout),
+	} {
+		if value != "" && !params.Has(key) {
+			params.Set(key, value)
+		}
+	}
+
+	return params, nil
+}
+
+func formatBool(b bool) string {
+	if !b {
+		return ""
+	}
+
+	return "true"
+}
+
+func formatDuration(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+
+	return d.String()
+}
+
+// ParseConnectionString reads a mysql:// URL or a go-sql-driver DSN (user:pass@tcp(host:3306)/db?params),
+// the params this package has fields for are lifted into them and the rest kept as extra params
+func (s *System) ParseConnectionString(connStr string) error {
+	var (
+		c   dsn.Config
+		err error
+	)
+	if strings.HasPrefix(connStr, "mysql://") {
+		c, err = dsn.ParseMySQL(connStr, defaultPort)
+	} else {
+		c, err = parseDriverDSN(connStr)
+	}
+	if err != nil {
+		return logs.Errorf("mysql: unable to parse connection string: %v", err)
+	}
+	if len(c.Addresses) == 0 {
+		return logs.Error("mysql: unable to find host in connection string")
+	}
+
+	s.Details.Port = c.Addresses[0].Port
+	s.Details.Host = dsn.JoinHosts(c.Addresses, s.Details.Port)
+	s.Details.User = c.User
+	s.Details.Password = c.Password
+	if c.DBName != "" {
+		s.Details.DBName = c.DBName
+	}
+
+	for key, field := range map[string]*string{
+		"tls":       &s.Details.TLS,
+		"charset":   &s.Details.Charset,
+		"collation": &s.Details.Collation,
+	} {
+		if v := c.Params.Get(key); v != "" {
+			*field = v
+		}
+		c.Params.Del(key)
+	}
+
+	if v := c.Params.Get("parseTime"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return logs.Errorf("mysql: unable to parse parseTime: %v", err)
+		}
+		s.Details.ParseTime = b
+	}
+	c.Params.Del("parseTime")
+
+	for key, field := range map[string]*time.Duration{
+		"timeout":      &s.Details.ConnectionTimeout,
+		"readTimeout":  &s.Details.ReadTimeout,
+		"writeTimeout": &s.Details.WriteTimeout,
+	} {
+		if v := c.Params.Get(key); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return logs.Errorf("mysql: unable to parse %s: %v", key, err)
+			}
+			*field = d
+		}
+		c.Params.Del(key)
+	}
+
+	s.Details.ExtraParams = c.Params.Encode()
+
+	return nil
+}
+
+// parseDriverDSN leaves the params to url parsing, the driver keeps some of them (charset) to itself
+func parseDriverDSN(connStr string) (dsn.Config, error) {
+	cfg, err := mysqldriver.ParseDSN(connStr)
+	if err != nil {
+		return dsn.Config{}, err
+	}
+
+	c := dsn.Config{
+		User:     cfg.User,
+		Password: secrets.New(cfg.Passwd),
+		DBName:   cfg.DBName,
+		Params:   url.Values{},
+	}
+	if i := strings.LastIndex(connStr, "?"); i >= 0 && i > strings.LastIndex(connStr, "/") {
+		if c.Params, err = url.ParseQuery(connStr[i+1:]); err != nil {
+			return dsn.Config{}, err
+		}
+	}
+
+	if cfg.Net == "unix" {
+		c.Addresses = []dsn.Address{{Host: cfg.Addr, Port: defaultPort}}
+		return c, nil
+	}
+	c.Addresses, err = dsn.ParseHosts(cfg.Addr, defaultPort)
+
+	return c, err
+}
+
+// open uses the only host as is, with a failover list it hands back the first host that answers a ping
+func open(ctx context.Context, c dsn.Config, t *telemetry.Telemetry, name string) (*sql.DB, error) {
+	if len(c.Addresses) == 1 {
+		client, err := sqlOpen(c, c.Addresses[0], t, name)
+		if err != nil {
+			return nil, logs.Errorf("mysql: unable to connect: %v", err)
+		}
+		return client, nil
+	}
+
+	var lastErr error
+	for _, addr := range c.Addresses {
+		client, err := sqlOpen(c.WithAddress(addr), addr, t, name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := client.PingContext(ctx); err != nil {
+			_ = client.Close()
+			lastErr = err
+			continue
+		}
+		return client, nil
+	}
+
+	return nil, logs.Errorf("mysql: unable to connect to any host: %v", lastErr)
+}
+
+// sqlOpen wraps the driver so every query is traced when there is telemetry, and reports the pool as name when it is set
+func sqlOpen(c dsn.Config, addr dsn.Address, t *telemetry.Telemetry, name string) (*sql.DB, error) {
+	if t == nil {
+		return sql.Open("mysql", c.MySQL())
+	}
+
+	attrs := []attribute.KeyValue{semconv.DBNamespace(c.DBName), semconv.ServerAddress(addr.Host)}
+	if !addr.IsUnix() {
+		attrs = append(attrs, semconv.ServerPort(addr.Port))
+	}
+
+	conn, err := t.OpenConnector("mysql", c.MySQL(), semconv.DBSystemNameMySQL, attrs...)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return sql.OpenDB(conn), nil
+	}
+
+	return t.OpenObservedDB(conn, name, semconv.DBSystemNameMySQL)
 }
 
 func (s *System) CloseMySQLClient(ctx context.Context, conn *sql.DB) error {
@@ -0,0 +1,138 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"net/url"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/keloran/go-config/database/migrate"
+)
+
+// Migrate applies the versioned sql files in fsys while holding a named lock so only one replica of a service migrates at a time,
+// MySQL commits DDL as it runs so a failing migration can leave its earlier statements in place
+func (s *System) Migrate(ctx context.Context, fsys fs.FS, opts ...migrate.Option) (migrate.Result, error) {
+	o, err := migrate.NewOptions(opts...)
+	if err != nil {
+		return migrate.Result{}, err
+	}
+
+	// migration files hold more than one statement
+	db, err := s.openClient(ctx, url.Values{"multiStatements": {"true"}}, false)
+	if err != nil {
+		return migrate.Result{}, err
+	}
+	defer func() {
+		if err := s.CloseMySQLClient(ctx, db); err != nil {
+			logs.Infof("mysql: unable to close migration client: %v", err)
+		}
+	}()
+
+	// the named lock belongs to a session, so everything has to run on the one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return migrate.Result{}, logs.Errorf("mysql: unable to get migration connection: %v", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	return migrate.Run(ctx, &migrationStore{conn: conn, table: o.Table}, fsys, o)
+}
+
+type migrationStore struct {
+	conn  *sql.Conn
+	table string
+}
+
+func (m *migrationStore) lockName() string {
+	return "go-config:migrate:" + m.table
+}
+
+func (m *migrationStore) Lock(ctx context.Context) error {
+	var got sql.NullInt64
+	if err := m.conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, -1)", m.lockName()).Scan(&got); err != nil {
+		return logs.Errorf("mysql: unable to take migration lock: %v", err)
+	}
+	if got.Int64 != 1 {
+		return logs.Error("mysql: unable to take migration lock")
+	}
+	return nil
+}
+
+func (m *migrationStore) Unlock(ctx context.Context) error {
+	if _, err := m.conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", m.lockName()); err != nil {
+		return logs.Errorf("mysql: unable to release migration lock: %v", err)
+	}
+	return nil
+}
+
+func (m *migrationStore) Prepare(ctx context.Context) error {
+	q := fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` (version BIGINT PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)", m.table)
+	if _, err := m.conn.ExecContext(ctx, q); err != nil {
+		return logs.Errorf("mysql: unable to create migrations table: %v", err)
+	}
+	return nil
+}
+
+func (m *migrationStore) Applied(ctx context.Context) (map[int64]bool, error) {
+	var exists int
+	if err := m.conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?", m.table).Scan(&exists); err != nil {
+		return nil, logs.Errorf("mysql: unable to find migrations table: %v", err)
+	}
+	applied := make(map[int64]bool)
+	if exists == 0 {
+		return applied, nil
+	}
+
+	rows, err := m.conn.QueryContext(ctx, fmt.Sprintf("SELECT version FROM `%s`", m.table))
+	if err != nil {
+		return nil, logs.Errorf("mysql: unable to read migrations: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var v int64
+		if err := rows.Scan(&v); err != nil {
+			return nil, logs.Errorf("mysql: unable to read migrations: %v", err)
+		}
+		applied[v] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, logs.Errorf("mysql: unable to read migrations: %v", err)
+	}
+
+	return applied, nil
+}
+
+func (m *migrationStore) Apply(ctx context.Context, mig migrate.Migration, d migrate.Direction) error {
+	tx, err := m.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if d == migrate.Down {
+		if _, err := tx.ExecContext(ctx, mig.Down); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM `%s` WHERE version = ?", m.table), mig.Version); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if _, err := tx.ExecContext(ctx, mig.Up); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO `%s` (version, name) VALUES (?, ?)", m.table), mig.Version, mig.Name); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
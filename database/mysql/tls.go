@@ -0,0 +1,85 @@
+package mysql
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+const pemPrefix = "-----BEGIN"
+
+// isPEM tells PEM content apart from a file path, both are accepted for the ssl settings
+func isPEM(v string) bool {
+	return strings.Contains(v, pemPrefix)
+}
+
+func readPEM(v string) ([]byte, error) {
+	if isPEM(v) {
+		return []byte(v), nil
+	}
+
+	b, err := os.ReadFile(v)
+	if err != nil {
+		return nil, logs.Errorf("mysql: unable to read %s: %v", v, err)
+	}
+	return b, nil
+}
+
+// tlsParam is the driver's tls param, with certs to load it registers a config with the driver and names that,
+// the config verifies the server unless TLS is skip-verify, preferred isn't possible with a custom config
+func (d Details) tlsParam() (string, error) {
+	if d.SSLRootCert == "" && d.SSLCert == "" && d.SSLKey.IsZero() || d.TLS == "false" {
+		return d.TLS, nil
+	}
+	if d.SSLCert != "" && d.SSLKey.IsZero() || d.SSLCert == "" && !d.SSLKey.IsZero() {
+		return "", logs.Error("mysql: unable to use ssl cert without ssl key")
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: d.TLS == "skip-verify",
+	}
+
+	if d.SSLRootCert != "" {
+		rootPEM, err := readPEM(d.SSLRootCert)
+		if err != nil {
+			return "", err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(rootPEM) {
+			return "", logs.Error("mysql: unable to parse ssl root cert")
+		}
+	}
+
+	if d.SSLCert != "" {
+		certPEM, err := readPEM(d.SSLCert)
+		if err != nil {
+			return "", err
+		}
+		keyPEM, err := readPEM(d.SSLKey.Reveal())
+		if err != nil {
+			return "", err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return "", logs.Errorf("mysql: unable to parse ssl cert and key: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	// the same settings get the same name, so reopening re-registers rather than piling up configs
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(d.TLS + "\x00" + d.SSLRootCert + "\x00" + d.SSLCert + "\x00" + d.SSLKey.Reveal()))
+	name := fmt.Sprintf("go-config-%x", h.Sum64())
+	if err := mysqldriver.RegisterTLSConfig(name, cfg); err != nil {
+		return "", logs.Errorf("mysql: unable to register tls config: %v", err)
+	}
+
+	return name, nil
+}
@@ -2,7 +2,6 @@ package postgres
 
 import (
 	"context"
-	"fmt"
 	"net/url"
 	"strconv"
 	"strings"
@@ -12,27 +11,59 @@ import (
 	"github.com/caarlos0/env/v8"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/keloran/go-config/database/dsn"
+	"github.com/keloran/go-config/secrets"
+	"github.com/keloran/go-config/telemetry"
+	"github.com/keloran/go-config/vault"
 	vaultHelper "github.com/keloran/vault-helper"
 )
 
-const vaultRefreshBuffer = 3600
+const (
+	vaultRefreshBuffer = 3600
+	defaultPort        = 5432
+
+	// DefaultHost is used when RDS_HOSTNAME isn't set, DefaultFallbackHost when the details secret has no rds-hostname
+	DefaultHost         = "postgres.chewedfeed"
+	DefaultFallbackHost = "db.chewed-k8s.net"
+)
 
 type VaultDetails struct {
-	CredPath    string `env:"RDS_VAULT_CRED_PATH" envDefault:"secret/data/chewedfeed/postgres"`
-	DetailsPath string `env:"RDS_VAULT_DETAIL_PATH" envDefault:"secret/data/chewedfeed/details"`
+	CredPath    string `env:"RDS_VAULT_CRED_PATH"`
+	DetailsPath string `env:"RDS_VAULT_DETAIL_PATH"`
+
+	// FallbackHost is used when the details secret has no rds-hostname
+	FallbackHost string `env:"RDS_VAULT_FALLBACK_HOSTNAME"`
 
 	ExpireTime time.Time
 }
 
 type Details struct {
-	Host              string        `env:"RDS_HOSTNAME" envDefault:"postgres.chewedfeed"`
-	Port              int           `env:"RDS_PORT" envDefault:"5432"`
-	User              string        `env:"RDS_USERNAME"`
-	Password          string        `env:"RDS_PASSWORD"`
-	DBName            string        `env:"RDS_DB" envDefault:"postgres"`
-	RawURL            string        `env:"RDS_URL"`
-	ConnectionTimeout time.Duration `env:"RDS_CONNECTION_TIMEOUT" envDefault:"10s"`
+	Host              string         `env:"RDS_HOSTNAME"`
+	Port              int            `env:"RDS_PORT" envDefault:"5432"`
+	User              string         `env:"RDS_USERNAME"`
+	Password          secrets.Secret `env:"RDS_PASSWORD"`
+	DBName            string         `env:"RDS_DB" envDefault:"postgres"`
+	RawURL            string         `env:"RDS_URL"`
+	ConnectionTimeout time.Duration  `env:"RDS_CONNECTION_TIMEOUT" envDefault:"10s"`
 	ExtraParams       string
+
+	// SSLRootCert, SSLCert and SSLKey take either a file path or the PEM content itself
+	SSLMode     string         `env:"RDS_SSLMODE"`
+	SSLRootCert string         `env:"RDS_SSLROOTCERT"`
+	SSLCert     string         `env:"RDS_SSLCERT"`
+	SSLKey      secrets.Secret `env:"RDS_SSLKEY"`
+
+	// ReplicaHosts is a comma separated list of read replicas for ReadPool, sharing everything but the host with the primary
+	ReplicaHosts          string        `env:"RDS_REPLICA_HOSTNAMES"`
+	ReplicaStrategy       string        `env:"RDS_REPLICA_STRATEGY" envDefault:"round-robin"`
+	ReplicaHealthInterval time.Duration `env:"RDS_REPLICA_HEALTH_INTERVAL" envDefault:"10s"`
+
+	// ApplicationName defaults to the service name so load can be traced back to it, the timeouts are off when zero
+	ApplicationName                 string        `env:"RDS_APPLICATION_NAME"`
+	SearchPath                      string        `env:"RDS_SEARCH_PATH"`
+	StatementTimeout                time.Duration `env:"RDS_STATEMENT_TIMEOUT"`
+	LockTimeout                     time.Duration `env:"RDS_LOCK_TIMEOUT"`
+	IdleInTransactionSessionTimeout time.Duration `env:"RDS_IDLE_IN_TRANSACTION_SESSION_TIMEOUT"`
 }
 
 type System struct {
@@ -42,11 +73,19 @@ type System struct {
 
 	VaultDetails
 	VaultHelper *vaultHelper.VaultHelper
+
+	// Telemetry traces every query and reports pool metrics when set
+	Telemetry *telemetry.Telemetry
+
+	pools *pools
+	// env is what Build found in env, vault rebuilds only fill in what it left unset
+	env *Details
 }
 
 func NewSystem() *System {
 	return &System{
 		Context: context.Background(),
+		pools:   &pools{},
 	}
 }
 
@@ -56,6 +95,10 @@ func (s *System) Setup(vd VaultDetails, vh vaultHelper.VaultHelper) {
 }
 
 func (s *System) Build() (*Details, error) {
+	if s.pools == nil {
+		s.pools = &pools{}
+	}
+
 	gen, err := s.buildGeneric()
 	if err != nil {
 		return nil, err
@@ -73,6 +116,13 @@ func (s *System) buildGeneric() (*Details, error) {
 	if err := env.Parse(rds); err != nil {
 		return rds, logs.Errorf("postgres: unable to parse env: %v", err)
 	}
+	if rds.Host == "" {
+		rds.Host = DefaultHost
+	}
+
+	if rds.ReplicaStrategy != StrategyRoundRobin && rds.ReplicaStrategy != StrategyLeastConnections {
+		return nil, logs.Errorf("postgres: unable to use replica strategy: %s", rds.ReplicaStrategy)
+	}
 
 	s.Details = *rds
 
@@ -82,15 +132,62 @@ func (s *System) buildGeneric() (*Details, error) {
 		}
 	}
 
+	set := s.Details
+	s.env = &set
+
 	return rds, nil
 }
 
+// configured is the details before vault filled them in, so a refresh reads new credentials rather than keeping the old ones
+func (s *System) configured() Details {
+	if s.env != nil {
+		return *s.env
+	}
+
+	return s.Details
+}
+
+func (vd VaultDetails) fallbackHost() string {
+	if vd.FallbackHost != "" {
+		return vd.FallbackHost
+	}
+
+	return DefaultFallbackHost
+}
+
 func isVaultKeyNotFound(err error) bool {
 	return err != nil && strings.Contains(err.Error(), "not found")
 }
 
+// resolvePaths fills in the vault paths Setup was given without, under the root from VAULT_PATH_PREFIX
+func (s *System) resolvePaths() error {
+	if s.VaultDetails.CredPath != "" && s.VaultDetails.DetailsPath != "" {
+		return nil
+	}
+
+	root, err := vault.BuildRoot()
+	if err != nil {
+		return logs.Errorf("postgres: unable to build vault root: %v", err)
+	}
+	s.VaultDetails.CredPath = root.Resolve(s.VaultDetails.CredPath, "postgres")
+	s.VaultDetails.DetailsPath = root.Resolve(s.VaultDetails.DetailsPath, "details")
+
+	return nil
+}
+
 func (s *System) buildVault() (*Details, error) {
-	rds := &Details{}
+	if err := s.resolvePaths(); err != nil {
+		return nil, err
+	}
+
+	// vault only holds credentials and where to connect, how to connect stays as env set it
+	set := s.configured()
+	rds := &Details{
+		ConnectionTimeout:     set.ConnectionTimeout,
+		ExtraParams:           set.ExtraParams,
+		ReplicaStrategy:       set.ReplicaStrategy,
+		ReplicaHealthInterval: set.ReplicaHealthInterval,
+	}
 	vh := *s.VaultHelper
 
 	// Get Credentials
@@ -101,24 +198,24 @@ func (s *System) buildVault() (*Details, error) {
 		return rds, logs.Error("postgres: unable to find credential secrets")
 	}
 
-	if s.Details.User == "" {
+	if set.User == "" {
 		secret, err := vh.GetSecret("username")
 		if err != nil {
 			return nil, logs.Errorf("postgres: unable to get username: %v", err)
 		}
 		rds.User = secret
 	} else {
-		rds.User = s.Details.User
+		rds.User = set.User
 	}
 
-	if s.Details.Password == "" {
+	if set.Password.IsZero() {
 		secret, err := vh.GetSecret("password")
 		if err != nil {
 			return nil, logs.Errorf("postgres: unable to get password: %v", err)
 		}
-		rds.Password = secret
+		rds.Password = secrets.New(secret)
 	} else {
-		rds.Password = s.Details.Password
+		rds.Password = set.Password
 	}
 
 	// Get Details
@@ -130,7 +227,7 @@ func (s *System) buildVault() (*Details, error) {
 	}
 
 	// get the port based on the username, since port has a default in env
-	if s.Details.User == "" && s.Details.Port == 5432 {
+	if set.User == "" && set.Port == 5432 {
 		secret, err := vh.GetSecret("rds-port")
 		if err != nil {
 			if !isVaultKeyNotFound(err) {
@@ -146,11 +243,11 @@ func (s *System) buildVault() (*Details, error) {
 			rds.Port = iport
 		}
 	} else {
-		rds.Port = s.Details.Port
+		rds.Port = set.Port
 	}
 
 	// get the db based on the username, since db has a default in env
-	if s.Details.User == "" {
+	if set.User == "" {
 		secret, err := vh.GetSecret("rds-db")
 		if err != nil {
 			if !isVaultKeyNotFound(err) {
@@ -160,21 +257,28 @@ func (s *System) buildVault() (*Details, error) {
 		}
 		rds.DBName = secret
 	} else {
-		rds.DBName = s.Details.DBName
+		rds.DBName = set.DBName
 	}
 
 	// get the host based on the username, since host has a default in env
-	if s.Details.User == "" {
+	if set.User == "" {
 		secret, err := vh.GetSecret("rds-hostname")
 		if err != nil {
 			if !isVaultKeyNotFound(err) {
 				return nil, logs.Errorf("postgres: unable to get hostname: %v", err)
 			}
-			secret = "db.chewed-k8s.net"
+			secret = s.VaultDetails.fallbackHost()
 		}
 		rds.Host = secret
 	} else {
-		rds.Host = s.Details.Host
+		rds.Host = set.Host
+	}
+
+	if err := s.buildVaultOptional(vh, rds); err != nil {
+		return nil, err
+	}
+	if err := s.buildVaultSession(vh, rds); err != nil {
+		return nil, err
 	}
 
 	s.ExpireTime = time.Now().Add(time.Duration(vh.LeaseDuration()) * time.Second)
@@ -183,19 +287,119 @@ func (s *System) buildVault() (*Details, error) {
 	return rds, nil
 }
 
-func (s *System) GetPGXClient(ctx context.Context) (*pgx.Conn, error) {
-	if s.VaultHelper != nil && time.Now().Unix() > (s.VaultDetails.ExpireTime.Unix()-vaultRefreshBuffer) {
-		logs.Infof("vault expired, rebuilding, new expire time is %v", s.VaultDetails.ExpireTime)
+// buildVaultOptional reads the ssl and replica settings from the details secret, anything set in env wins
+func (s *System) buildVaultOptional(vh vaultHelper.VaultHelper, rds *Details) error {
+	set := s.configured()
+	rds.ReplicaHosts = set.ReplicaHosts
+	rds.SSLMode = set.SSLMode
+	rds.SSLRootCert = set.SSLRootCert
+	rds.SSLCert = set.SSLCert
+	rds.SSLKey = set.SSLKey
+
+	for key, field := range map[string]*string{
+		"rds-sslmode":     &rds.SSLMode,
+		"rds-sslrootcert": &rds.SSLRootCert,
+		"rds-sslcert":     &rds.SSLCert,
+
+		"rds-replica-hostnames": &rds.ReplicaHosts,
+	} {
+		if *field != "" {
+			continue
+		}
+		secret, err := vh.GetSecret(key)
+		if err != nil {
+			if isVaultKeyNotFound(err) {
+				continue
+			}
+			return logs.Errorf("postgres: unable to get %s: %v", key, err)
+		}
+		*field = secret
+	}
 
-		if _, err := s.buildVault(); err != nil {
-			return nil, logs.Errorf("postgres: unable to rebuild vault config: %v", err)
+	if rds.SSLKey.IsZero() {
+		secret, err := vh.GetSecret("rds-sslkey")
+		if err != nil && !isVaultKeyNotFound(err) {
+			return logs.Errorf("postgres: unable to get rds-sslkey: %v", err)
 		}
+		rds.SSLKey = secrets.New(secret)
+	}
+
+	return nil
+}
+
+// ConnectionString is the details as a postgres URL with every part escaped, Host can be a comma separated
+// failover list of hosts, IPv6 addresses and unix socket directories, ParseConnectionString reads it back
+func (d Details) ConnectionString() (string, error) {
+	params, err := url.ParseQuery(d.ExtraParams)
+	if err != nil {
+		return "", logs.Errorf("postgres: unable to parse extra params: %v", err)
 	}
+	d.sslParams(params)
 
-	timeoutContext, cancel := context.WithTimeout(ctx, s.Details.ConnectionTimeout)
+	addrs, err := dsn.ParseHosts(d.Host, d.Port)
+	if err != nil {
+		return "", logs.Errorf("postgres: unable to parse hosts: %v", err)
+	}
+
+	return dsn.Config{
+		User:      d.User,
+		Password:  d.Password,
+		Addresses: addrs,
+		DBName:    d.DBName,
+		Params:    params,
+	}.Postgres(), nil
+}
+
+// refreshVault rebuilds the details once the vault lease is close to expiring, and reports whether it did,
+// callers go through refreshPools so the rebuild holds the lock every reader of the details takes
+func (s *System) refreshVault() (bool, error) {
+	if s.VaultHelper == nil || time.Now().Unix() <= (s.VaultDetails.ExpireTime.Unix()-vaultRefreshBuffer) {
+		return false, nil
+	}
+
+	logs.Infof("vault expired, rebuilding, new expire time is %v", s.VaultDetails.ExpireTime)
+	if _, err := s.buildVault(); err != nil {
+		return false, logs.Errorf("postgres: unable to rebuild vault config: %v", err)
+	}
+
+	return true, nil
+}
+
+// connConfig is the parsed connection string with the session settings and TLS applied
+func (d Details) connConfig() (*pgx.ConnConfig, error) {
+	connStr, err := d.ConnectionString()
+	if err != nil {
+		return nil, err
+	}
+	config, err := pgx.ParseConfig(connStr)
+	if err != nil {
+		return nil, logs.Errorf("postgres: unable to parse config: %v", err)
+	}
+	if err := d.applyConfig(&config.Config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (s *System) GetPGXClient(ctx context.Context) (*pgx.Conn, error) {
+	d, _, err := s.refreshPools()
+	if err != nil {
+		return nil, err
+	}
+
+	timeoutContext, cancel := context.WithTimeout(ctx, d.ConnectionTimeout)
 	defer cancel()
 
-	client, err := pgx.Connect(timeoutContext, fmt.Sprintf("postgres://%s:%s@%s:%d/%s?%s", s.Details.User, s.Details.Password, s.Details.Host, s.Details.Port, s.Details.DBName, s.Details.ExtraParams))
+	config, err := d.connConfig()
+	if err != nil {
+		return nil, err
+	}
+	if s.Telemetry != nil {
+		config.Tracer = s.Telemetry.PgxTracer()
+	}
+
+	client, err := pgx.ConnectConfig(timeoutContext, config)
 	if err != nil {
 		if strings.Contains(err.Error(), "operation was canceled") {
 			return nil, err
@@ -207,26 +411,49 @@ func (s *System) GetPGXClient(ctx context.Context) (*pgx.Conn, error) {
 }
 
 func (s *System) GetPGXPoolClient(ctx context.Context) (*pgxpool.Pool, error) {
-	if s.VaultHelper != nil && time.Now().Unix() > (s.VaultDetails.ExpireTime.Unix()-vaultRefreshBuffer) {
-		logs.Infof("vault expired, rebuilding, new expire time is %v", s.VaultDetails.ExpireTime)
+	d, _, err := s.refreshPools()
+	if err != nil {
+		return nil, err
+	}
 
-		if _, err := s.buildVault(); err != nil {
-			return nil, logs.Errorf("postgres: unable to rebuild vault config: %v", err)
+	pool, err := newPool(ctx, d, s.Telemetry)
+	if err != nil {
+		return nil, err
+	}
+	if s.Telemetry != nil {
+		// the caller owns the pool, the registration lets go of it once it is dropped
+		if _, err := s.Telemetry.ObservePgxPool(pool); err != nil {
+			pool.Close()
+			return nil, err
 		}
 	}
 
-	timeoutContext, cancel := context.WithTimeout(ctx, s.Details.ConnectionTimeout)
+	return pool, nil
+}
+
+func newPool(ctx context.Context, d Details, t *telemetry.Telemetry) (*pgxpool.Pool, error) {
+	timeoutContext, cancel := context.WithTimeout(ctx, d.ConnectionTimeout)
 	defer cancel()
 
-	config, err := pgxpool.ParseConfig(fmt.Sprintf("postgres://%s:%s@%s:%d/%s?%s", s.Details.User, s.Details.Password, s.Details.Host, s.Details.Port, s.Details.DBName, s.Details.ExtraParams))
+	connStr, err := d.ConnectionString()
+	if err != nil {
+		return nil, err
+	}
+	config, err := pgxpool.ParseConfig(connStr)
 	if err != nil {
 		if strings.Contains(err.Error(), "operation was canceled") {
 			return nil, err
 		}
 		return nil, logs.Errorf("postgres: unable to parse pool config: %v", err)
 	}
+	if err := d.applyConfig(&config.ConnConfig.Config); err != nil {
+		return nil, err
+	}
 	config.MaxConns = 10
-	config.MaxConnIdleTime = s.Details.ConnectionTimeout
+	config.MaxConnIdleTime = d.ConnectionTimeout
+	if t != nil {
+		config.ConnConfig.Tracer = t.PgxTracer()
+	}
 
 	client, err := pgxpool.NewWithConfig(timeoutContext, config)
 	if err != nil {
@@ -247,35 +474,38 @@ func (s *System) ClosePGX(ctx context.Context, conn *pgx.Conn) error {
 }
 
 func (s *System) ParseConnectionString(connStr string) error {
-	str, err := url.Parse(connStr)
+	c, err := dsn.ParsePostgres(connStr, defaultPort)
 	if err != nil {
 		return logs.Errorf("postgres: unable to parse connection string: %v", err)
 	}
-	if str.Scheme != "postgres" && str.Scheme != "postgresql" {
-		return logs.Errorf("postgres: unable to use connection string scheme: %s", str.Scheme)
+	if len(c.Addresses) == 0 {
+		return logs.Error("postgres: unable to find host in connection string")
 	}
 
-	s.Details.Host = str.Hostname()
-	if port, err := strconv.Atoi(str.Port()); err == nil {
-		s.Details.Port = port
-	} else {
-		return logs.Errorf("postgres: unable to parse connection string port: %s", str.Port())
+	s.Details.Port = c.Addresses[0].Port
+	s.Details.Host = dsn.JoinHosts(c.Addresses, s.Details.Port)
+	s.Details.User = c.User
+	s.Details.Password = c.Password
+	if c.DBName != "" {
+		s.Details.DBName = c.DBName
 	}
 
-	s.Details.User = str.User.Username()
-	if pword, ok := str.User.Password(); ok {
-		s.Details.Password = pword
-	} else {
-		return logs.Error("postgres: unable to find password in connection string")
+	for key, field := range map[string]*string{
+		"sslmode":     &s.Details.SSLMode,
+		"sslrootcert": &s.Details.SSLRootCert,
+		"sslcert":     &s.Details.SSLCert,
+	} {
+		if v := c.Params.Get(key); v != "" {
+			*field = v
+		}
+		c.Params.Del(key)
 	}
-
-	if parts := strings.Split(str.Path, "/"); len(parts) > 1 {
-		s.Details.DBName = parts[1]
+	if v := c.Params.Get("sslkey"); v != "" {
+		s.Details.SSLKey = secrets.New(v)
 	}
+	c.Params.Del("sslkey")
 
-	if len(str.Query()) > 0 {
-		s.Details.ExtraParams = str.RawQuery
-	}
+	s.Details.ExtraParams = c.Params.Encode()
 
 	return nil
 }
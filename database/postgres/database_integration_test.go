@@ -6,8 +6,10 @@ package postgres
 import (
 	"context"
 	"testing"
+	"testing/fstest"
 	"time"
 
+	"github.com/keloran/go-config/database/migrate"
 	"github.com/stretchr/testify/assert"
 	tpg "github.com/testcontainers/testcontainers-go/modules/postgres"
 )
@@ -118,3 +120,202 @@ func TestPostgresConnection(t *testing.T) {
 	}()
 	assert.NotNil(t, conn)
 }
+
+func TestPostgresMigrate(t *testing.T) {
+	ctx := context.Background()
+
+	pg, err := setupPostgres(ctx)
+	assert.NoError(t, err)
+	defer func() {
+		if pg != nil {
+			if err := pg.Terminate(ctx); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	connectionString, err := pg.ConnectionString(ctx, "sslmode=disable")
+	assert.NoError(t, err)
+
+	sys := NewSystem()
+	if err := sys.ParseConnectionString(connectionString); err != nil {
+		t.Fatal(err)
+	}
+	sys.Details.ConnectionTimeout = 30 * time.Second
+	assert.NoError(t, waitForPostgresConnection(ctx, sys, 30*time.Second))
+
+	files := fstest.MapFS{
+		"0001_users.up.sql":   {Data: []byte("CREATE TABLE users (id INT); INSERT INTO users VALUES (1);")},
+		"0001_users.down.sql": {Data: []byte("DROP TABLE users;")},
+	}
+
+	res, err := sys.Migrate(ctx, files, migrate.WithDryRun())
+	assert.NoError(t, err)
+	assert.Len(t, res.Migrations, 1)
+
+	res, err = sys.Migrate(ctx, files)
+	assert.NoError(t, err)
+	assert.Len(t, res.Migrations, 1)
+
+	res, err = sys.Migrate(ctx, files)
+	assert.NoError(t, err)
+	assert.Empty(t, res.Migrations)
+
+	res, err = sys.Migrate(ctx, files, migrate.WithDown(1))
+	assert.NoError(t, err)
+	assert.Len(t, res.Migrations, 1)
+}
+
+func TestPostgresListen(t *testing.T) {
+	ctx := context.Background()
+
+	pg, err := setupPostgres(ctx)
+	assert.NoError(t, err)
+	defer func() {
+		if pg != nil {
+			if err := pg.Terminate(ctx); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	connectionString, err := pg.ConnectionString(ctx, "sslmode=disable")
+	assert.NoError(t, err)
+
+	sys := NewSystem()
+	if err := sys.ParseConnectionString(connectionString); err != nil {
+		t.Fatal(err)
+	}
+	sys.Details.ConnectionTimeout = 30 * time.Second
+	assert.NoError(t, waitForPostgresConnection(ctx, sys, 30*time.Second))
+	defer sys.ClosePools()
+
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	notifications, err := sys.Listen(listenCtx, "orders", "Mixed Case")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func() string {
+		select {
+		case n := <-notifications:
+			return n.Channel + ":" + n.Payload
+		case <-time.After(10 * time.Second):
+			return ""
+		}
+	}
+
+	assert.NoError(t, sys.Notify(ctx, "orders", "1"))
+	assert.Equal(t, "orders:1", receive())
+	assert.NoError(t, sys.Notify(ctx, "Mixed Case", "2"))
+	assert.Equal(t, "Mixed Case:2", receive())
+
+	// drop the listener's connection, it should come back and listen again
+	pool, err := sys.WritePool(ctx)
+	assert.NoError(t, err)
+	_, err = pool.Exec(ctx, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE query LIKE 'LISTEN%'")
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		if err := sys.Notify(ctx, "orders", "3"); err != nil {
+			return false
+		}
+		select {
+		case n := <-notifications:
+			return n.Payload == "3"
+		case <-time.After(500 * time.Millisecond):
+			return false
+		}
+	}, 20*time.Second, 100*time.Millisecond)
+
+	cancel()
+	closed := time.After(5 * time.Second)
+	for {
+		select {
+		case _, open := <-notifications:
+			if !open {
+				return
+			}
+		case <-closed:
+			t.Fatal("notifications weren't closed")
+		}
+	}
+}
+
+func TestPostgresElect(t *testing.T) {
+	ctx := context.Background()
+
+	pg, err := setupPostgres(ctx)
+	assert.NoError(t, err)
+	defer func() {
+		if pg != nil {
+			if err := pg.Terminate(ctx); err != nil {
+				t.Logf("failed to terminate container: %v", err)
+			}
+		}
+	}()
+
+	connectionString, err := pg.ConnectionString(ctx, "sslmode=disable")
+	assert.NoError(t, err)
+
+	candidate := func() *System {
+		sys := NewSystem()
+		if err := sys.ParseConnectionString(connectionString); err != nil {
+			t.Fatal(err)
+		}
+		sys.Details.ConnectionTimeout = 30 * time.Second
+		t.Cleanup(sys.ClosePools)
+		return sys
+	}
+	first, second := candidate(), candidate()
+	assert.NoError(t, waitForPostgresConnection(ctx, first, 30*time.Second))
+
+	receive := func(ch <-chan bool, timeout time.Duration) (bool, bool) {
+		select {
+		case leader, open := <-ch:
+			return leader, open
+		case <-time.After(timeout):
+			t.Fatal("no leadership change")
+			return false, false
+		}
+	}
+
+	firstCtx, cancelFirst := context.WithCancel(ctx)
+	defer cancelFirst()
+	firstLeader, err := first.Elect(firstCtx, "cron")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader, _ := receive(firstLeader, 10*time.Second)
+	assert.True(t, leader)
+
+	secondCtx, cancelSecond := context.WithCancel(ctx)
+	defer cancelSecond()
+	secondLeader, err := second.Elect(secondCtx, "cron")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-secondLeader:
+		t.Fatal("two leaders")
+	case <-time.After(2 * electionInterval):
+	}
+
+	// the first steps down, the second takes over
+	cancelFirst()
+	_, open := receive(firstLeader, 5*time.Second)
+	assert.False(t, open)
+	leader, _ = receive(secondLeader, 3*electionInterval)
+	assert.True(t, leader)
+
+	// dropping the leader's connection loses the lock, it reconnects and wins it back as the only candidate
+	pool, err := first.WritePool(ctx)
+	assert.NoError(t, err)
+	_, err = pool.Exec(ctx, "SELECT pg_terminate_backend(pid) FROM pg_locks WHERE locktype = 'advisory'")
+	assert.NoError(t, err)
+	leader, _ = receive(secondLeader, 3*electionInterval)
+	assert.False(t, leader)
+	leader, _ = receive(secondLeader, 60*time.Second)
+	assert.True(t, leader)
+}
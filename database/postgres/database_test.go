@@ -2,10 +2,12 @@ package postgres
 
 import (
 	"errors"
+	"github.com/keloran/go-config/secrets"
 	vaultHelper "github.com/keloran/vault-helper"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestBuildVault(t *testing.T) {
@@ -29,7 +31,7 @@ func TestBuildVault(t *testing.T) {
 	db, err := d.Build()
 	assert.NoError(t, err)
 
-	assert.Equal(t, "testPassword", db.Password)
+	assert.Equal(t, "testPassword", db.Password.Reveal())
 	assert.Equal(t, "testUser", db.User)
 	assert.Equal(t, 1111, db.Port)
 	assert.Equal(t, "testDB", db.DBName)
@@ -55,13 +57,49 @@ func TestBuildVaultNoPort(t *testing.T) {
 	db, err := d.Build()
 	assert.NoError(t, err)
 
-	assert.Equal(t, "testPassword", db.Password)
+	assert.Equal(t, "testPassword", db.Password.Reveal())
 	assert.Equal(t, "testUser", db.User)
 	assert.Equal(t, 5432, db.Port)
 	assert.Equal(t, "testDB", db.DBName)
 	assert.Equal(t, "testHost", db.Host)
 }
 
+func TestRefreshVaultReadsNewSecrets(t *testing.T) {
+	os.Clearenv()
+	mockVault := &vaultHelper.MockVaultHelper{
+		KVSecrets: []vaultHelper.KVSecret{
+			{Key: "password", Value: "testPassword"},
+			{Key: "username", Value: "testUser"},
+			{Key: "rds-port", Value: "1111"},
+			{Key: "rds-db", Value: "testDB"},
+			{Key: "rds-hostname", Value: "testHost"},
+		},
+	}
+
+	d := NewSystem()
+	d.Setup(VaultDetails{CredPath: "tester", DetailsPath: "tester"}, mockVault)
+	_, err := d.Build()
+	assert.NoError(t, err)
+	assert.Equal(t, 1111, d.Details.Port)
+
+	mockVault.KVSecrets = []vaultHelper.KVSecret{
+		{Key: "password", Value: "newPassword"},
+		{Key: "username", Value: "newUser"},
+		{Key: "rds-port", Value: "1111"},
+		{Key: "rds-db", Value: "testDB"},
+		{Key: "rds-hostname", Value: "testHost"},
+	}
+	d.ExpireTime = time.Now()
+	rebuilt, err := d.refreshVault()
+	assert.NoError(t, err)
+	assert.True(t, rebuilt)
+
+	assert.Equal(t, "newUser", d.Details.User)
+	assert.Equal(t, "newPassword", d.Details.Password.Reveal())
+	assert.Equal(t, 1111, d.Details.Port, "the port from vault is kept, not reset to the env default")
+	assert.Equal(t, "testHost", d.Details.Host)
+}
+
 func TestBuildGeneric(t *testing.T) {
 	os.Clearenv()
 
@@ -84,7 +122,7 @@ func TestBuildGeneric(t *testing.T) {
 	d := NewSystem()
 	db, err := d.Build()
 	assert.NoError(t, err)
-	assert.Equal(t, "testPassword", db.Password)
+	assert.Equal(t, "testPassword", db.Password.Reveal())
 	assert.Equal(t, "testUser", db.User)
 	assert.Equal(t, 1111, db.Port)
 	assert.Equal(t, "testDB", db.DBName)
@@ -128,3 +166,50 @@ func TestBuildVaultUnexpectedSecretError(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "postgres: unable to get database")
 }
+
+func TestBuildVaultFallbackHost(t *testing.T) {
+	os.Clearenv()
+	mockVault := &vaultHelper.MockVaultHelper{
+		KVSecrets: []vaultHelper.KVSecret{
+			{Key: "password", Value: "testPassword"},
+			{Key: "username", Value: "testUser"},
+		},
+	}
+
+	d := NewSystem()
+	d.Setup(VaultDetails{CredPath: "tester", DetailsPath: "tester"}, mockVault)
+	db, err := d.Build()
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultFallbackHost, db.Host)
+
+	d = NewSystem()
+	d.Setup(VaultDetails{CredPath: "tester", DetailsPath: "tester", FallbackHost: "db.example.com"}, mockVault)
+	db, err = d.Build()
+	assert.NoError(t, err)
+	assert.Equal(t, "db.example.com", db.Host)
+}
+
+func TestConnectionStringRoundTrip(t *testing.T) {
+	d := Details{
+		Host:        "db1,db2:5433,[::1]",
+		Port:        5432,
+		User:        "app@team",
+		Password:    secrets.New("p@ss/w?rd#"),
+		DBName:      "orders",
+		ExtraParams: "connect_timeout=5",
+		SSLMode:     "verify-full",
+	}
+
+	connStr, err := d.ConnectionString()
+	assert.NoError(t, err)
+
+	s := NewSystem()
+	assert.NoError(t, s.ParseConnectionString(connStr))
+	assert.Equal(t, d.Host, s.Host)
+	assert.Equal(t, d.Port, s.Port)
+	assert.Equal(t, d.User, s.User)
+	assert.Equal(t, d.Password.Reveal(), s.Password.Reveal())
+	assert.Equal(t, d.DBName, s.DBName)
+	assert.Equal(t, d.ExtraParams, s.ExtraParams)
+	assert.Equal(t, d.SSLMode, s.SSLMode)
+}
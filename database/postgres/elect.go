@@ -0,0 +1,116 @@
+package postgres
+
+import (
+	"context"
+	"hash/fnv"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+)
+
+// electionInterval is how often a follower tries for the lock and a leader checks its connection is still there
+const electionInterval = 5 * time.Second
+
+// Elect campaigns for leadership of lockKey with a session-level advisory lock held on a connection of its own,
+// true on the returned channel means this process is now the leader and false that it has lost it.
+// When the connection drops the lock goes with it, so it reports false, reconnects and campaigns again,
+// a leader finds out within the election interval and should stop its work as soon as it sees false.
+// Leadership is released and the channel closed once ctx ends
+func (s *System) Elect(ctx context.Context, lockKey string) (<-chan bool, error) {
+	if lockKey == "" {
+		return nil, logs.Error("postgres: unable to elect without a lock key")
+	}
+
+	conn, err := s.dedicatedConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &election{
+		dial:     s.dedicatedConn,
+		name:     lockKey,
+		key:      electionKey(lockKey),
+		interval: electionInterval,
+		out:      make(chan bool, 1),
+	}
+	go e.run(ctx, conn)
+
+	return e.out, nil
+}
+
+// electionKey keeps election locks apart from the migration locks and anything else using advisory locks
+func electionKey(lockKey string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("go-config:elect:" + lockKey))
+
+	return int64(h.Sum64())
+}
+
+type election struct {
+	dial     func(context.Context) (sessionConn, error)
+	name     string
+	key      int64
+	interval time.Duration
+	out      chan bool
+	leader   bool
+}
+
+func (e *election) run(ctx context.Context, conn sessionConn) {
+	defer close(e.out)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.check(ctx, conn); err != nil && ctx.Err() == nil {
+			logs.Infof("postgres: election connection for %s lost, reconnecting: %v", e.name, err)
+			e.set(ctx, false)
+			closeConn(ctx, conn)
+
+			if conn = reconnect(ctx, e.dial); conn == nil {
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			// the lock is session-level, closing the connection releases it
+			closeConn(ctx, conn)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check tries for the lock as a follower, as the leader it makes sure the connection holding the lock is still alive
+func (e *election) check(ctx context.Context, conn sessionConn) error {
+	checkCtx, cancel := context.WithTimeout(ctx, e.interval)
+	defer cancel()
+
+	if e.leader {
+		return conn.Ping(checkCtx)
+	}
+
+	var won bool
+	if err := conn.QueryRow(checkCtx, "SELECT pg_try_advisory_lock($1)", e.key).Scan(&won); err != nil {
+		return err
+	}
+	if won {
+		e.set(ctx, true)
+	}
+
+	return nil
+}
+
+func (e *election) set(ctx context.Context, leader bool) {
+	if e.leader == leader {
+		return
+	}
+	e.leader = leader
+
+	select {
+	case e.out <- leader:
+	case <-ctx.Done():
+	}
+}
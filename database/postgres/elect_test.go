@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElectionKey(t *testing.T) {
+	assert.Equal(t, electionKey("cron"), electionKey("cron"))
+	assert.NotEqual(t, electionKey("cron"), electionKey("billing"))
+	assert.NotEqual(t, electionKey("schema_migrations"), newMigrationStore(nil, "schema_migrations").key)
+}
+
+func TestElectUnreachable(t *testing.T) {
+	s := replicaSystem(t, StrategyRoundRobin)
+
+	_, err := s.Elect(context.Background(), "cron")
+	assert.Error(t, err)
+	_, err = s.Elect(context.Background(), "")
+	assert.Error(t, err)
+}
+
+func TestElectLosesLockWhenConnectionDrops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &fakeDialer{won: true}
+	e := &election{
+		dial:     d.dial,
+		name:     "cron",
+		key:      electionKey("cron"),
+		interval: 10 * time.Millisecond,
+		out:      make(chan bool, 1),
+	}
+
+	conn, err := e.dial(ctx)
+	require.NoError(t, err)
+	go e.run(ctx, conn)
+
+	next := func() bool {
+		t.Helper()
+		select {
+		case leader, ok := <-e.out:
+			require.True(t, ok, "the channel stays open until ctx ends")
+			return leader
+		case <-time.After(5 * time.Second):
+			t.Fatal("no election result")
+			return false
+		}
+	}
+	assert.True(t, next(), "the lock is won on the first connection")
+
+	first := d.conn(t, 0)
+	first.drop()
+	assert.False(t, next(), "losing the connection loses the lock")
+	assert.Eventually(t, first.isClosed, time.Second, 10*time.Millisecond)
+
+	second := d.conn(t, 1)
+	assert.True(t, next(), "it campaigns again on the new connection")
+
+	cancel()
+	_, ok := <-e.out
+	assert.False(t, ok, "the channel is closed once ctx ends")
+	assert.True(t, second.isClosed(), "closing the connection releases the lock")
+}
+
+func TestElectStopsReconnectingWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dials := 0
+	e := &election{
+		dial: func(context.Context) (sessionConn, error) {
+			dials++
+			cancel()
+			return nil, errors.New("refused")
+		},
+		name:     "cron",
+		key:      electionKey("cron"),
+		interval: 10 * time.Millisecond,
+		out:      make(chan bool, 1),
+	}
+
+	first := newFakeConn(true)
+	go e.run(ctx, first)
+	assert.True(t, <-e.out)
+
+	first.drop()
+	assert.False(t, <-e.out)
+	_, ok := <-e.out
+	assert.False(t, ok, "a reconnect cut short by ctx closes the channel")
+	assert.Equal(t, 1, dials)
+	assert.True(t, first.isClosed())
+}
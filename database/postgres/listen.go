@@ -0,0 +1,168 @@
+package postgres
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	reconnectInitialBackoff = 200 * time.Millisecond
+	reconnectMaxBackoff     = 30 * time.Second
+
+	// notificationBuffer lets a burst of notifications queue up while the receiver is busy
+	notificationBuffer = 64
+)
+
+// Listen subscribes to the channels on a connection of its own and keeps it subscribed until ctx ends, when the
+// connection drops it reconnects with backoff, picking up new vault credentials, and issues LISTEN again.
+// Anything notified while it is reconnecting is lost, so a cache should treat a gap as a reason to reload.
+// The returned channel is closed once ctx ends
+func (s *System) Listen(ctx context.Context, channels ...string) (<-chan *pgconn.Notification, error) {
+	if len(channels) == 0 {
+		return nil, logs.Error("postgres: unable to listen without a channel")
+	}
+
+	l := &listener{dial: s.dedicatedConn, channels: channels}
+	conn, err := l.listen(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *pgconn.Notification, notificationBuffer)
+	go l.receive(ctx, conn, out)
+
+	return out, nil
+}
+
+// sessionConn is the part of a dedicated connection Listen and Elect use, so a dropped connection can be faked
+type sessionConn interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Ping(ctx context.Context) error
+	WaitForNotification(ctx context.Context) (*pgconn.Notification, error)
+	Close(ctx context.Context) error
+}
+
+// listener keeps the channels subscribed on whatever connection dial hands it
+type listener struct {
+	dial     func(context.Context) (sessionConn, error)
+	channels []string
+}
+
+func (l *listener) listen(ctx context.Context) (sessionConn, error) {
+	conn, err := l.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, channel := range l.channels {
+		if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			closeConn(ctx, conn)
+			return nil, logs.Errorf("postgres: unable to listen on %s: %v", channel, err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (l *listener) receive(ctx context.Context, conn sessionConn, out chan<- *pgconn.Notification) {
+	defer close(out)
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err == nil {
+			select {
+			case out <- n:
+				continue
+			case <-ctx.Done():
+			}
+		}
+
+		closeConn(ctx, conn)
+		if ctx.Err() != nil {
+			return
+		}
+
+		logs.Infof("postgres: listener connection lost, reconnecting: %v", err)
+		if conn = reconnect(ctx, l.listen); conn == nil {
+			return
+		}
+	}
+}
+
+// Notify sends payload to everyone listening on channel
+func (s *System) Notify(ctx context.Context, channel, payload string) error {
+	pool, err := s.WritePool(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := pool.Exec(ctx, "SELECT pg_notify($1, $2)", channel, payload); err != nil {
+		return logs.Errorf("postgres: unable to notify %s: %v", channel, err)
+	}
+
+	return nil
+}
+
+// dedicatedConn takes a connection out of the write pool for good so its session (LISTEN, advisory locks) is its own,
+// going through the pool means it connects with the current vault credentials, the caller closes it
+func (s *System) dedicatedConn(ctx context.Context) (sessionConn, error) {
+	pool, err := s.WritePool(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := pool.Acquire(ctx)
+	if err != nil {
+		return nil, logs.Errorf("postgres: unable to acquire connection: %v", err)
+	}
+
+	return c.Hijack(), nil
+}
+
+// reconnect keeps calling connect with backoff until it succeeds, it gives up with nil once ctx ends
+func reconnect(ctx context.Context, connect func(context.Context) (sessionConn, error)) sessionConn {
+	for attempt := 1; ; attempt++ {
+		timer := time.NewTimer(reconnectBackoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		conn, err := connect(ctx)
+		if err == nil {
+			return conn
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		logs.Infof("postgres: unable to reconnect, attempt %d: %v", attempt, err)
+	}
+}
+
+// reconnectBackoff doubles from the initial backoff up to the max, spread by up to a fifth either way
+func reconnectBackoff(attempt int) time.Duration {
+	wait := reconnectInitialBackoff
+	for i := 1; i < attempt && wait < reconnectMaxBackoff; i++ {
+		wait *= 2
+	}
+	wait = min(wait, reconnectMaxBackoff)
+	spread := (rand.Float64()*2 - 1) * 0.2
+
+	return time.Duration(float64(wait) * (1 + spread))
+}
+
+// closeConn closes a connection that may already be broken, with a context that isn't done so the close is sent
+func closeConn(ctx context.Context, conn sessionConn) {
+	closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+	defer cancel()
+
+	_ = conn.Close(closeCtx)
+}
@@ -0,0 +1,216 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConn is a dedicated session that hands over queued notifications until it is dropped
+type fakeConn struct {
+	notes   chan *pgconn.Notification
+	dropped chan struct{}
+	// won is what pg_try_advisory_lock answers
+	won bool
+
+	mu     sync.Mutex
+	execs  []string
+	closed bool
+}
+
+func newFakeConn(won bool) *fakeConn {
+	return &fakeConn{
+		notes:   make(chan *pgconn.Notification, 1),
+		dropped: make(chan struct{}),
+		won:     won,
+	}
+}
+
+func (c *fakeConn) drop() {
+	close(c.dropped)
+}
+
+func (c *fakeConn) lost() error {
+	select {
+	case <-c.dropped:
+		return errors.New("conn closed")
+	default:
+		return nil
+	}
+}
+
+func (c *fakeConn) Exec(_ context.Context, sql string, _ ...any) (pgconn.CommandTag, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.execs = append(c.execs, sql)
+
+	return pgconn.CommandTag{}, c.lost()
+}
+
+func (c *fakeConn) QueryRow(context.Context, string, ...any) pgx.Row {
+	return fakeRow{won: c.won, err: c.lost()}
+}
+
+func (c *fakeConn) Ping(context.Context) error {
+	return c.lost()
+}
+
+func (c *fakeConn) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	select {
+	case n := <-c.notes:
+		return n, nil
+	case <-c.dropped:
+		return nil, errors.New("conn closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *fakeConn) Close(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+
+	return nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+func (c *fakeConn) listened() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]string(nil), c.execs...)
+}
+
+type fakeRow struct {
+	won bool
+	err error
+}
+
+func (r fakeRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	*dest[0].(*bool) = r.won
+
+	return nil
+}
+
+// fakeDialer hands out a new fake session on every dial and keeps them in order
+type fakeDialer struct {
+	won bool
+
+	mu    sync.Mutex
+	conns []*fakeConn
+}
+
+func (d *fakeDialer) dial(context.Context) (sessionConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := newFakeConn(d.won)
+	d.conns = append(d.conns, c)
+
+	return c, nil
+}
+
+// conn waits for the nth dial
+func (d *fakeDialer) conn(t *testing.T, n int) *fakeConn {
+	t.Helper()
+
+	var c *fakeConn
+	require.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if len(d.conns) <= n {
+			return false
+		}
+		c = d.conns[n]
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return c
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	for attempt, base := range map[int]time.Duration{
+		1:   reconnectInitialBackoff,
+		2:   2 * reconnectInitialBackoff,
+		4:   8 * reconnectInitialBackoff,
+		20:  reconnectMaxBackoff,
+		100: reconnectMaxBackoff,
+	} {
+		wait := reconnectBackoff(attempt)
+		assert.GreaterOrEqual(t, wait, time.Duration(float64(base)*0.8), "attempt %d", attempt)
+		assert.LessOrEqual(t, wait, time.Duration(float64(base)*1.2), "attempt %d", attempt)
+	}
+}
+
+func TestReconnectStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	conn := reconnect(ctx, func(context.Context) (sessionConn, error) {
+		attempts++
+		cancel()
+		return nil, errors.New("refused")
+	})
+	assert.Nil(t, conn)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestListenWithoutChannels(t *testing.T) {
+	s := replicaSystem(t, StrategyRoundRobin)
+
+	_, err := s.Listen(context.Background())
+	assert.Error(t, err)
+}
+
+func TestListenUnreachable(t *testing.T) {
+	s := replicaSystem(t, StrategyRoundRobin)
+
+	_, err := s.Listen(context.Background(), "orders")
+	assert.Error(t, err)
+}
+
+func TestListenRelistensAfterDrop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &fakeDialer{}
+	l := &listener{dial: d.dial, channels: []string{"orders", "users"}}
+
+	conn, err := l.listen(ctx)
+	require.NoError(t, err)
+	out := make(chan *pgconn.Notification, notificationBuffer)
+	go l.receive(ctx, conn, out)
+
+	first := d.conn(t, 0)
+	assert.Equal(t, []string{`LISTEN "orders"`, `LISTEN "users"`}, first.listened())
+	first.notes <- &pgconn.Notification{Channel: "orders", Payload: "1"}
+	assert.Equal(t, "1", (<-out).Payload)
+
+	first.drop()
+	second := d.conn(t, 1)
+	assert.Eventually(t, first.isClosed, time.Second, 10*time.Millisecond, "the dropped connection is closed")
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{`LISTEN "orders"`, `LISTEN "users"`}, second.listened())
+	}, time.Second, 10*time.Millisecond, "every channel is listened on again")
+	second.notes <- &pgconn.Notification{Channel: "users", Payload: "2"}
+	assert.Equal(t, "2", (<-out).Payload)
+
+	cancel()
+	for range out {
+	}
+	assert.True(t, second.isClosed())
+}
@@ -0,0 +1,121 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	"github.com/keloran/go-config/database/migrate"
+)
+
+// Migrate applies the versioned sql files in fsys, each in its own transaction, while holding an advisory lock
+// so only one replica of a service migrates at a time
+func (s *System) Migrate(ctx context.Context, fsys fs.FS, opts ...migrate.Option) (migrate.Result, error) {
+	o, err := migrate.NewOptions(opts...)
+	if err != nil {
+		return migrate.Result{}, err
+	}
+
+	conn, err := s.GetPGXClient(ctx)
+	if err != nil {
+		return migrate.Result{}, err
+	}
+	defer func() {
+		if err := s.ClosePGX(context.WithoutCancel(ctx), conn); err != nil {
+			logs.Infof("postgres: unable to close migration connection: %v", err)
+		}
+	}()
+
+	return migrate.Run(ctx, newMigrationStore(conn, o.Table), fsys, o)
+}
+
+type migrationStore struct {
+	conn  *pgx.Conn
+	table string
+	key   int64
+}
+
+func newMigrationStore(conn *pgx.Conn, table string) *migrationStore {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("go-config:migrate:" + table))
+
+	return &migrationStore{
+		conn:  conn,
+		table: table,
+		key:   int64(h.Sum64()),
+	}
+}
+
+func (m *migrationStore) Lock(ctx context.Context) error {
+	if _, err := m.conn.Exec(ctx, "SELECT pg_advisory_lock($1)", m.key); err != nil {
+		return logs.Errorf("postgres: unable to take migration lock: %v", err)
+	}
+	return nil
+}
+
+func (m *migrationStore) Unlock(ctx context.Context) error {
+	if _, err := m.conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", m.key); err != nil {
+		return logs.Errorf("postgres: unable to release migration lock: %v", err)
+	}
+	return nil
+}
+
+func (m *migrationStore) Prepare(ctx context.Context) error {
+	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		version BIGINT PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`, pgx.Identifier{m.table}.Sanitize())
+	if _, err := m.conn.Exec(ctx, q); err != nil {
+		return logs.Errorf("postgres: unable to create migrations table: %v", err)
+	}
+	return nil
+}
+
+func (m *migrationStore) Applied(ctx context.Context) (map[int64]bool, error) {
+	var exists bool
+	if err := m.conn.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", pgx.Identifier{m.table}.Sanitize()).Scan(&exists); err != nil {
+		return nil, logs.Errorf("postgres: unable to find migrations table: %v", err)
+	}
+	applied := make(map[int64]bool)
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := m.conn.Query(ctx, fmt.Sprintf("SELECT version FROM %s", pgx.Identifier{m.table}.Sanitize()))
+	if err != nil {
+		return nil, logs.Errorf("postgres: unable to read migrations: %v", err)
+	}
+	versions, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, logs.Errorf("postgres: unable to read migrations: %v", err)
+	}
+	for _, v := range versions {
+		applied[v] = true
+	}
+
+	return applied, nil
+}
+
+func (m *migrationStore) Apply(ctx context.Context, mig migrate.Migration, d migrate.Direction) error {
+	table := pgx.Identifier{m.table}.Sanitize()
+
+	return pgx.BeginFunc(ctx, m.conn, func(tx pgx.Tx) error {
+		if d == migrate.Down {
+			if _, err := tx.Exec(ctx, mig.Down); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE version = $1", table), mig.Version)
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, mig.Up); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (version, name) VALUES ($1, $2)", table), mig.Version, mig.Name)
+		return err
+	})
+}
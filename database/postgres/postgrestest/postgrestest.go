@@ -0,0 +1,169 @@
+// Package postgrestest gives each test a database, or a schema, of its own on any reachable postgres server,
+// with the migrations applied, and drops it again once the test is done
+package postgrestest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/keloran/go-config/database/migrate"
+	"github.com/keloran/go-config/database/postgres"
+)
+
+// EnvURL is the server FromEnv connects to, a shared CI database, a container or a locally started binary
+const EnvURL = "POSTGRESTEST_URL"
+
+const (
+	defaultPrefix = "test"
+	// maxIdentifier is postgres' NAMEDATALEN less one, longer names are silently truncated
+	maxIdentifier = 63
+	setupTimeout  = 30 * time.Second
+)
+
+type options struct {
+	schema     bool
+	prefix     string
+	migrations fs.FS
+	migrate    []migrate.Option
+}
+
+type Option func(*options)
+
+// WithSchema isolates the test with a schema in the server's database rather than a database of its own,
+// for servers where the user can't create databases
+func WithSchema() Option {
+	return func(o *options) {
+		o.schema = true
+	}
+}
+
+// WithPrefix starts the names with prefix instead of "test", so leftovers from a crashed run are easy to find
+func WithPrefix(prefix string) Option {
+	return func(o *options) {
+		o.prefix = prefix
+	}
+}
+
+// WithMigrations applies the migrations in fsys before handing the system back
+func WithMigrations(fsys fs.FS, opts ...migrate.Option) Option {
+	return func(o *options) {
+		o.migrations = fsys
+		o.migrate = opts
+	}
+}
+
+// FromEnv is a system for the server in POSTGRESTEST_URL, the test is skipped when it isn't set
+func FromEnv(t testing.TB) *postgres.System {
+	t.Helper()
+
+	connStr := os.Getenv(EnvURL)
+	if connStr == "" {
+		t.Skipf("postgrestest: %s is not set", EnvURL)
+	}
+
+	s := postgres.NewSystem()
+	s.Details.ConnectionTimeout = setupTimeout
+	if err := s.ParseConnectionString(connStr); err != nil {
+		t.Fatalf("postgrestest: unable to parse %s: %v", EnvURL, err)
+	}
+
+	return s
+}
+
+// New creates a uniquely named database (or schema with WithSchema) on base's server and returns a system
+// that uses it, it is dropped in t.Cleanup along with the system's pools
+func New(t testing.TB, base *postgres.System, opts ...Option) *postgres.System {
+	t.Helper()
+
+	o := options{prefix: defaultPrefix}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
+
+	name := Name(o.prefix, t.Name())
+	ident := pgx.Identifier{name}.Sanitize()
+	create, drop := "CREATE DATABASE "+ident, "DROP DATABASE IF EXISTS "+ident+" WITH (FORCE)"
+	if o.schema {
+		create, drop = "CREATE SCHEMA "+ident, "DROP SCHEMA IF EXISTS "+ident+" CASCADE"
+	}
+
+	if err := exec(ctx, base, create); err != nil {
+		t.Fatalf("postgrestest: unable to create %s: %v", name, err)
+	}
+
+	s := postgres.NewSystem()
+	s.Context = base.Context
+	s.Telemetry = base.Telemetry
+	s.Details = base.Details
+	s.Details.ReplicaHosts = ""
+	if o.schema {
+		s.Details.SearchPath = ident
+	} else {
+		s.Details.DBName = name
+	}
+
+	t.Cleanup(func() {
+		s.ClosePools()
+
+		ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+		defer cancel()
+		if err := exec(ctx, base, drop); err != nil {
+			t.Errorf("postgrestest: unable to drop %s: %v", name, err)
+		}
+	})
+
+	if o.migrations != nil {
+		if _, err := s.Migrate(ctx, o.migrations, o.migrate...); err != nil {
+			t.Fatalf("postgrestest: unable to migrate %s: %v", name, err)
+		}
+	}
+
+	return s
+}
+
+// Name is prefix and the test name made safe for an identifier, with a random suffix so parallel runs don't collide
+func Name(prefix, testName string) string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	var b strings.Builder
+	for _, r := range strings.ToLower(prefix + "_" + testName) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	name := b.String()
+	if limit := maxIdentifier - len(suffix)*2 - 1; len(name) > limit {
+		name = name[:limit]
+	}
+
+	return name + "_" + hex.EncodeToString(suffix)
+}
+
+// exec runs a statement on a connection of its own, CREATE and DROP DATABASE can't run inside a transaction
+func exec(ctx context.Context, base *postgres.System, sql string) error {
+	conn, err := base.GetPGXClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = base.ClosePGX(context.WithoutCancel(ctx), conn)
+	}()
+
+	_, err = conn.Exec(ctx, sql)
+	return err
+}
@@ -0,0 +1,82 @@
+//go:build integration
+// +build integration
+
+package postgrestest
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/keloran/go-config/database/postgres"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tpg "github.com/testcontainers/testcontainers-go/modules/postgres"
+)
+
+func setupServer(t *testing.T) *postgres.System {
+	ctx := context.Background()
+
+	pg, err := tpg.Run(ctx,
+		"postgres:16-alpine",
+		tpg.WithDatabase("test"),
+		tpg.WithUsername("user"),
+		tpg.WithPassword("password"),
+		tpg.BasicWaitStrategies())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := pg.Terminate(ctx); err != nil {
+			t.Logf("failed to terminate container: %v", err)
+		}
+	})
+
+	connectionString, err := pg.ConnectionString(ctx, "sslmode=disable")
+	require.NoError(t, err)
+
+	base := postgres.NewSystem()
+	require.NoError(t, base.ParseConnectionString(connectionString))
+	base.Details.ConnectionTimeout = 30 * time.Second
+
+	return base
+}
+
+func TestNewDatabase(t *testing.T) {
+	base := setupServer(t)
+	files := fstest.MapFS{
+		"0001_orders.up.sql": {Data: []byte("CREATE TABLE orders (id INT); INSERT INTO orders VALUES (1);")},
+	}
+
+	var names []string
+	for _, opts := range [][]Option{nil, {WithSchema()}} {
+		t.Run("isolated", func(t *testing.T) {
+			s := New(t, base, append(opts, WithMigrations(files))...)
+
+			pool, err := s.WritePool(context.Background())
+			require.NoError(t, err)
+
+			var count int
+			require.NoError(t, pool.QueryRow(context.Background(), "SELECT count(*) FROM orders").Scan(&count))
+			assert.Equal(t, 1, count)
+
+			var name string
+			require.NoError(t, pool.QueryRow(context.Background(), "SELECT current_database() || '.' || current_schema()").Scan(&name))
+			names = append(names, name)
+		})
+	}
+	require.Len(t, names, 2)
+	assert.Regexp(t, `^test_testnewdatabase_isolated_[0-9a-f]{8}\.public$`, names[0])
+	assert.Regexp(t, `^test\.test_testnewdatabase_isolated_01_[0-9a-f]{8}$`, names[1])
+
+	conn, err := base.GetPGXClient(context.Background())
+	require.NoError(t, err)
+	defer func() {
+		_ = base.ClosePGX(context.Background(), conn)
+	}()
+
+	var left int
+	require.NoError(t, conn.QueryRow(context.Background(), "SELECT count(*) FROM pg_database WHERE datname LIKE 'test\\_%'").Scan(&left))
+	assert.Zero(t, left)
+	require.NoError(t, conn.QueryRow(context.Background(), "SELECT count(*) FROM pg_namespace WHERE nspname LIKE 'test\\_%'").Scan(&left))
+	assert.Zero(t, left)
+}
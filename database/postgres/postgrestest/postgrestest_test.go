@@ -0,0 +1,36 @@
+package postgrestest
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestName(t *testing.T) {
+	name := Name("test", "TestOrders/Parallel Sub-Test")
+	assert.Regexp(t, regexp.MustCompile(`^test_testorders_parallel_sub_test_[0-9a-f]{8}$`), name)
+	assert.NotEqual(t, name, Name("test", "TestOrders/Parallel Sub-Test"))
+
+	long := Name("test", strings.Repeat("TestSomethingVeryLong", 10))
+	assert.Len(t, long, maxIdentifier)
+	assert.Regexp(t, regexp.MustCompile(`_[0-9a-f]{8}$`), long)
+}
+
+func TestFromEnvSkips(t *testing.T) {
+	if v, ok := os.LookupEnv(EnvURL); ok {
+		defer func() {
+			_ = os.Setenv(EnvURL, v)
+		}()
+	}
+	if err := os.Unsetenv(EnvURL); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("no url", func(t *testing.T) {
+		FromEnv(t)
+		t.Error("FromEnv should have skipped")
+	})
+}
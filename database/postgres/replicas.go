@@ -0,0 +1,331 @@
+package postgres
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/keloran/go-config/database/dsn"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	StrategyRoundRobin       = "round-robin"
+	StrategyLeastConnections = "least-connections"
+
+	defaultHealthInterval = 10 * time.Second
+)
+
+// pools sits behind a pointer so the System can be copied into the config
+type pools struct {
+	// refresh serialises vault rebuilds, database/sql opens connections from its own goroutines
+	refresh sync.Mutex
+
+	mu       sync.Mutex
+	primary  *pgxpool.Pool
+	replicas []*replica
+	next     atomic.Uint64
+	cancel   context.CancelFunc
+	settings replicaSettings
+	// observed are the telemetry registrations for the pools above
+	observed []metric.Registration
+}
+
+type replica struct {
+	host    string
+	pool    *pgxpool.Pool
+	healthy atomic.Bool
+}
+
+// replicaSettings are taken from the details once when the replica pools are built,
+// so picking and health checks never read details a vault refresh is writing
+type replicaSettings struct {
+	strategy    string
+	interval    time.Duration
+	pingTimeout time.Duration
+}
+
+func (d Details) replicaSettings() replicaSettings {
+	rs := replicaSettings{
+		strategy:    d.ReplicaStrategy,
+		interval:    healthInterval(d.ReplicaHealthInterval),
+		pingTimeout: d.ConnectionTimeout,
+	}
+	if rs.pingTimeout <= 0 {
+		rs.pingTimeout = rs.interval
+	}
+
+	return rs
+}
+
+// replicaDetails is a copy of the details for each replica host, everything but the host is shared with the primary
+func (d Details) replicaDetails() ([]Details, error) {
+	addrs, err := dsn.ParseHosts(d.ReplicaHosts, d.Port)
+	if err != nil {
+		return nil, logs.Errorf("postgres: unable to parse replica hosts: %v", err)
+	}
+
+	replicas := make([]Details, 0, len(addrs))
+	for _, a := range addrs {
+		rd := d
+		rd.Host = dsn.JoinHosts([]dsn.Address{a}, d.Port)
+		rd.ReplicaHosts = ""
+		replicas = append(replicas, rd)
+	}
+
+	return replicas, nil
+}
+
+// WritePool is the pool for the primary, it is created on first use and replaced when the vault credentials are
+func (s *System) WritePool(ctx context.Context) (*pgxpool.Pool, error) {
+	d, _, err := s.refreshPools()
+	if err != nil {
+		return nil, err
+	}
+
+	s.pools.mu.Lock()
+	defer s.pools.mu.Unlock()
+
+	return s.primaryPool(ctx, d)
+}
+
+// primaryPool must be called with the lock held
+func (s *System) primaryPool(ctx context.Context, d Details) (*pgxpool.Pool, error) {
+	if s.pools.primary != nil {
+		return s.pools.primary, nil
+	}
+
+	pool, err := newPool(ctx, d, s.Telemetry)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.observe(pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	s.pools.primary = pool
+
+	return pool, nil
+}
+
+// ReadPool picks a healthy replica using the replica strategy, falling back to the primary
+// when there are no replicas or none of them pass their health check
+func (s *System) ReadPool(ctx context.Context) (*pgxpool.Pool, error) {
+	d, _, err := s.refreshPools()
+	if err != nil {
+		return nil, err
+	}
+
+	s.pools.mu.Lock()
+	defer s.pools.mu.Unlock()
+
+	if d.ReplicaHosts == "" {
+		return s.primaryPool(ctx, d)
+	}
+	if s.pools.replicas == nil {
+		if err := s.startReplicas(ctx, d); err != nil {
+			return nil, err
+		}
+	}
+
+	if r := s.pickReplica(); r != nil {
+		return r.pool, nil
+	}
+
+	logs.Infof("postgres: no healthy replicas, reading from the primary")
+	return s.primaryPool(ctx, d)
+}
+
+// observe must be called with the lock held
+func (s *System) observe(pool *pgxpool.Pool) error {
+	if s.Telemetry == nil {
+		return nil
+	}
+
+	reg, err := s.Telemetry.ObservePgxPool(pool)
+	if err != nil {
+		return err
+	}
+	s.pools.observed = append(s.pools.observed, reg)
+
+	return nil
+}
+
+// pickReplica must be called with the lock held
+func (s *System) pickReplica() *replica {
+	healthy := make([]*replica, 0, len(s.pools.replicas))
+	for _, r := range s.pools.replicas {
+		if r.healthy.Load() {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	if s.pools.settings.strategy == StrategyLeastConnections {
+		least := healthy[0]
+		for _, r := range healthy[1:] {
+			if r.pool.Stat().AcquiredConns() < least.pool.Stat().AcquiredConns() {
+				least = r
+			}
+		}
+		return least
+	}
+
+	return healthy[(s.pools.next.Add(1)-1)%uint64(len(healthy))]
+}
+
+// startReplicas must be called with the lock held
+func (s *System) startReplicas(ctx context.Context, d Details) error {
+	details, err := d.replicaDetails()
+	if err != nil {
+		return err
+	}
+
+	replicas := make([]*replica, 0, len(details))
+	for _, rd := range details {
+		pool, err := newPool(ctx, rd, s.Telemetry)
+		if err == nil {
+			if err = s.observe(pool); err != nil {
+				pool.Close()
+			}
+		}
+		if err != nil {
+			for _, r := range replicas {
+				r.pool.Close()
+			}
+			return err
+		}
+		r := &replica{host: rd.Host, pool: pool}
+		r.healthy.Store(true)
+		replicas = append(replicas, r)
+	}
+	s.pools.replicas = replicas
+	s.pools.settings = d.replicaSettings()
+
+	base := s.Context
+	if base == nil {
+		base = context.Background()
+	}
+	healthCtx, cancel := context.WithCancel(base)
+	s.pools.cancel = cancel
+	go s.checkReplicas(healthCtx, replicas, s.pools.settings)
+
+	return nil
+}
+
+// checkReplicas pings every replica each health interval, ejecting the ones that fail and taking them back once they answer
+func (s *System) checkReplicas(ctx context.Context, replicas []*replica, rs replicaSettings) {
+	ticker := time.NewTicker(rs.interval)
+	defer ticker.Stop()
+
+	for {
+		for _, r := range replicas {
+			s.checkReplica(ctx, r, rs)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *System) checkReplica(ctx context.Context, r *replica, rs replicaSettings) {
+	pingCtx, cancel := context.WithTimeout(ctx, rs.pingTimeout)
+	defer cancel()
+
+	err := r.pool.Ping(pingCtx)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		if r.healthy.Swap(false) {
+			logs.Infof("postgres: ejecting replica %s: %v", r.host, err)
+		}
+		return
+	}
+	if !r.healthy.Swap(true) {
+		logs.Infof("postgres: replica %s is healthy again", r.host)
+	}
+}
+
+func healthInterval(d time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultHealthInterval
+	}
+
+	return d
+}
+
+// refreshPools drops the cached pools when the vault credentials have been rebuilt, so the next call connects with the new ones,
+// the details it returns are a copy taken under the same lock the rebuild writes them with
+func (s *System) refreshPools() (Details, bool, error) {
+	if s.pools == nil {
+		s.pools = &pools{}
+	}
+
+	s.pools.refresh.Lock()
+	rebuilt, err := s.refreshVault()
+	d := s.Details
+	s.pools.refresh.Unlock()
+	if err != nil {
+		return Details{}, false, err
+	}
+	if rebuilt {
+		s.closePools(false)
+	}
+
+	return d, rebuilt, nil
+}
+
+// ClosePools stops the replica health checks and closes the read and write pools
+func (s *System) ClosePools() {
+	s.closePools(true)
+}
+
+// closePools waits for borrowed connections to come back when wait is set,
+// otherwise the old pools drain in the background so callers still holding them aren't blocked
+func (s *System) closePools(wait bool) {
+	if s.pools == nil {
+		return
+	}
+
+	s.pools.mu.Lock()
+	if s.pools.cancel != nil {
+		s.pools.cancel()
+		s.pools.cancel = nil
+	}
+	old := make([]*pgxpool.Pool, 0, len(s.pools.replicas)+1)
+	for _, r := range s.pools.replicas {
+		old = append(old, r.pool)
+	}
+	if s.pools.primary != nil {
+		old = append(old, s.pools.primary)
+	}
+	for _, reg := range s.pools.observed {
+		if err := reg.Unregister(); err != nil {
+			logs.Infof("postgres: unable to stop pool metrics: %v", err)
+		}
+	}
+	s.pools.observed = nil
+	s.pools.replicas = nil
+	s.pools.primary = nil
+	s.pools.mu.Unlock()
+
+	closeAll := func() {
+		for _, p := range old {
+			p.Close()
+		}
+	}
+	if wait {
+		closeAll()
+		return
+	}
+	go closeAll()
+}
@@ -0,0 +1,242 @@
+package postgres
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keloran/go-config/secrets"
+	vaultHelper "github.com/keloran/vault-helper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closedPort is a local port with nothing listening on it
+func closedPort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	return port
+}
+
+func replicaSystem(t *testing.T, strategy string) *System {
+	t.Helper()
+
+	s := NewSystem()
+	s.Details = Details{
+		Host:                  "127.0.0.1",
+		Port:                  closedPort(t),
+		User:                  "user",
+		Password:              secrets.New("pass"),
+		DBName:                "db",
+		ConnectionTimeout:     time.Second,
+		ReplicaHosts:          "127.0.0.1,127.0.0.2",
+		ReplicaStrategy:       strategy,
+		ReplicaHealthInterval: time.Hour,
+		SSLMode:               "disable",
+	}
+	t.Cleanup(s.ClosePools)
+
+	return s
+}
+
+func TestReplicaDetails(t *testing.T) {
+	d := Details{Host: "primary", Port: 5432, ReplicaHosts: "replica1,replica2:5433,[::1]"}
+
+	replicas, err := d.replicaDetails()
+	require.NoError(t, err)
+	require.Len(t, replicas, 3)
+	assert.Equal(t, "replica1", replicas[0].Host)
+	assert.Equal(t, "replica2:5433", replicas[1].Host)
+	assert.Equal(t, "[::1]", replicas[2].Host)
+	assert.Equal(t, 5432, replicas[0].Port)
+	assert.Empty(t, replicas[0].ReplicaHosts)
+}
+
+func TestReadPoolRoundRobin(t *testing.T) {
+	s := replicaSystem(t, StrategyRoundRobin)
+
+	s.pools.mu.Lock()
+	require.NoError(t, s.startReplicas(context.Background(), s.Details))
+	s.pools.cancel()
+	s.pools.mu.Unlock()
+	for _, r := range s.pools.replicas {
+		r.healthy.Store(true)
+	}
+
+	first, err := s.ReadPool(context.Background())
+	require.NoError(t, err)
+	second, err := s.ReadPool(context.Background())
+	require.NoError(t, err)
+	third, err := s.ReadPool(context.Background())
+	require.NoError(t, err)
+
+	assert.NotSame(t, first, second)
+	assert.Same(t, first, third)
+}
+
+func TestReadPoolLeastConnections(t *testing.T) {
+	s := replicaSystem(t, StrategyLeastConnections)
+
+	s.pools.mu.Lock()
+	require.NoError(t, s.startReplicas(context.Background(), s.Details))
+	s.pools.cancel()
+	s.pools.mu.Unlock()
+	for _, r := range s.pools.replicas {
+		r.healthy.Store(true)
+	}
+
+	first, err := s.ReadPool(context.Background())
+	require.NoError(t, err)
+	second, err := s.ReadPool(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+}
+
+func TestReadPoolEjectsAndFallsBack(t *testing.T) {
+	s := replicaSystem(t, StrategyRoundRobin)
+	s.Details.ReplicaHosts = "127.0.0.1"
+
+	s.pools.mu.Lock()
+	require.NoError(t, s.startReplicas(context.Background(), s.Details))
+	s.pools.cancel()
+	s.pools.mu.Unlock()
+
+	r := s.pools.replicas[0]
+	s.checkReplica(context.Background(), r, s.pools.settings)
+	assert.False(t, r.healthy.Load())
+
+	read, err := s.ReadPool(context.Background())
+	require.NoError(t, err)
+	write, err := s.WritePool(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, write, read)
+	assert.NotSame(t, r.pool, read)
+}
+
+func TestReadPoolWithoutReplicas(t *testing.T) {
+	s := replicaSystem(t, StrategyRoundRobin)
+	s.Details.ReplicaHosts = ""
+
+	read, err := s.ReadPool(context.Background())
+	require.NoError(t, err)
+	write, err := s.WritePool(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, write, read)
+}
+
+func TestReadPoolDuringVaultRefresh(t *testing.T) {
+	os.Clearenv()
+	t.Setenv("RDS_REPLICA_HEALTH_INTERVAL", "1ms")
+	t.Setenv("RDS_CONNECTION_TIMEOUT", "100ms")
+	port := strconv.Itoa(closedPort(t))
+	mockVault := &vaultHelper.MockVaultHelper{
+		KVSecrets: []vaultHelper.KVSecret{
+			{Key: "password", Value: "testPassword"},
+			{Key: "username", Value: "testUser"},
+			{Key: "rds-hostname", Value: "127.0.0.1"},
+			{Key: "rds-port", Value: port},
+			{Key: "rds-replica-hostnames", Value: "127.0.0.1,127.0.0.2"},
+		},
+	}
+
+	// a zero lease expires straight away, so every call rebuilds the details from vault while the health checks run
+	s := NewSystem()
+	s.Setup(VaultDetails{CredPath: "tester", DetailsPath: "tester"}, mockVault)
+	_, err := s.Build()
+	require.NoError(t, err)
+	t.Cleanup(s.ClosePools)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, err := s.ReadPool(context.Background())
+				assert.NoError(t, err)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPGXPoolClientDuringVaultRefresh(t *testing.T) {
+	os.Clearenv()
+	t.Setenv("RDS_CONNECTION_TIMEOUT", "100ms")
+	mockVault := &vaultHelper.MockVaultHelper{
+		KVSecrets: []vaultHelper.KVSecret{
+			{Key: "password", Value: "testPassword"},
+			{Key: "username", Value: "testUser"},
+			{Key: "rds-hostname", Value: "127.0.0.1"},
+			{Key: "rds-port", Value: strconv.Itoa(closedPort(t))},
+		},
+	}
+
+	// every call rebuilds from vault, the pgx clients take the same lock as the cached pools
+	s := NewSystem()
+	s.Setup(VaultDetails{CredPath: "tester", DetailsPath: "tester"}, mockVault)
+	_, err := s.Build()
+	require.NoError(t, err)
+	t.Cleanup(s.ClosePools)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				pool, err := s.GetPGXPoolClient(context.Background())
+				if assert.NoError(t, err) {
+					pool.Close()
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, err := s.WritePool(context.Background())
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestBuildVaultReplicas(t *testing.T) {
+	os.Clearenv()
+	mockVault := &vaultHelper.MockVaultHelper{
+		KVSecrets: []vaultHelper.KVSecret{
+			{Key: "password", Value: "testPassword"},
+			{Key: "username", Value: "testUser"},
+			{Key: "rds-hostname", Value: "primary"},
+			{Key: "rds-replica-hostnames", Value: "replica1,replica2"},
+		},
+	}
+
+	d := NewSystem()
+	d.Setup(VaultDetails{CredPath: "tester", DetailsPath: "tester"}, mockVault)
+	db, err := d.Build()
+	require.NoError(t, err)
+	assert.Equal(t, "replica1,replica2", db.ReplicaHosts)
+	assert.Equal(t, StrategyRoundRobin, db.ReplicaStrategy)
+}
+
+func TestBuildReplicaStrategy(t *testing.T) {
+	os.Clearenv()
+	if err := os.Setenv("RDS_REPLICA_STRATEGY", "random"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewSystem().Build()
+	assert.Error(t, err)
+}
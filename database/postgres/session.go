@@ -0,0 +1,119 @@
+package postgres
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5/pgconn"
+	vaultHelper "github.com/keloran/vault-helper"
+)
+
+// serviceName is the application_name when none is set, SERVICE_NAME or OTEL_SERVICE_NAME, then the binary name
+func serviceName() string {
+	for _, key := range []string{"SERVICE_NAME", "OTEL_SERVICE_NAME"} {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+	}
+
+	return filepath.Base(os.Args[0])
+}
+
+// runtimeParams are the session settings sent when every connection starts
+func (d Details) runtimeParams() map[string]string {
+	params := map[string]string{
+		"application_name": d.ApplicationName,
+	}
+	if params["application_name"] == "" {
+		params["application_name"] = serviceName()
+	}
+	if d.SearchPath != "" {
+		params["search_path"] = d.SearchPath
+	}
+
+	// postgres reads a bare number as milliseconds
+	for key, timeout := range map[string]time.Duration{
+		"statement_timeout":                   d.StatementTimeout,
+		"lock_timeout":                        d.LockTimeout,
+		"idle_in_transaction_session_timeout": d.IdleInTransactionSessionTimeout,
+	} {
+		if timeout > 0 {
+			params[key] = strconv.FormatInt(timeout.Milliseconds(), 10)
+		}
+	}
+
+	return params
+}
+
+// applyConfig adds the session settings and any PEM content to a parsed config,
+// settings already in the connection string (RDS_URL or ExtraParams) are left alone
+func (d Details) applyConfig(cfg *pgconn.Config) error {
+	if err := d.applyTLS(cfg); err != nil {
+		return err
+	}
+
+	if cfg.RuntimeParams == nil {
+		cfg.RuntimeParams = make(map[string]string)
+	}
+	for key, value := range d.runtimeParams() {
+		if _, ok := cfg.RuntimeParams[key]; !ok {
+			cfg.RuntimeParams[key] = value
+		}
+	}
+
+	return nil
+}
+
+// buildVaultSession reads the session settings from the details secret, anything set in env wins
+func (s *System) buildVaultSession(vh vaultHelper.VaultHelper, rds *Details) error {
+	set := s.configured()
+	rds.ApplicationName = set.ApplicationName
+	rds.SearchPath = set.SearchPath
+	rds.StatementTimeout = set.StatementTimeout
+	rds.LockTimeout = set.LockTimeout
+	rds.IdleInTransactionSessionTimeout = set.IdleInTransactionSessionTimeout
+
+	for key, field := range map[string]*string{
+		"rds-application-name": &rds.ApplicationName,
+		"rds-search-path":      &rds.SearchPath,
+	} {
+		if *field != "" {
+			continue
+		}
+		secret, err := vh.GetSecret(key)
+		if err != nil {
+			if isVaultKeyNotFound(err) {
+				continue
+			}
+			return logs.Errorf("postgres: unable to get %s: %v", key, err)
+		}
+		*field = secret
+	}
+
+	for key, field := range map[string]*time.Duration{
+		"rds-statement-timeout":                   &rds.StatementTimeout,
+		"rds-lock-timeout":                        &rds.LockTimeout,
+		"rds-idle-in-transaction-session-timeout": &rds.IdleInTransactionSessionTimeout,
+	} {
+		if *field != 0 {
+			continue
+		}
+		secret, err := vh.GetSecret(key)
+		if err != nil {
+			if isVaultKeyNotFound(err) {
+				continue
+			}
+			return logs.Errorf("postgres: unable to get %s: %v", key, err)
+		}
+		timeout, err := time.ParseDuration(secret)
+		if err != nil {
+			return logs.Errorf("postgres: unable to parse %s: %v", key, err)
+		}
+		*field = timeout
+	}
+
+	return nil
+}
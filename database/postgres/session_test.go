@@ -0,0 +1,91 @@
+package postgres
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/keloran/go-config/secrets"
+	vaultHelper "github.com/keloran/vault-helper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyConfigRuntimeParams(t *testing.T) {
+	os.Clearenv()
+	if err := os.Setenv("SERVICE_NAME", "orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	d := Details{
+		Host:             "localhost",
+		Port:             5432,
+		User:             "user",
+		Password:         secrets.New("pass"),
+		DBName:           "db",
+		SearchPath:       "orders,public",
+		StatementTimeout: 30 * time.Second,
+		LockTimeout:      500 * time.Millisecond,
+	}
+
+	connStr, err := d.ConnectionString()
+	require.NoError(t, err)
+	cfg, err := pgx.ParseConfig(connStr)
+	require.NoError(t, err)
+	require.NoError(t, d.applyConfig(&cfg.Config))
+
+	assert.Equal(t, "orders", cfg.RuntimeParams["application_name"])
+	assert.Equal(t, "orders,public", cfg.RuntimeParams["search_path"])
+	assert.Equal(t, "30000", cfg.RuntimeParams["statement_timeout"])
+	assert.Equal(t, "500", cfg.RuntimeParams["lock_timeout"])
+	assert.NotContains(t, cfg.RuntimeParams, "idle_in_transaction_session_timeout")
+}
+
+func TestApplyConfigKeepsConnectionStringParams(t *testing.T) {
+	d := Details{
+		Host:             "localhost",
+		Port:             5432,
+		DBName:           "db",
+		ApplicationName:  "orders",
+		StatementTimeout: time.Second,
+		ExtraParams:      "application_name=migrations&statement_timeout=0",
+	}
+
+	connStr, err := d.ConnectionString()
+	require.NoError(t, err)
+	cfg, err := pgx.ParseConfig(connStr)
+	require.NoError(t, err)
+	require.NoError(t, d.applyConfig(&cfg.Config))
+
+	assert.Equal(t, "migrations", cfg.RuntimeParams["application_name"])
+	assert.Equal(t, "0", cfg.RuntimeParams["statement_timeout"])
+}
+
+func TestBuildVaultSession(t *testing.T) {
+	os.Clearenv()
+	if err := os.Setenv("RDS_LOCK_TIMEOUT", "2s"); err != nil {
+		t.Fatal(err)
+	}
+
+	mockVault := &vaultHelper.MockVaultHelper{
+		KVSecrets: []vaultHelper.KVSecret{
+			{Key: "password", Value: "testPassword"},
+			{Key: "username", Value: "testUser"},
+			{Key: "rds-application-name", Value: "billing"},
+			{Key: "rds-search-path", Value: "billing"},
+			{Key: "rds-statement-timeout", Value: "15s"},
+			{Key: "rds-lock-timeout", Value: "5s"},
+		},
+	}
+
+	d := NewSystem()
+	d.Setup(VaultDetails{CredPath: "tester", DetailsPath: "tester"}, mockVault)
+	db, err := d.Build()
+	require.NoError(t, err)
+	assert.Equal(t, "billing", db.ApplicationName)
+	assert.Equal(t, "billing", db.SearchPath)
+	assert.Equal(t, 15*time.Second, db.StatementTimeout)
+	assert.Equal(t, 2*time.Second, db.LockTimeout)
+	assert.Zero(t, db.IdleInTransactionSessionTimeout)
+}
@@ -0,0 +1,72 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+)
+
+// SQLDB is a database/sql handle over pgx for code that needs one (sqlc, ORMs), it shares the session settings and TLS
+// with the pgx clients, every new connection picks up refreshed vault credentials and connections are retired when the lease ends
+func (s *System) SQLDB(ctx context.Context) (*sql.DB, error) {
+	d, _, err := s.refreshPools()
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := d.connConfig()
+	if err != nil {
+		return nil, err
+	}
+	if s.Telemetry != nil {
+		config.Tracer = s.Telemetry.PgxTracer()
+	}
+
+	var db *sql.DB
+	connector := stdlib.GetConnector(*config, stdlib.OptionBeforeConnect(func(ctx context.Context, cc *pgx.ConnConfig) error {
+		_, rebuilt, err := s.refreshPools()
+		if err != nil {
+			return err
+		}
+
+		s.pools.refresh.Lock()
+		cc.User = s.Details.User
+		cc.Password = s.Details.Password.Reveal()
+		lifetime := s.connLifetime()
+		s.pools.refresh.Unlock()
+
+		if rebuilt {
+			db.SetConnMaxLifetime(lifetime)
+		}
+
+		return nil
+	}))
+	if s.Telemetry == nil {
+		db = sql.OpenDB(connector)
+	} else {
+		name := fmt.Sprintf("%s:%d/%s", config.Host, config.Port, config.Database)
+		if db, err = s.Telemetry.OpenObservedDB(connector, name, semconv.DBSystemNamePostgreSQL); err != nil {
+			return nil, err
+		}
+	}
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(10)
+	db.SetConnMaxIdleTime(d.ConnectionTimeout)
+	db.SetConnMaxLifetime(s.connLifetime())
+
+	return db, nil
+}
+
+// connLifetime is how long until the vault lease ends, connections made without vault don't expire
+func (s *System) connLifetime() time.Duration {
+	if s.VaultHelper == nil {
+		return 0
+	}
+
+	return time.Until(s.ExpireTime)
+}
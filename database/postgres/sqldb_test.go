@@ -0,0 +1,55 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	vaultHelper "github.com/keloran/vault-helper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLDBRefreshesCredentials(t *testing.T) {
+	os.Clearenv()
+	mockVault := &vaultHelper.MockVaultHelper{
+		KVSecrets: []vaultHelper.KVSecret{
+			{Key: "password", Value: "firstPassword"},
+			{Key: "username", Value: "testUser"},
+			{Key: "rds-hostname", Value: "127.0.0.1"},
+			{Key: "rds-port", Value: "1"},
+			{Key: "rds-sslmode", Value: "disable"},
+		},
+		// the lease is always inside the refresh buffer, so every connection rebuilds
+		Lease: 60,
+	}
+
+	s := NewSystem()
+	s.Setup(VaultDetails{CredPath: "tester", DetailsPath: "tester"}, mockVault)
+	_, err := s.Build()
+	require.NoError(t, err)
+	assert.Equal(t, "firstPassword", s.Password.Reveal())
+
+	db, err := s.SQLDB(context.Background())
+	require.NoError(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+	assert.Equal(t, 10, db.Stats().MaxOpenConnections)
+
+	mockVault.KVSecrets[0].Value = "secondPassword"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Error(t, db.PingContext(ctx))
+	assert.Equal(t, "secondPassword", s.Password.Reveal())
+}
+
+func TestConnLifetime(t *testing.T) {
+	s := NewSystem()
+	assert.Zero(t, s.connLifetime())
+
+	s.VaultHelper = new(vaultHelper.VaultHelper)
+	s.ExpireTime = time.Now().Add(time.Hour)
+	assert.InDelta(t, time.Hour.Seconds(), s.connLifetime().Seconds(), 1)
+}
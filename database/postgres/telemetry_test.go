@@ -0,0 +1,79 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	"github.com/keloran/go-config/telemetry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func maxConnPoints(t *testing.T, reader *sdkmetric.ManualReader) int {
+	t.Helper()
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "db.client.connection.max" {
+				return len(m.Data.(metricdata.Sum[int64]).DataPoints)
+			}
+		}
+	}
+
+	return 0
+}
+
+func TestPoolsTelemetry(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	tel, err := telemetry.New(nil, sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	require.NoError(t, err)
+
+	s := replicaSystem(t, StrategyRoundRobin)
+	s.Telemetry = tel
+
+	write, err := s.WritePool(context.Background())
+	require.NoError(t, err)
+	assert.NotNil(t, write.Config().ConnConfig.Tracer)
+	read, err := s.ReadPool(context.Background())
+	require.NoError(t, err)
+	assert.NotNil(t, read.Config().ConnConfig.Tracer)
+
+	// the primary and both replicas are on the same address, each pool is numbered so they get their own point
+	assert.Equal(t, 3, maxConnPoints(t, reader))
+
+	s.ClosePools()
+	assert.Equal(t, 0, maxConnPoints(t, reader))
+}
+
+func TestSQLDBTelemetry(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	tel, err := telemetry.New(nil, sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	require.NoError(t, err)
+
+	s := replicaSystem(t, StrategyRoundRobin)
+	s.Telemetry = tel
+
+	first, err := s.SQLDB(context.Background())
+	require.NoError(t, err)
+	second, err := s.SQLDB(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, maxConnPoints(t, reader))
+
+	require.NoError(t, first.Close())
+	assert.Equal(t, 1, maxConnPoints(t, reader), "a closed handle stops reporting")
+	require.NoError(t, second.Close())
+	assert.Equal(t, 0, maxConnPoints(t, reader))
+}
+
+func TestPoolWithoutTelemetry(t *testing.T) {
+	s := replicaSystem(t, StrategyRoundRobin)
+
+	pool, err := s.GetPGXPoolClient(context.Background())
+	require.NoError(t, err)
+	defer pool.Close()
+	assert.Nil(t, pool.Config().ConnConfig.Tracer)
+}
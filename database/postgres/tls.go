@@ -0,0 +1,109 @@
+package postgres
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const pemPrefix = "-----BEGIN"
+
+// isPEM tells PEM content apart from a file path, both are accepted for the ssl settings
+func isPEM(v string) bool {
+	return strings.Contains(v, pemPrefix)
+}
+
+func readPEM(v string) ([]byte, error) {
+	if isPEM(v) {
+		return []byte(v), nil
+	}
+
+	b, err := os.ReadFile(v)
+	if err != nil {
+		return nil, logs.Errorf("postgres: unable to read %s: %v", v, err)
+	}
+	return b, nil
+}
+
+// sslParams are the connection params for the ssl settings that pgx can load itself, PEM content is applied by applyTLS
+func (d Details) sslParams(params url.Values) {
+	mode := d.SSLMode
+	if mode == "require" && isPEM(d.SSLRootCert) {
+		// libpq treats require with a root cert as verify-ca, pgx only knows to when the cert is a file
+		mode = "verify-ca"
+	}
+	if mode != "" {
+		params.Set("sslmode", mode)
+	}
+
+	if d.SSLRootCert != "" && !isPEM(d.SSLRootCert) {
+		params.Set("sslrootcert", d.SSLRootCert)
+	}
+	if d.clientCertFromFiles() {
+		params.Set("sslcert", d.SSLCert)
+		params.Set("sslkey", d.SSLKey.Reveal())
+	}
+}
+
+func (d Details) clientCertFromFiles() bool {
+	return d.SSLCert != "" && !d.SSLKey.IsZero() && !isPEM(d.SSLCert) && !isPEM(d.SSLKey.Reveal())
+}
+
+// applyTLS loads any PEM content into the tls configs pgx built for each host and fallback
+func (d Details) applyTLS(cfg *pgconn.Config) error {
+	if d.SSLCert != "" && d.SSLKey.IsZero() || d.SSLCert == "" && !d.SSLKey.IsZero() {
+		return logs.Error("postgres: unable to use ssl cert without ssl key")
+	}
+
+	var pool *x509.CertPool
+	if isPEM(d.SSLRootCert) {
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(d.SSLRootCert)) {
+			return logs.Error("postgres: unable to parse ssl root cert")
+		}
+	}
+
+	var certs []tls.Certificate
+	if d.SSLCert != "" && !d.clientCertFromFiles() {
+		certPEM, err := readPEM(d.SSLCert)
+		if err != nil {
+			return err
+		}
+		keyPEM, err := readPEM(d.SSLKey.Reveal())
+		if err != nil {
+			return err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return logs.Errorf("postgres: unable to parse ssl cert and key: %v", err)
+		}
+		certs = []tls.Certificate{cert}
+	}
+
+	if pool == nil && certs == nil {
+		return nil
+	}
+
+	configs := []*tls.Config{cfg.TLSConfig}
+	for _, fb := range cfg.Fallbacks {
+		configs = append(configs, fb.TLSConfig)
+	}
+	for _, tc := range configs {
+		if tc == nil {
+			continue
+		}
+		if pool != nil {
+			tc.RootCAs = pool
+		}
+		if certs != nil {
+			tc.Certificates = certs
+		}
+	}
+
+	return nil
+}
@@ -6,19 +6,27 @@ import (
 
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/caarlos0/env/v8"
+	"github.com/keloran/go-config/secrets"
+	"github.com/keloran/go-config/vault"
 	vaultHelper "github.com/keloran/vault-helper"
 )
 
+// DefaultFallbackHost is used when neither INFLUX_HOSTNAME nor the details secret set a host
+const DefaultFallbackHost = "http://db.chewed-k8s.net:8086"
+
 type VaultDetails struct {
-	CredsPath   string `env:"INFLUX_VAULT_CREDS_PATH" envDefault:"secret/data/chewedfeed/influx"`
-	DetailsPath string `env:"INFLUX_VAULT_DETAILS_PATH" envDefault:"secret/data/chewedfeed/details"`
+	CredsPath   string `env:"INFLUX_VAULT_CREDS_PATH"`
+	DetailsPath string `env:"INFLUX_VAULT_DETAILS_PATH"`
+
+	// FallbackHost is used when the details secret has no influx-hostname
+	FallbackHost string `env:"INFLUX_VAULT_FALLBACK_HOSTNAME"`
 }
 
 type Details struct {
-	Host   string `env:"INFLUX_HOSTNAME" envDefault:"http://db.chewed-k8s.net:8086"`
-	Token  string `env:"INFLUX_TOKEN"`
-	Bucket string `env:"INFLUX_BUCKET"`
-	Org    string `env:"INFLUX_ORG"`
+	Host   string         `env:"INFLUX_HOSTNAME"`
+	Token  secrets.Secret `env:"INFLUX_TOKEN"`
+	Bucket string         `env:"INFLUX_BUCKET"`
+	Org    string         `env:"INFLUX_ORG"`
 }
 
 type System struct {
@@ -59,16 +67,47 @@ func (s *System) buildGeneric() (*Details, error) {
 	if err := env.Parse(in); err != nil {
 		return in, logs.Errorf("influx: unable to parse env: %v", err)
 	}
+	if in.Host == "" {
+		in.Host = DefaultFallbackHost
+	}
 
 	s.Details = *in
 	return in, nil
 }
 
+func (vd VaultDetails) fallbackHost() string {
+	if vd.FallbackHost != "" {
+		return vd.FallbackHost
+	}
+
+	return DefaultFallbackHost
+}
+
 func isVaultKeyNotFound(err error) bool {
 	return err != nil && strings.Contains(err.Error(), "not found")
 }
 
+// resolvePaths fills in the vault paths Setup was given without, under the root from VAULT_PATH_PREFIX
+func (s *System) resolvePaths() error {
+	if s.VaultDetails.CredsPath != "" && s.VaultDetails.DetailsPath != "" {
+		return nil
+	}
+
+	root, err := vault.BuildRoot()
+	if err != nil {
+		return logs.Errorf("influx: unable to build vault root: %v", err)
+	}
+	s.VaultDetails.CredsPath = root.Resolve(s.VaultDetails.CredsPath, "influx")
+	s.VaultDetails.DetailsPath = root.Resolve(s.VaultDetails.DetailsPath, "details")
+
+	return nil
+}
+
 func (s *System) buildVault() (*Details, error) {
+	if err := s.resolvePaths(); err != nil {
+		return nil, err
+	}
+
 	in := &Details{}
 	vh := *s.VaultHelper
 
@@ -80,12 +119,12 @@ func (s *System) buildVault() (*Details, error) {
 		return in, logs.Error("influx: unable to find credential secrets")
 	}
 
-	if s.Details.Token == "" {
+	if s.Details.Token.IsZero() {
 		secret, err := vh.GetSecret("influx-token")
 		if err != nil {
 			return in, logs.Errorf("influx: unable to get token: %v", err)
 		}
-		in.Token = secret
+		in.Token = secrets.New(secret)
 	}
 
 	if s.Details.Bucket == "" {
@@ -105,13 +144,13 @@ func (s *System) buildVault() (*Details, error) {
 	}
 
 	// get the host based on the token, since host has a default in env
-	if s.Details.Token == "" {
+	if s.Details.Token.IsZero() {
 		secret, err := vh.GetSecret("influx-hostname")
 		if err != nil {
 			if !isVaultKeyNotFound(err) {
 				return in, logs.Errorf("influx: unable to get hostname: %v", err)
 			}
-			secret = "http://db.chewed-k8s.net:8086"
+			secret = s.VaultDetails.fallbackHost()
 		}
 		in.Host = secret
 	}
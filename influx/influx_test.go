@@ -26,7 +26,7 @@ func TestBuildGeneric(t *testing.T) {
 	i := NewSystem()
 	in, err := i.Build()
 	assert.NoError(t, err)
-	assert.Equal(t, "testToken", in.Token)
+	assert.Equal(t, "testToken", in.Token.Reveal())
 	assert.Equal(t, "testBucket", in.Bucket)
 	assert.Equal(t, "testOrg", in.Org)
 	assert.Equal(t, "testHost", in.Host)
@@ -51,7 +51,7 @@ func TestBuildVault(t *testing.T) {
 	in, err := i.Build()
 	assert.NoError(t, err)
 
-	assert.Equal(t, "testToken", in.Token)
+	assert.Equal(t, "testToken", in.Token.Reveal())
 	assert.Equal(t, "testBucket", in.Bucket)
 	assert.Equal(t, "testOrg", in.Org)
 	assert.Equal(t, "testHost", in.Host)
@@ -74,7 +74,7 @@ func TestBuildVaultNoHost(t *testing.T) {
 	in, err := i.Build()
 	assert.NoError(t, err)
 
-	assert.Equal(t, "testToken", in.Token)
+	assert.Equal(t, "testToken", in.Token.Reveal())
 	assert.Equal(t, "testBucket", in.Bucket)
 	assert.Equal(t, "testOrg", in.Org)
 	assert.Equal(t, "http://db.chewed-k8s.net:8086", in.Host)
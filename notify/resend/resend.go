@@ -3,11 +3,12 @@ package resend
 import (
 	"context"
 	"github.com/caarlos0/env/v8"
+	"github.com/keloran/go-config/secrets"
 	vaultHelper "github.com/keloran/vault-helper"
 )
 
 type Details struct {
-	Key string `env:"RESEND_KEY" envDefault:""`
+	Key secrets.Secret `env:"RESEND_KEY" envDefault:""`
 }
 
 type System struct {
@@ -64,12 +65,12 @@ func (s *System) buildVault() (*Details, error) {
 		return resend, nil
 	}
 
-	if s.Details.Key == "" {
+	if s.Details.Key.IsZero() {
 		secret, err := vh.GetSecret("resend_key")
 		if err != nil {
 			return resend, err
 		}
-		resend.Key = secret
+		resend.Key = secrets.New(secret)
 	} else {
 		resend.Key = s.Details.Key
 	}
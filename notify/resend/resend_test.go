@@ -17,7 +17,7 @@ func TestBuildGeneric(t *testing.T) {
 	r := NewSystem()
 	rd, err := r.Build()
 	assert.NoError(t, err)
-	assert.Equal(t, "testKey", rd.Key)
+	assert.Equal(t, "testKey", rd.Key.Reveal())
 }
 
 func TestBuildVault(t *testing.T) {
@@ -34,7 +34,7 @@ func TestBuildVault(t *testing.T) {
 	r.Setup(*vd, mockVault)
 	rd, err := r.Build()
 	assert.NoError(t, err)
-	assert.Equal(t, "testKey", rd.Key)
+	assert.Equal(t, "testKey", rd.Key.Reveal())
 }
 
 func TestBuildVaultNoKey(t *testing.T) {
@@ -51,5 +51,5 @@ func TestBuildVaultNoKey(t *testing.T) {
 	r.Setup(*vd, mockVault)
 	rd, err := r.Build()
 	assert.NoError(t, err)
-	assert.Equal(t, "testKey", rd.Key)
+	assert.Equal(t, "testKey", rd.Key.Reveal())
 }
@@ -8,10 +8,18 @@ import (
 
 	"github.com/bugfixes/go-bugfixes/logs"
 	"github.com/caarlos0/env/v8"
+	"github.com/keloran/go-config/secrets"
+	"github.com/keloran/go-config/vault"
 	vaulthelper "github.com/keloran/vault-helper"
 )
 
-const vaultRefreshBuffer = 3600
+const (
+	vaultRefreshBuffer = 3600
+
+	// DefaultMount is the "secrets" mount rabbit has always read from, rather than the "secret" of the other
+	// subsystems, it is kept while the vault root is the default so existing deployments read the same paths
+	DefaultMount = "secrets"
+)
 
 type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
@@ -19,21 +27,21 @@ type HTTPClient interface {
 
 type VaultDetails struct {
 	Address string
-	Token   string
+	Token   secrets.Secret
 
-	CredPath    string `env:"RABBIT_VAULT_CREDS_PATH" envDefault:"secrets/data/chewedfeed/rabbitmq"`
-	DetailsPath string `env:"RABBIT_VAULT_DETAILS_PATH" envDefault:"secrets/data/chewedfeed/details"`
+	CredPath    string `env:"RABBIT_VAULT_CREDS_PATH"`
+	DetailsPath string `env:"RABBIT_VAULT_DETAILS_PATH"`
 
 	ExpireTime time.Time
 }
 
 type Details struct {
-	Host           string `env:"RABBIT_HOSTNAME" envDefault:"" json:"host,omitempty"`
-	ManagementHost string `env:"RABBIT_MANAGEMENT_HOSTNAME" envDefault:"" json:"management_host,omitempty"`
-	Username       string `env:"RABBIT_USERNAME" envDefault:"" json:"username,omitempty"`
-	Password       string `env:"RABBIT_PASSWORD" envDefault:"" json:"password,omitempty"`
-	VHost          string `env:"RABBIT_VHOST" envDefault:"" json:"vhost,omitempty"`
-	Queue          string `env:"RABBIT_QUEUE" envDefault:"" json:"queue,omitempty"`
+	Host           string         `env:"RABBIT_HOSTNAME" envDefault:"" json:"host,omitempty"`
+	ManagementHost string         `env:"RABBIT_MANAGEMENT_HOSTNAME" envDefault:"" json:"management_host,omitempty"`
+	Username       string         `env:"RABBIT_USERNAME" envDefault:"" json:"username,omitempty"`
+	Password       secrets.Secret `env:"RABBIT_PASSWORD" envDefault:"" json:"password,omitempty"`
+	VHost          string         `env:"RABBIT_VHOST" envDefault:"" json:"vhost,omitempty"`
+	Queue          string         `env:"RABBIT_QUEUE" envDefault:"" json:"queue,omitempty"`
 }
 
 type System struct {
@@ -83,7 +91,31 @@ func (s *System) buildGeneric() (*Details, error) {
 	return rab, nil
 }
 
+// resolvePaths fills in the vault paths Setup was given without, under the root from VAULT_PATH_PREFIX,
+// rabbit keeps its own secrets mount when the root is the default
+func (s *System) resolvePaths() error {
+	if s.VaultDetails.CredPath != "" && s.VaultDetails.DetailsPath != "" {
+		return nil
+	}
+
+	root, err := vault.BuildRoot()
+	if err != nil {
+		return logs.Errorf("rabbit: unable to build vault root: %v", err)
+	}
+	if root.IsDefault() {
+		root = vault.NewRoot(DefaultMount, vault.DefaultBase)
+	}
+	s.VaultDetails.CredPath = root.Resolve(s.VaultDetails.CredPath, "rabbitmq")
+	s.VaultDetails.DetailsPath = root.Resolve(s.VaultDetails.DetailsPath, "details")
+
+	return nil
+}
+
 func (s *System) buildVault() (*Details, error) {
+	if err := s.resolvePaths(); err != nil {
+		return nil, err
+	}
+
 	rab := &Details{}
 	vh := *s.VaultHelper
 
@@ -104,12 +136,12 @@ func (s *System) buildVault() (*Details, error) {
 		rab.Username = s.Details.Username
 	}
 
-	if s.Details.Password == "" {
+	if s.Details.Password.IsZero() {
 		secret, err := vh.GetSecret("rabbit-password")
 		if err != nil {
 			return nil, logs.Errorf("failed to get password: %v", err)
 		}
-		rab.Password = secret
+		rab.Password = secrets.New(secret)
 	} else {
 		rab.Password = s.Details.Password
 	}
@@ -153,7 +185,7 @@ func (s *System) buildVault() (*Details, error) {
 	} else {
 		rab.Queue = s.Details.Queue
 	}
-	
+
 	s.Details = *rab
 
 	return rab, nil
@@ -174,7 +206,7 @@ func (s *System) GetRabbitQueue() (interface{}, error) {
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	req.SetBasicAuth(s.Details.Username, s.Details.Password)
+	req.SetBasicAuth(s.Details.Username, s.Details.Password.Reveal())
 
 	res, err := s.HTTPClient.Do(req)
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/keloran/go-config/secrets"
 	vaultHelper "github.com/keloran/vault-helper"
 	"github.com/stretchr/testify/assert"
 )
@@ -45,7 +46,7 @@ func TestVaultBuild(t *testing.T) {
 
 	vd := &VaultDetails{
 		Address:     "mockAddress",
-		Token:       "mockToken",
+		Token:       secrets.New("mockToken"),
 		DetailsPath: "tester",
 	}
 
@@ -57,13 +58,35 @@ func TestVaultBuild(t *testing.T) {
 	assert.NoError(t, err)
 
 	assert.Equal(t, "testUsername", rab.Username)
-	assert.Equal(t, "testPassword", rab.Password)
+	assert.Equal(t, "testPassword", rab.Password.Reveal())
 	assert.Equal(t, "testHost", rab.Host)
 	assert.Equal(t, "testManagementHost", rab.ManagementHost)
 	assert.Equal(t, "testVHost", rab.VHost)
 	assert.Equal(t, "testQueue", rab.Queue)
 }
 
+func TestVaultBuildDefaultPaths(t *testing.T) {
+	os.Clearenv()
+
+	mockVault := &vaultHelper.MockVaultHelper{
+		KVSecrets: []vaultHelper.KVSecret{
+			{Key: "rabbit-hostname", Value: "testHost"},
+			{Key: "rabbit-username", Value: "testUsername"},
+			{Key: "rabbit-password", Value: "testPassword"},
+			{Key: "rabbit-vhost", Value: "testVHost"},
+			{Key: "rabbit-queue", Value: "testQueue"},
+			{Key: "rabbit-management-hostname", Value: "testManagementHost"},
+		},
+	}
+
+	d := NewSystem(&MockHTTPClient{})
+	d.Setup(VaultDetails{}, mockVault)
+	_, err := d.Build()
+	assert.NoError(t, err)
+	assert.Equal(t, "secrets/data/chewedfeed/rabbitmq", d.VaultDetails.CredPath)
+	assert.Equal(t, "secrets/data/chewedfeed/details", d.VaultDetails.DetailsPath)
+}
+
 func TestGenericBuild(t *testing.T) {
 	os.Clearenv()
 
@@ -97,7 +120,7 @@ func TestGetRabbitQueue(t *testing.T) {
 
 	vd := &VaultDetails{
 		Address:     "mockAddress",
-		Token:       "mockToken",
+		Token:       secrets.New("mockToken"),
 		DetailsPath: "tester",
 	}
 
@@ -0,0 +1,11 @@
+package config
+
+import "github.com/keloran/go-config/secrets"
+
+// Secret holds a password, token or key and redacts it everywhere but Reveal
+type Secret = secrets.Secret
+
+// NewSecret wraps a value so it only comes back out through Reveal
+func NewSecret(v string) Secret {
+	return secrets.New(v)
+}
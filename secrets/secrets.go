@@ -0,0 +1,86 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+const Redacted = "[REDACTED]"
+
+// Secret holds a password or token, it redacts itself when printed, logged or encoded,
+// Reveal is the only way to get the value back
+type Secret struct {
+	value string
+}
+
+func New(value string) Secret {
+	return Secret{value: value}
+}
+
+// Reveal returns the raw value, keep it out of logs
+func (s Secret) Reveal() string {
+	return s.value
+}
+
+func (s Secret) IsZero() bool {
+	return s.value == ""
+}
+
+func (s Secret) redacted() string {
+	if s.value == "" {
+		return ""
+	}
+
+	return Redacted
+}
+
+func (s Secret) String() string {
+	return s.redacted()
+}
+
+func (s Secret) GoString() string {
+	return fmt.Sprintf("secrets.Secret(%q)", s.redacted())
+}
+
+// Format covers every verb so %d, %x and friends can't reach the value either
+func (s Secret) Format(f fmt.State, verb rune) {
+	if verb == 'v' && f.Flag('#') {
+		_, _ = fmt.Fprint(f, s.GoString())
+		return
+	}
+	if verb == 'q' {
+		_, _ = fmt.Fprintf(f, "%q", s.redacted())
+		return
+	}
+
+	_, _ = fmt.Fprint(f, s.redacted())
+}
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.redacted())
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.redacted())
+}
+
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	var v string
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	s.value = v
+	return nil
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.redacted()), nil
+}
+
+// UnmarshalText lets the env parser fill a Secret from an environment variable
+func (s *Secret) UnmarshalText(text []byte) error {
+	s.value = string(text)
+	return nil
+}
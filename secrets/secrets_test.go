@@ -0,0 +1,58 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/caarlos0/env/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretRedacts(t *testing.T) {
+	s := New("hunter2")
+
+	for _, out := range []string{
+		s.String(),
+		fmt.Sprintf("%v", s),
+		fmt.Sprintf("%+v", struct{ Password Secret }{s}),
+		fmt.Sprintf("%#v", s),
+		fmt.Sprintf("%s %q %x %d", s, s, s, s),
+	} {
+		assert.NotContains(t, out, "hunter2")
+		assert.Contains(t, out, Redacted)
+	}
+
+	j, err := json.Marshal(struct {
+		Password Secret `json:"password"`
+	}{s})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"password":"[REDACTED]"}`, string(j))
+
+	var buf bytes.Buffer
+	slog.New(slog.NewJSONHandler(&buf, nil)).Info("login", "password", s)
+	assert.NotContains(t, buf.String(), "hunter2")
+
+	assert.Equal(t, "hunter2", s.Reveal())
+	assert.Equal(t, "", New("").String())
+	assert.True(t, New("").IsZero())
+}
+
+func TestSecretDecodes(t *testing.T) {
+	var s Secret
+	assert.NoError(t, json.Unmarshal([]byte(`"hunter2"`), &s))
+	assert.Equal(t, "hunter2", s.Reveal())
+
+	os.Clearenv()
+	assert.NoError(t, os.Setenv("TEST_PASSWORD", "from-env"))
+	cfg := struct {
+		Password Secret `env:"TEST_PASSWORD"`
+		Default  Secret `env:"TEST_DEFAULT" envDefault:"fallback"`
+	}{}
+	assert.NoError(t, env.Parse(&cfg))
+	assert.Equal(t, "from-env", cfg.Password.Reveal())
+	assert.Equal(t, "fallback", cfg.Default.Reveal())
+}
@@ -0,0 +1,63 @@
+package telemetry
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/v2/event"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+)
+
+// MongoMonitor is a command monitor for options.Client().SetMonitor, the command itself is left off the spans
+// since filters and documents carry user data
+func (t *Telemetry) MongoMonitor() *event.CommandMonitor {
+	var ops sync.Map
+
+	finish := func(ctx context.Context, requestID int64, err error) {
+		op, ok := ops.LoadAndDelete(requestID)
+		if !ok {
+			return
+		}
+		t.end(ctx, op.(*operation), err)
+	}
+
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, evt *event.CommandStartedEvent) {
+			collection, _ := evt.Command.Lookup(evt.CommandName).StringValueOK()
+
+			attrs := []attribute.KeyValue{semconv.DBNamespace(evt.DatabaseName)}
+			if collection != "" {
+				attrs = append(attrs, semconv.DBCollectionName(collection))
+			}
+			attrs = append(attrs, mongoServerAttrs(evt.ConnectionID)...)
+
+			_, op := t.startOperation(ctx, semconv.DBSystemNameMongoDB, evt.CommandName, collection, "", attrs...)
+			ops.Store(evt.RequestID, op)
+		},
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			finish(ctx, evt.RequestID, nil)
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			finish(ctx, evt.RequestID, evt.Failure)
+		},
+	}
+}
+
+// mongoServerAttrs reads the server out of the driver's connection id, "host:port[-1]"
+func mongoServerAttrs(connID string) []attribute.KeyValue {
+	addr, _, _ := strings.Cut(connID, "[")
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return serverAttrs(addr, 0)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return serverAttrs(host, 0)
+	}
+
+	return serverAttrs(host, p)
+}
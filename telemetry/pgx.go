@@ -0,0 +1,79 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"weak"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+)
+
+type pgxOperationKey struct{}
+
+type pgxTracer struct {
+	t *Telemetry
+}
+
+// PgxTracer is a pgx QueryTracer, set it on the ConnConfig before connecting
+func (t *Telemetry) PgxTracer() pgx.QueryTracer {
+	return &pgxTracer{t: t}
+}
+
+func (p *pgxTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	var attrs []attribute.KeyValue
+	if conn != nil {
+		cfg := conn.Config()
+		attrs = append(attrs, semconv.DBNamespace(cfg.Database))
+		attrs = append(attrs, serverAttrs(cfg.Host, int(cfg.Port))...)
+	}
+
+	ctx, op := p.t.startOperation(ctx, semconv.DBSystemNamePostgreSQL, operationName(data.SQL), "", data.SQL, attrs...)
+
+	return context.WithValue(ctx, pgxOperationKey{}, op)
+}
+
+func (p *pgxTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	op, ok := ctx.Value(pgxOperationKey{}).(*operation)
+	if !ok {
+		return
+	}
+
+	p.t.end(ctx, op, data.Err)
+}
+
+// ObservePgxPool reports the pool's used, idle and max connections named after its server and database,
+// it only holds a weak reference so a pool that is dropped without unregistering stops being reported once it is collected
+func (t *Telemetry) ObservePgxPool(pool *pgxpool.Pool) (metric.Registration, error) {
+	cfg := pool.Config().ConnConfig
+	name := t.poolName(fmt.Sprintf("%s:%d/%s", cfg.Host, cfg.Port, cfg.Database))
+	wp := weak.Make(pool)
+
+	reg, err := t.meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		p := wp.Value()
+		if p == nil {
+			return nil
+		}
+
+		stat := p.Stat()
+		t.observeConnections(o, semconv.DBSystemNamePostgreSQL, name, int64(stat.AcquiredConns()), int64(stat.IdleConns()), int64(stat.MaxConns()))
+		return nil
+	}, t.connCount.Inst(), t.connMax.Inst())
+	if err != nil {
+		return nil, logs.Errorf("telemetry: unable to observe pool: %v", err)
+	}
+
+	return reg, nil
+}
+
+func (t *Telemetry) observeConnections(o metric.Observer, system attribute.KeyValue, name string, used, idle, maxConns int64) {
+	pool := semconv.DBClientConnectionPoolName(name)
+
+	o.ObserveInt64(t.connCount.Inst(), used, metric.WithAttributes(system, pool, semconv.DBClientConnectionStateUsed))
+	o.ObserveInt64(t.connCount.Inst(), idle, metric.WithAttributes(system, pool, semconv.DBClientConnectionStateIdle))
+	o.ObserveInt64(t.connMax.Inst(), maxConns, metric.WithAttributes(system, pool))
+}
@@ -0,0 +1,331 @@
+package telemetry
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"time"
+	"weak"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// OpenDB is sql.Open with every connection traced, system is the db.system.name attribute and attrs
+// (db.namespace, server.address, server.port) go on every span
+func (t *Telemetry) OpenDB(driverName, dataSource string, system attribute.KeyValue, attrs ...attribute.KeyValue) (*sql.DB, error) {
+	c, err := t.OpenConnector(driverName, dataSource, system, attrs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return sql.OpenDB(c), nil
+}
+
+// OpenConnector is the traced connector OpenDB opens its handle with
+func (t *Telemetry) OpenConnector(driverName, dataSource string, system attribute.KeyValue, attrs ...attribute.KeyValue) (driver.Connector, error) {
+	db, err := sql.Open(driverName, dataSource)
+	if err != nil {
+		return nil, logs.Errorf("telemetry: unable to open %s: %v", driverName, err)
+	}
+	drv := db.Driver()
+	_ = db.Close()
+
+	var c driver.Connector = dsnConnector{dsn: dataSource, driver: drv}
+	if dc, ok := drv.(driver.DriverContext); ok {
+		if c, err = dc.OpenConnector(dataSource); err != nil {
+			return nil, logs.Errorf("telemetry: unable to open %s connector: %v", driverName, err)
+		}
+	}
+
+	return t.WrapConnector(c, system, attrs...), nil
+}
+
+// WrapConnector traces the queries and execs on every connection the connector makes
+func (t *Telemetry) WrapConnector(c driver.Connector, system attribute.KeyValue, attrs ...attribute.KeyValue) driver.Connector {
+	return &connector{Connector: c, t: t, system: system, attrs: attrs}
+}
+
+// ObserveSQLDB reports the handle's used, idle and max connections as pool name, like ObservePgxPool
+// it only holds a weak reference to the handle
+func (t *Telemetry) ObserveSQLDB(db *sql.DB, name string, system attribute.KeyValue) (metric.Registration, error) {
+	wp := weak.Make(db)
+	name = t.poolName(name)
+
+	reg, err := t.meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		db := wp.Value()
+		if db == nil {
+			return nil
+		}
+
+		stats := db.Stats()
+		t.observeConnections(o, system, name, int64(stats.InUse), int64(stats.Idle), int64(stats.MaxOpenConnections))
+		return nil
+	}, t.connCount.Inst(), t.connMax.Inst())
+	if err != nil {
+		return nil, logs.Errorf("telemetry: unable to observe sql db: %v", err)
+	}
+
+	return reg, nil
+}
+
+// OpenObservedDB opens a handle on the connector and reports it like ObserveSQLDB,
+// the registration is dropped when the handle is closed so handles opened per call don't pile up
+func (t *Telemetry) OpenObservedDB(c driver.Connector, name string, system attribute.KeyValue) (*sql.DB, error) {
+	oc := &observedConnector{Connector: c}
+	db := sql.OpenDB(oc)
+	reg, err := t.ObserveSQLDB(db, name, system)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	oc.reg = reg
+
+	return db, nil
+}
+
+// observedConnector unregisters the pool metrics when database/sql closes it along with the handle
+type observedConnector struct {
+	driver.Connector
+	reg metric.Registration
+}
+
+func (o *observedConnector) Close() error {
+	var err error
+	if o.reg != nil {
+		if err = o.reg.Unregister(); err != nil {
+			err = logs.Errorf("telemetry: unable to stop sql db metrics: %v", err)
+		}
+	}
+	if c, ok := o.Connector.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// dsnConnector is for drivers that predate driver.DriverContext
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (d dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return d.driver.Open(d.dsn)
+}
+
+func (d dsnConnector) Driver() driver.Driver {
+	return d.driver
+}
+
+type connector struct {
+	driver.Connector
+	t      *Telemetry
+	system attribute.KeyValue
+	attrs  []attribute.KeyValue
+}
+
+// Close closes the wrapped connector for drivers that hold resources on it
+func (c *connector) Close() error {
+	if cl, ok := c.Connector.(io.Closer); ok {
+		return cl.Close()
+	}
+
+	return nil
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlConn{Conn: conn, c: c}, nil
+}
+
+func (c *connector) start(ctx context.Context, query string) (context.Context, *operation) {
+	return c.t.startOperation(ctx, c.system, operationName(query), "", query, c.attrs...)
+}
+
+// record traces a direct query or exec once the driver has run it, the driver can still answer driver.ErrSkip
+// and that must not leave a span or duration behind
+func (c *connector) record(ctx context.Context, start time.Time, query string, err error) {
+	ctx, op := c.t.startOperationAt(ctx, start, c.system, operationName(query), "", query, c.attrs...)
+	c.t.end(ctx, op, err)
+}
+
+// sqlConn passes through everything the driver's conn supports, returning driver.ErrSkip where it doesn't
+// so database/sql falls back the same way it would without the wrapper
+type sqlConn struct {
+	driver.Conn
+	c *connector
+}
+
+func (s *sqlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := s.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	if err == driver.ErrSkip {
+		// database/sql retries through a prepared statement, which gets its own span
+		return nil, err
+	}
+	s.c.record(ctx, start, query, err)
+
+	return rows, err
+}
+
+func (s *sqlConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := s.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	res, err := e.ExecContext(ctx, query, args)
+	if err == driver.ErrSkip {
+		return nil, err
+	}
+	s.c.record(ctx, start, query, err)
+
+	return res, err
+}
+
+func (s *sqlConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var (
+		stmt driver.Stmt
+		err  error
+	)
+	if p, ok := s.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = s.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlStmt{Stmt: stmt, c: s.c, query: query}, nil
+}
+
+func (s *sqlConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := s.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) || opts.ReadOnly {
+		return nil, logs.Error("telemetry: unable to set transaction options on a driver without BeginTx")
+	}
+
+	return s.Conn.Begin()
+}
+
+func (s *sqlConn) Ping(ctx context.Context) error {
+	if p, ok := s.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+
+	return nil
+}
+
+func (s *sqlConn) ResetSession(ctx context.Context) error {
+	if r, ok := s.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+func (s *sqlConn) IsValid() bool {
+	if v, ok := s.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+
+	return true
+}
+
+func (s *sqlConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if c, ok := s.Conn.(driver.NamedValueChecker); ok {
+		return c.CheckNamedValue(nv)
+	}
+
+	return driver.ErrSkip
+}
+
+type sqlStmt struct {
+	driver.Stmt
+	c     *connector
+	query string
+}
+
+func (s *sqlStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	ctx, op := s.c.start(ctx, s.query)
+	var (
+		res driver.Result
+		err error
+	)
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = e.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValues(args); err == nil {
+			res, err = s.Stmt.Exec(values)
+		}
+	}
+	s.c.t.end(ctx, op, err)
+
+	return res, err
+}
+
+func (s *sqlStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	ctx, op := s.c.start(ctx, s.query)
+	var (
+		rows driver.Rows
+		err  error
+	)
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValues(args); err == nil {
+			rows, err = s.Stmt.Query(values)
+		}
+	}
+	s.c.t.end(ctx, op, err)
+
+	return rows, err
+}
+
+func (s *sqlStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	switch c := s.Stmt.(type) {
+	case driver.NamedValueChecker:
+		return c.CheckNamedValue(nv)
+	case driver.ColumnConverter:
+		v, err := c.ColumnConverter(nv.Ordinal - 1).ConvertValue(nv.Value)
+		if err != nil {
+			return err
+		}
+		nv.Value = v
+		return nil
+	}
+
+	return driver.ErrSkip
+}
+
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, logs.Error("telemetry: unable to use named arguments with this driver")
+		}
+		values[i] = arg.Value
+	}
+
+	return values, nil
+}
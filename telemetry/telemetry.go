@@ -0,0 +1,155 @@
+// Package telemetry traces and measures the database clients with OpenTelemetry using the database semantic conventions,
+// build one with New and hand it to config.WithTelemetry or set it on a subsystem's Telemetry field
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/semconv/v1.41.0/dbconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const ScopeName = "github.com/keloran/go-config/telemetry"
+
+type Telemetry struct {
+	tracer trace.Tracer
+	meter  metric.Meter
+
+	duration  dbconv.ClientOperationDuration
+	connCount dbconv.ClientConnectionCountObservable
+	connMax   dbconv.ClientConnectionMaxObservable
+
+	mu    sync.Mutex
+	names map[string]int
+}
+
+// New uses the global providers for whichever of tp and mp is nil
+func New(tp trace.TracerProvider, mp metric.MeterProvider) (*Telemetry, error) {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+
+	t := &Telemetry{
+		tracer: tp.Tracer(ScopeName),
+		meter:  mp.Meter(ScopeName),
+		names:  make(map[string]int),
+	}
+
+	var err error
+	if t.duration, err = dbconv.NewClientOperationDuration(t.meter); err != nil {
+		return nil, logs.Errorf("telemetry: unable to create operation duration: %v", err)
+	}
+	if t.connCount, err = dbconv.NewClientConnectionCountObservable(t.meter); err != nil {
+		return nil, logs.Errorf("telemetry: unable to create connection count: %v", err)
+	}
+	if t.connMax, err = dbconv.NewClientConnectionMaxObservable(t.meter); err != nil {
+		return nil, logs.Errorf("telemetry: unable to create connection max: %v", err)
+	}
+
+	return t, nil
+}
+
+// poolName keeps pool names unique, pools to the same database after the first are numbered, e.g. "db:5432/orders#2"
+func (t *Telemetry) poolName(name string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.names[name]++
+	if n := t.names[name]; n > 1 {
+		return fmt.Sprintf("%s#%d", name, n)
+	}
+
+	return name
+}
+
+// operation is one database call, attrs go on both the span and the duration metric, the query text only on the span
+type operation struct {
+	start time.Time
+	span  trace.Span
+	attrs []attribute.KeyValue
+}
+
+// startOperation opens a client span named "{operation} {target}", falling back to the system name
+func (t *Telemetry) startOperation(ctx context.Context, system attribute.KeyValue, name, target, query string, attrs ...attribute.KeyValue) (context.Context, *operation) {
+	return t.startOperationAt(ctx, time.Now(), system, name, target, query, attrs...)
+}
+
+// startOperationAt is startOperation for a call that began at start, so the span can be opened once the call has run
+func (t *Telemetry) startOperationAt(ctx context.Context, start time.Time, system attribute.KeyValue, name, target, query string, attrs ...attribute.KeyValue) (context.Context, *operation) {
+	attrs = append([]attribute.KeyValue{system}, attrs...)
+	if name != "" {
+		attrs = append(attrs, semconv.DBOperationName(name))
+	}
+
+	spanName := strings.TrimSpace(name + " " + target)
+	if spanName == "" {
+		spanName = system.Value.AsString()
+	}
+
+	spanAttrs := attrs
+	if query != "" {
+		spanAttrs = append(attrs[:len(attrs):len(attrs)], semconv.DBQueryText(query))
+	}
+
+	ctx, span := t.tracer.Start(ctx, spanName, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(spanAttrs...), trace.WithTimestamp(start))
+
+	return ctx, &operation{
+		start: start,
+		span:  span,
+		attrs: attrs,
+	}
+}
+
+// end records the error and the duration and ends the span
+func (t *Telemetry) end(ctx context.Context, op *operation, err error) {
+	if err != nil {
+		errType := semconv.ErrorType(err)
+		op.attrs = append(op.attrs, errType)
+		op.span.SetAttributes(errType)
+		op.span.RecordError(err)
+		op.span.SetStatus(codes.Error, err.Error())
+	}
+
+	t.duration.Inst().Record(ctx, time.Since(op.start).Seconds(), metric.WithAttributes(op.attrs...))
+	op.span.End()
+}
+
+// operationName is the first keyword of a query, e.g. SELECT, with an empty name for anything that doesn't start with one
+func operationName(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return ""
+	}
+	for _, r := range fields[0] {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return ""
+		}
+	}
+
+	return strings.ToUpper(fields[0])
+}
+
+// serverAttrs are server.address and server.port, the port is left off for unix sockets
+func serverAttrs(host string, port int) []attribute.KeyValue {
+	if host == "" {
+		return nil
+	}
+	if strings.HasPrefix(host, "/") || port == 0 {
+		return []attribute.KeyValue{semconv.ServerAddress(host)}
+	}
+
+	return []attribute.KeyValue{semconv.ServerAddress(host), semconv.ServerPort(port)}
+}
@@ -0,0 +1,315 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/hashicorp/vault/api"
+	vaultHelper "github.com/keloran/vault-helper"
+)
+
+// SecretVersion is the KV metadata of a secret that was loaded, version is 0 for KV v1 secrets
+type SecretVersion struct {
+	Path        string
+	Version     int
+	CreatedTime time.Time
+}
+
+// VersionedHelper is implemented by helpers that know the metadata of the secrets they read,
+// VersionOf answers for one path so a read on another goroutine can't swap it
+type VersionedHelper interface {
+	LastVersion() (SecretVersion, bool)
+	VersionOf(path string) (SecretVersion, bool)
+}
+
+// WithVersion pins a KV v2 path to a specific secret version
+func WithVersion(path string, version int) string {
+	p, _, _ := ParseVersionedPath(path)
+	if version <= 0 {
+		return p
+	}
+
+	return fmt.Sprintf("%s?version=%d", p, version)
+}
+
+// ParseVersionedPath splits "secret/data/app/details?version=7" into the path and the pinned version
+func ParseVersionedPath(path string) (string, int, error) {
+	p, query, found := strings.Cut(path, "?")
+	if !found {
+		return path, 0, nil
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return p, 0, logs.Errorf("vault: unable to parse path query: %v", err)
+	}
+	if values.Get("version") == "" {
+		return p, 0, nil
+	}
+
+	version, err := strconv.Atoi(values.Get("version"))
+	if err != nil || version < 0 {
+		return p, 0, logs.Errorf("vault: unable to parse version: %s", values.Get("version"))
+	}
+
+	return p, version, nil
+}
+
+// Helper is the vault-helper Vault with support for pinned KV v2 versions and secret metadata
+type Helper struct {
+	*vaultHelper.Vault
+
+	client *api.Client
+
+	// mu guards last and versions, they are written by reads on refresh goroutines and read by recorders on others
+	mu   sync.Mutex
+	last *SecretVersion
+	// versions is keyed by the path as it was asked for, pin included
+	versions map[string]SecretVersion
+}
+
+func NewHelper(address, token string) (*Helper, error) {
+	cfg := api.DefaultConfig()
+	cfg.Address = address
+	// retries belong to Resilient so the policy is in one place
+	cfg.MaxRetries = 0
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, logs.Errorf("vault: unable to create client: %v", err)
+	}
+
+	v := vaultHelper.NewVault(address, token)
+	v.Client = &vaultHelper.RealVaultClient{Client: client}
+
+	return &Helper{
+		Vault:  v,
+		client: client,
+	}, nil
+}
+
+// Client is the underlying vault api client, used by the engines that go past KV reads
+func (h *Helper) Client() *api.Client {
+	return h.client
+}
+
+func (h *Helper) context() context.Context {
+	if h.Vault.Context != nil {
+		return h.Vault.Context
+	}
+
+	return context.Background()
+}
+
+func (h *Helper) GetSecrets(path string) error {
+	if strings.HasPrefix(path, ".") || strings.HasPrefix(path, "/") {
+		h.setLast(path, nil)
+		return h.Vault.GetLocalSecrets(path)
+	}
+
+	return h.GetRemoteSecrets(path)
+}
+
+func (h *Helper) GetRemoteSecrets(path string) error {
+	h.setLast(path, nil)
+
+	p, version, err := ParseVersionedPath(path)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return logs.Errorf("path: %s, err: %s", path, "no path provided")
+	}
+
+	var query map[string][]string
+	if version > 0 {
+		query = map[string][]string{"version": {strconv.Itoa(version)}}
+	}
+
+	h.client.SetToken(h.Token)
+	secret, err := h.client.Logical().ReadWithDataWithContext(h.context(), p, query)
+	if err != nil {
+		return logs.Errorf("path: %s, err: %v", path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return logs.Errorf("path: %s, err: %s", path, "no data returned")
+	}
+
+	if secret.LeaseDuration != 0 {
+		h.Lease = secret.LeaseDuration
+	}
+
+	payload := secret.Data
+	meta := SecretVersion{Path: p}
+	if inner, ok := secret.Data["data"].(map[string]interface{}); ok {
+		payload = inner
+		if m, ok := secret.Data["metadata"].(map[string]interface{}); ok {
+			meta = parseMetadata(p, m)
+		}
+	}
+
+	secrets, err := vaultHelper.ParseData(payload, "")
+	if err != nil {
+		return logs.Errorf("path: %s, err: %v", path, err)
+	}
+
+	h.KVSecrets = secrets
+	h.setLast(path, &meta)
+
+	return nil
+}
+
+func (h *Helper) setLast(path string, sv *SecretVersion) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.last = sv
+	if sv == nil {
+		delete(h.versions, path)
+		return
+	}
+	if h.versions == nil {
+		h.versions = make(map[string]SecretVersion)
+	}
+	h.versions[path] = *sv
+}
+
+func (h *Helper) LastVersion() (SecretVersion, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.last == nil {
+		return SecretVersion{}, false
+	}
+
+	return *h.last, true
+}
+
+func (h *Helper) VersionOf(path string) (SecretVersion, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sv, ok := h.versions[path]
+	return sv, ok
+}
+
+func parseMetadata(path string, m map[string]interface{}) SecretVersion {
+	sv := SecretVersion{Path: path}
+
+	switch v := m["version"].(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			sv.Version = int(i)
+		}
+	case float64:
+		sv.Version = int(v)
+	case string:
+		if i, err := strconv.Atoi(v); err == nil {
+			sv.Version = i
+		}
+	}
+
+	if ct, ok := m["created_time"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ct); err == nil {
+			sv.CreatedTime = t
+		}
+	}
+
+	return sv
+}
+
+// Recorder wraps a VaultHelper and keeps the version of every secret path read through it
+type Recorder struct {
+	vaultHelper.VaultHelper
+
+	mu       sync.Mutex
+	versions map[string]SecretVersion
+}
+
+func NewRecorder(vh vaultHelper.VaultHelper) *Recorder {
+	return &Recorder{
+		VaultHelper: vh,
+		versions:    make(map[string]SecretVersion),
+	}
+}
+
+func (r *Recorder) GetSecrets(path string) error {
+	if err := r.VaultHelper.GetSecrets(path); err != nil {
+		return err
+	}
+
+	r.record(path)
+	return nil
+}
+
+func (r *Recorder) GetRemoteSecrets(path string) error {
+	if err := r.VaultHelper.GetRemoteSecrets(path); err != nil {
+		return err
+	}
+
+	r.record(path)
+	return nil
+}
+
+func (r *Recorder) record(path string) {
+	p, _, _ := ParseVersionedPath(path)
+	sv := SecretVersion{Path: p}
+	if vh, ok := r.VaultHelper.(VersionedHelper); ok {
+		if read, ok := vh.VersionOf(path); ok {
+			sv = read
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.versions[p] = sv
+}
+
+// Versions returns the secrets loaded so far, sorted by path
+func (r *Recorder) Versions() []SecretVersion {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions := make([]SecretVersion, 0, len(r.versions))
+	for _, sv := range r.versions {
+		versions = append(versions, sv)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Path < versions[j].Path
+	})
+
+	return versions
+}
+
+// APIClient digs the vault api client out of a helper, unwrapping recorders,
+// for the engines that need more than KV reads
+func APIClient(vh vaultHelper.VaultHelper) (*api.Client, bool) {
+	switch h := vh.(type) {
+	case *Recorder:
+		return APIClient(h.VaultHelper)
+	case *Resilient:
+		return APIClient(h.VaultHelper)
+	case *Helper:
+		if h.client == nil {
+			return nil, false
+		}
+		h.client.SetToken(h.Token)
+		return h.client, true
+	case *vaultHelper.Vault:
+		rc, ok := h.Client.(*vaultHelper.RealVaultClient)
+		if !ok || rc.Client == nil {
+			return nil, false
+		}
+		rc.Client.SetToken(h.Token)
+		return rc.Client, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,172 @@
+package vault
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	vaultHelper "github.com/keloran/vault-helper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func kvServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		latest := map[string]string{
+			"/v1/secret/data/app/details": "8",
+			"/v1/secret/data/app/other":   "3",
+		}[r.URL.Path]
+		if latest == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		version := r.URL.Query().Get("version")
+		if version == "" {
+			version = latest
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"lease_duration":0,"data":{"data":{"rds-hostname":"host-v%s"},"metadata":{"created_time":"2024-05-01T10:00:00.123456Z","deletion_time":"","destroyed":false,"version":%s}}}`, version, version)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestParseVersionedPath(t *testing.T) {
+	p, v, err := ParseVersionedPath("secret/data/app/details?version=7")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret/data/app/details", p)
+	assert.Equal(t, 7, v)
+
+	p, v, err = ParseVersionedPath("secret/data/app/details")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret/data/app/details", p)
+	assert.Equal(t, 0, v)
+
+	_, _, err = ParseVersionedPath("secret/data/app/details?version=latest")
+	assert.Error(t, err)
+
+	assert.Equal(t, "secret/data/app/details?version=3", WithVersion("secret/data/app/details?version=7", 3))
+}
+
+func TestHelperVersions(t *testing.T) {
+	srv := kvServer(t)
+	h, err := NewHelper(srv.URL, "root")
+	require.NoError(t, err)
+
+	t.Run("latest", func(t *testing.T) {
+		require.NoError(t, h.GetSecrets("secret/data/app/details"))
+		host, err := h.GetSecret("rds-hostname")
+		assert.NoError(t, err)
+		assert.Equal(t, "host-v8", host)
+
+		_, err = h.GetSecret("created_time")
+		assert.Error(t, err, "metadata should not leak into the secrets")
+
+		sv, ok := h.LastVersion()
+		assert.True(t, ok)
+		assert.Equal(t, 8, sv.Version)
+		assert.Equal(t, time.Date(2024, 5, 1, 10, 0, 0, 123456000, time.UTC), sv.CreatedTime)
+	})
+
+	t.Run("pinned", func(t *testing.T) {
+		require.NoError(t, h.GetSecrets("secret/data/app/details?version=7"))
+		host, err := h.GetSecret("rds-hostname")
+		assert.NoError(t, err)
+		assert.Equal(t, "host-v7", host)
+
+		sv, _ := h.LastVersion()
+		assert.Equal(t, 7, sv.Version)
+		assert.Equal(t, "secret/data/app/details", sv.Path)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		assert.Error(t, h.GetSecrets("secret/data/app/missing"))
+		_, ok := h.LastVersion()
+		assert.False(t, ok)
+	})
+}
+
+func TestNewHelperErrors(t *testing.T) {
+	_, err := NewHelper("://vault", "root")
+	assert.Error(t, err)
+
+	t.Setenv("VAULT_CACERT", "/nonexistent/ca.pem")
+	_, err = NewHelper("https://vault.internal", "root")
+	assert.Error(t, err)
+}
+
+func TestHelperLastVersionConcurrent(t *testing.T) {
+	srv := kvServer(t)
+	h, err := NewHelper(srv.URL, "root")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			_ = h.GetSecrets("secret/data/app/details")
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			sv, ok := h.LastVersion()
+			assert.True(t, ok)
+			assert.Equal(t, 8, sv.Version)
+			return
+		default:
+			_, _ = h.LastVersion()
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	srv := kvServer(t)
+	h, err := NewHelper(srv.URL, "root")
+	require.NoError(t, err)
+	rec := NewRecorder(h)
+
+	require.NoError(t, rec.GetSecrets("secret/data/app/details?version=7"))
+	assert.Equal(t, []SecretVersion{{
+		Path:        "secret/data/app/details",
+		Version:     7,
+		CreatedTime: time.Date(2024, 5, 1, 10, 0, 0, 123456000, time.UTC),
+	}}, rec.Versions())
+
+	mock := NewRecorder(&vaultHelper.MockVaultHelper{})
+	require.NoError(t, mock.GetSecrets("tester"))
+	assert.Equal(t, []SecretVersion{{Path: "tester"}}, mock.Versions())
+}
+
+// interleavedHelper reads another path straight after every read, the way a refresh on another goroutine can
+type interleavedHelper struct {
+	*Helper
+	other string
+}
+
+func (h *interleavedHelper) GetSecrets(path string) error {
+	if err := h.Helper.GetSecrets(path); err != nil {
+		return err
+	}
+
+	return h.Helper.GetSecrets(h.other)
+}
+
+func TestRecorderInterleavedRead(t *testing.T) {
+	srv := kvServer(t)
+	h, err := NewHelper(srv.URL, "root")
+	require.NoError(t, err)
+	rec := NewRecorder(&interleavedHelper{Helper: h, other: "secret/data/app/other"})
+
+	require.NoError(t, rec.GetSecrets("secret/data/app/details"))
+	versions := rec.Versions()
+	require.Len(t, versions, 1)
+	assert.Equal(t, "secret/data/app/details", versions[0].Path)
+	assert.Equal(t, 8, versions[0].Version, "the version is the one read for the path, not the read that came after")
+}
@@ -0,0 +1,344 @@
+package pki
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/caarlos0/env/v8"
+	"github.com/hashicorp/vault/api"
+)
+
+const minRotateWait = time.Second
+
+// Logical is the part of the vault api the pki engine needs
+type Logical interface {
+	WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*api.Secret, error)
+}
+
+type Details struct {
+	Mount      string        `env:"VAULT_PKI_MOUNT" envDefault:"pki"`
+	Role       string        `env:"VAULT_PKI_ROLE"`
+	CommonName string        `env:"VAULT_PKI_COMMON_NAME"`
+	AltNames   []string      `env:"VAULT_PKI_ALT_NAMES" envSeparator:","`
+	IPSANs     []string      `env:"VAULT_PKI_IP_SANS" envSeparator:","`
+	TTL        time.Duration `env:"VAULT_PKI_TTL" envDefault:"24h"`
+
+	// RotateFraction is how far through a certificate's lifetime it gets replaced
+	RotateFraction float64       `env:"VAULT_PKI_ROTATE_FRACTION" envDefault:"0.66"`
+	RetryInterval  time.Duration `env:"VAULT_PKI_RETRY_INTERVAL" envDefault:"30s"`
+}
+
+type System struct {
+	Context context.Context
+
+	Details
+
+	Logical Logical
+
+	state *certState
+}
+
+// certState sits behind a pointer so the System can be copied into the config
+type certState struct {
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	leaf   *x509.Certificate
+	pool   *x509.CertPool
+	cancel context.CancelFunc
+}
+
+func NewSystem() *System {
+	return &System{
+		Context: context.Background(),
+		state:   &certState{},
+	}
+}
+
+func (s *System) Setup(client *api.Client) {
+	s.Logical = client.Logical()
+}
+
+// Build issues the first certificate and starts rotating it in the background until Stop or the system context ends
+func (s *System) Build() (*Details, error) {
+	pk := &Details{}
+	if err := env.Parse(pk); err != nil {
+		return nil, logs.Errorf("pki: unable to parse env: %v", err)
+	}
+
+	if s.Details.Mount != "" {
+		pk.Mount = s.Details.Mount
+	}
+	if s.Details.Role != "" {
+		pk.Role = s.Details.Role
+	}
+	if s.Details.CommonName != "" {
+		pk.CommonName = s.Details.CommonName
+	}
+	if len(s.Details.AltNames) > 0 {
+		pk.AltNames = s.Details.AltNames
+	}
+	if len(s.Details.IPSANs) > 0 {
+		pk.IPSANs = s.Details.IPSANs
+	}
+	if s.Details.TTL != 0 {
+		pk.TTL = s.Details.TTL
+	}
+	if s.Details.RotateFraction != 0 {
+		pk.RotateFraction = s.Details.RotateFraction
+	}
+	if s.Details.RetryInterval != 0 {
+		pk.RetryInterval = s.Details.RetryInterval
+	}
+
+	if pk.Role == "" {
+		return nil, logs.Error("pki: unable to use empty role")
+	}
+	if pk.CommonName == "" {
+		return nil, logs.Error("pki: unable to use empty common name")
+	}
+	if pk.RotateFraction <= 0 || pk.RotateFraction >= 1 {
+		return nil, logs.Errorf("pki: unable to use rotate fraction: %v", pk.RotateFraction)
+	}
+	if s.Logical == nil {
+		return nil, logs.Error("pki: unable to build without a vault client")
+	}
+	if s.state == nil {
+		s.state = &certState{}
+	}
+	if s.Context == nil {
+		s.Context = context.Background()
+	}
+
+	s.Details = *pk
+	if err := s.Issue(s.Context); err != nil {
+		return nil, err
+	}
+	s.start()
+
+	return pk, nil
+}
+
+// Issue requests a new leaf certificate and swaps it in for every tls config handed out
+func (s *System) Issue(ctx context.Context) error {
+	data := map[string]interface{}{
+		"common_name": s.CommonName,
+		"ttl":         s.TTL.String(),
+	}
+	if len(s.AltNames) > 0 {
+		data["alt_names"] = strings.Join(s.AltNames, ",")
+	}
+	if len(s.IPSANs) > 0 {
+		data["ip_sans"] = strings.Join(s.IPSANs, ",")
+	}
+
+	secret, err := s.Logical.WriteWithContext(ctx, fmt.Sprintf("%s/issue/%s", strings.Trim(s.Mount, "/"), s.Role), data)
+	if err != nil {
+		return logs.Errorf("pki: unable to issue certificate: %v", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return logs.Error("pki: unable to issue certificate: no data returned")
+	}
+
+	certPEM, _ := secret.Data["certificate"].(string)
+	keyPEM, _ := secret.Data["private_key"].(string)
+	if certPEM == "" || keyPEM == "" {
+		return logs.Error("pki: unable to find certificate or private key in response")
+	}
+
+	chain := []string{certPEM}
+	pool := x509.NewCertPool()
+	if cas, ok := secret.Data["ca_chain"].([]interface{}); ok && len(cas) > 0 {
+		for _, ca := range cas {
+			if pem, ok := ca.(string); ok {
+				chain = append(chain, pem)
+				pool.AppendCertsFromPEM([]byte(pem))
+			}
+		}
+	} else if ca, ok := secret.Data["issuing_ca"].(string); ok {
+		chain = append(chain, ca)
+		pool.AppendCertsFromPEM([]byte(ca))
+	}
+
+	cert, err := tls.X509KeyPair([]byte(strings.Join(chain, "\n")), []byte(keyPEM))
+	if err != nil {
+		return logs.Errorf("pki: unable to parse key pair: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return logs.Errorf("pki: unable to parse certificate: %v", err)
+	}
+	cert.Leaf = leaf
+
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.cert = &cert
+	s.state.leaf = leaf
+	s.state.pool = pool
+
+	return nil
+}
+
+// Certificate is the current leaf certificate
+func (s *System) Certificate() *tls.Certificate {
+	s.state.mu.RLock()
+	defer s.state.mu.RUnlock()
+
+	return s.state.cert
+}
+
+// CAPool holds the issuing chain of the current certificate
+func (s *System) CAPool() *x509.CertPool {
+	s.state.mu.RLock()
+	defer s.state.mu.RUnlock()
+
+	return s.state.pool
+}
+
+// ServerTLSConfig serves the current certificate and requires clients to present one from the same CA
+func (s *System) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert := s.Certificate(); cert != nil {
+				return cert, nil
+			}
+			return nil, logs.Error("pki: unable to serve without a certificate")
+		},
+		// the chain is checked by VerifyConnection against the pool at handshake time
+		ClientAuth:       tls.RequireAnyClientCert,
+		VerifyConnection: s.verifyPeer(x509.ExtKeyUsageClientAuth, nil),
+	}
+}
+
+// ClientTLSConfig presents the current certificate and trusts servers from the same CA,
+// set ServerName on it before dialing an IP since the handshake doesn't carry IPs as a server name
+func (s *System) ClientTLSConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := s.Certificate(); cert != nil {
+				return cert, nil
+			}
+			return nil, logs.Error("pki: unable to present without a certificate")
+		},
+		// RootCAs would pin the pool the config was made with, so the chain and name are
+		// checked by VerifyConnection against the pool at handshake time instead
+		InsecureSkipVerify: true,
+	}
+	cfg.VerifyConnection = s.verifyPeer(x509.ExtKeyUsageServerAuth, func() string {
+		return cfg.ServerName
+	})
+
+	return cfg
+}
+
+// verifyPeer checks the peer chain against the current CA pool, so a config made before a CA rotation trusts the new CA,
+// serverName is the name the config was given, the connection state has none when an IP was dialed
+func (s *System) verifyPeer(usage x509.ExtKeyUsage, serverName func() string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return logs.Error("pki: unable to verify peer without a certificate")
+		}
+		pool := s.CAPool()
+		if pool == nil {
+			return logs.Error("pki: unable to verify peer without a ca pool")
+		}
+
+		opts := x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{usage},
+		}
+		if usage == x509.ExtKeyUsageServerAuth {
+			name := cs.ServerName
+			if name == "" && serverName != nil {
+				name = serverName()
+			}
+			if name == "" {
+				return logs.Error("pki: unable to verify server without a server name")
+			}
+			// x509 matches an IP here against the IP SANs
+			opts.DNSName = name
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+			return logs.Errorf("pki: unable to verify peer certificate: %v", err)
+		}
+
+		return nil
+	}
+}
+
+// rotateIn is how long until the current certificate reaches the rotate fraction of its lifetime
+func (s *System) rotateIn(now time.Time) time.Duration {
+	s.state.mu.RLock()
+	leaf := s.state.leaf
+	s.state.mu.RUnlock()
+	if leaf == nil {
+		return 0
+	}
+
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	at := leaf.NotBefore.Add(time.Duration(float64(lifetime) * s.RotateFraction))
+	if wait := at.Sub(now); wait > minRotateWait {
+		return wait
+	}
+
+	return minRotateWait
+}
+
+func (s *System) start() {
+	ctx, cancel := context.WithCancel(s.Context)
+
+	s.state.mu.Lock()
+	if s.state.cancel != nil {
+		s.state.cancel()
+	}
+	s.state.cancel = cancel
+	s.state.mu.Unlock()
+
+	go s.rotate(ctx)
+}
+
+func (s *System) rotate(ctx context.Context) {
+	timer := time.NewTimer(s.rotateIn(time.Now()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		wait := s.RetryInterval
+		if err := s.Issue(ctx); err != nil {
+			_ = logs.Errorf("pki: unable to rotate certificate, retrying in %v: %v", wait, err)
+		} else {
+			wait = s.rotateIn(time.Now())
+		}
+		timer.Reset(wait)
+	}
+}
+
+// Stop ends background rotation, the current certificate stays in use
+func (s *System) Stop() {
+	if s.state == nil {
+		return
+	}
+
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	if s.state.cancel != nil {
+		s.state.cancel()
+		s.state.cancel = nil
+	}
+}
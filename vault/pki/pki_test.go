@@ -0,0 +1,266 @@
+package pki
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCA issues real certificates the way pki/issue/<role> does
+type fakeCA struct {
+	t      *testing.T
+	mu     sync.Mutex
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    string
+	serial int64
+	paths  []string
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	t.Helper()
+
+	f := &fakeCA{t: t, serial: 1}
+	f.rotateCA()
+
+	return f
+}
+
+// rotateCA swaps in a new root, certificates issued after this chain to it
+func (f *fakeCA) rotateCA() {
+	t := f.t
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cert = cert
+	f.key = key
+	f.pem = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func (f *fakeCA) WriteWithContext(_ context.Context, path string, data map[string]interface{}) (*api.Secret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, path)
+	f.serial++
+
+	ttl, err := time.ParseDuration(data["ttl"].(string))
+	require.NoError(f.t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(f.t, err)
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(f.serial),
+		Subject:      pkix.Name{CommonName: data["common_name"].(string)},
+		DNSNames:     []string{data["common_name"].(string)},
+		NotBefore:    now,
+		NotAfter:     now.Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ips, ok := data["ip_sans"].(string); ok {
+		for _, ip := range strings.Split(ips, ",") {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(ip))
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, f.cert, &key.PublicKey, f.key)
+	require.NoError(f.t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(f.t, err)
+
+	return &api.Secret{Data: map[string]interface{}{
+		"certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		"private_key": string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		"issuing_ca":  f.pem,
+		"ca_chain":    []interface{}{f.pem},
+	}}, nil
+}
+
+func newTestSystem(t *testing.T, ca *fakeCA, ttl time.Duration) *System {
+	t.Helper()
+	os.Clearenv()
+
+	s := NewSystem()
+	s.Logical = ca
+	s.Role = "service"
+	s.CommonName = "svc.internal"
+	s.TTL = ttl
+	_, err := s.Build()
+	require.NoError(t, err)
+	t.Cleanup(s.Stop)
+
+	return s
+}
+
+func TestBuild(t *testing.T) {
+	os.Clearenv()
+
+	s := NewSystem()
+	s.Logical = newFakeCA(t)
+	_, err := s.Build()
+	assert.Error(t, err, "role is required")
+
+	s.Role = "service"
+	_, err = s.Build()
+	assert.Error(t, err, "common name is required")
+
+	s.CommonName = "svc.internal"
+	s.RotateFraction = 1.5
+	_, err = s.Build()
+	assert.Error(t, err, "fraction must be below 1")
+}
+
+func TestIssue(t *testing.T) {
+	ca := newFakeCA(t)
+	s := newTestSystem(t, ca, time.Hour)
+
+	cert := s.Certificate()
+	require.NotNil(t, cert)
+	assert.Equal(t, "svc.internal", cert.Leaf.Subject.CommonName)
+	assert.Equal(t, []string{"pki/issue/service"}, ca.paths)
+
+	wait := s.rotateIn(time.Now())
+	assert.InDelta(t, (time.Hour * 66 / 100).Seconds(), wait.Seconds(), 5)
+}
+
+func TestRotation(t *testing.T) {
+	ca := newFakeCA(t)
+	s := newTestSystem(t, ca, 2*time.Second)
+	first := s.Certificate().Leaf.SerialNumber
+
+	assert.Eventually(t, func() bool {
+		return s.Certificate().Leaf.SerialNumber.Cmp(first) != 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// handshake runs both ends over a pipe and returns the first error either side saw
+func handshake(t *testing.T, clientCfg, serverCfg *tls.Config) (*tls.Conn, error) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	server := tls.Server(serverConn, serverCfg)
+	client := tls.Client(clientConn, clientCfg)
+
+	errs := make(chan error, 1)
+	go func() {
+		err := server.Handshake()
+		if err != nil {
+			_ = serverConn.Close()
+		}
+		errs <- err
+	}()
+	clientErr := client.Handshake()
+	if clientErr != nil {
+		_ = clientConn.Close()
+	}
+	serverErr := <-errs
+	if clientErr != nil {
+		return server, clientErr
+	}
+
+	return server, serverErr
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newFakeCA(t)
+	s := newTestSystem(t, ca, time.Hour)
+
+	clientCfg := s.ClientTLSConfig()
+	clientCfg.ServerName = "svc.internal"
+	server, err := handshake(t, clientCfg, s.ServerTLSConfig())
+	require.NoError(t, err)
+
+	peers := server.ConnectionState().PeerCertificates
+	require.NotEmpty(t, peers)
+	assert.Equal(t, "svc.internal", peers[0].Subject.CommonName)
+
+	clientCfg = s.ClientTLSConfig()
+	clientCfg.ServerName = "other.internal"
+	_, err = handshake(t, clientCfg, s.ServerTLSConfig())
+	assert.Error(t, err, "server name must match the certificate")
+}
+
+func TestMutualTLSOverIP(t *testing.T) {
+	os.Clearenv()
+
+	s := NewSystem()
+	s.Logical = newFakeCA(t)
+	s.Role = "service"
+	s.CommonName = "svc.internal"
+	s.IPSANs = []string{"127.0.0.1"}
+	_, err := s.Build()
+	require.NoError(t, err)
+	t.Cleanup(s.Stop)
+
+	clientCfg := s.ClientTLSConfig()
+	clientCfg.ServerName = "127.0.0.1"
+	_, err = handshake(t, clientCfg, s.ServerTLSConfig())
+	assert.NoError(t, err, "an ip dial is checked against the ip sans")
+
+	clientCfg = s.ClientTLSConfig()
+	clientCfg.ServerName = "10.0.0.1"
+	_, err = handshake(t, clientCfg, s.ServerTLSConfig())
+	assert.Error(t, err, "the ip must be in the certificate")
+
+	_, err = handshake(t, s.ClientTLSConfig(), s.ServerTLSConfig())
+	assert.Error(t, err, "a server name is still required")
+}
+
+func TestMutualTLSAfterCARotation(t *testing.T) {
+	ca := newFakeCA(t)
+	s := newTestSystem(t, ca, time.Hour)
+	stale := newTestSystem(t, ca, time.Hour)
+
+	clientCfg := s.ClientTLSConfig()
+	clientCfg.ServerName = "svc.internal"
+	serverCfg := s.ServerTLSConfig()
+	_, err := handshake(t, clientCfg, serverCfg)
+	require.NoError(t, err)
+
+	ca.rotateCA()
+	require.NoError(t, s.Issue(context.Background()))
+
+	_, err = handshake(t, clientCfg, serverCfg)
+	assert.NoError(t, err, "configs made before the rotation trust the new ca")
+
+	staleClient := stale.ClientTLSConfig()
+	staleClient.ServerName = "svc.internal"
+	_, err = handshake(t, staleClient, serverCfg)
+	assert.Error(t, err, "a peer still on the old ca is rejected")
+}
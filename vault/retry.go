@@ -0,0 +1,328 @@
+package vault
+
+import (
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/caarlos0/env/v8"
+	vaultHelper "github.com/keloran/vault-helper"
+)
+
+// RetryPolicy controls how vault reads are retried and when the circuit breaker opens
+type RetryPolicy struct {
+	MaxAttempts    int           `env:"VAULT_RETRY_MAX_ATTEMPTS" envDefault:"3"`
+	InitialBackoff time.Duration `env:"VAULT_RETRY_INITIAL_BACKOFF" envDefault:"200ms"`
+	MaxBackoff     time.Duration `env:"VAULT_RETRY_MAX_BACKOFF" envDefault:"5s"`
+	// Jitter spreads each wait by up to this fraction either way
+	Jitter float64 `env:"VAULT_RETRY_JITTER" envDefault:"0.2"`
+
+	// BreakerThreshold is the number of failed reads in a row that opens the breaker, 0 disables it
+	BreakerThreshold int           `env:"VAULT_BREAKER_THRESHOLD" envDefault:"5"`
+	BreakerCooldown  time.Duration `env:"VAULT_BREAKER_COOLDOWN" envDefault:"30s"`
+}
+
+// RetryEvent is reported for every retry, stale read and breaker change so it can feed metrics
+type RetryEvent struct {
+	Path    string
+	Attempt int
+	Wait    time.Duration
+	Err     error
+	Kind    RetryEventKind
+}
+
+type RetryEventKind string
+
+const (
+	EventRetry       RetryEventKind = "retry"
+	EventStale       RetryEventKind = "stale"
+	EventBreakerOpen RetryEventKind = "breaker_open"
+)
+
+// RetryStats are running totals since the helper was created
+type RetryStats struct {
+	Retries      int
+	Failures     int
+	StaleReads   int
+	BreakerOpens int
+	BreakerOpen  bool
+}
+
+func BuildRetryPolicy() (RetryPolicy, error) {
+	p := RetryPolicy{}
+	if err := env.Parse(&p); err != nil {
+		return p, logs.Errorf("vault: unable to parse retry env: %v", err)
+	}
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+
+	return p, nil
+}
+
+type knownGood struct {
+	secrets []vaultHelper.KVSecret
+	lease   int
+	version SecretVersion
+	hasVer  bool
+}
+
+// Resilient wraps a VaultHelper with retries, backoff and a circuit breaker,
+// once a path has been read it keeps serving the last known good secrets while vault is down
+type Resilient struct {
+	vaultHelper.VaultHelper
+
+	Policy  RetryPolicy
+	OnEvent func(RetryEvent)
+
+	mu   sync.Mutex
+	good map[string]knownGood
+	// stale marks the paths being answered from good, current is the path the accessors answer for
+	stale     map[string]bool
+	current   string
+	failures  int
+	openUntil time.Time
+	stats     RetryStats
+	sleep     func(time.Duration)
+	now       func() time.Time
+}
+
+func NewResilient(vh vaultHelper.VaultHelper, p RetryPolicy) *Resilient {
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+
+	return &Resilient{
+		VaultHelper: vh,
+		Policy:      p,
+		good:        make(map[string]knownGood),
+		stale:       make(map[string]bool),
+		sleep:       time.Sleep,
+		now:         time.Now,
+	}
+}
+
+func (r *Resilient) GetSecrets(path string) error {
+	return r.read(path, r.VaultHelper.GetSecrets)
+}
+
+func (r *Resilient) GetRemoteSecrets(path string) error {
+	return r.read(path, r.VaultHelper.GetRemoteSecrets)
+}
+
+func (r *Resilient) read(path string, get func(string) error) error {
+	if r.isOpen() {
+		return r.serveStale(path, logs.Error("vault: circuit breaker open"))
+	}
+
+	var err error
+	for attempt := 1; attempt <= r.Policy.MaxAttempts; attempt++ {
+		if err = get(path); err == nil {
+			r.succeeded(path)
+			return nil
+		}
+		if !isRetryable(err) {
+			return r.rejected(path, err)
+		}
+		if attempt == r.Policy.MaxAttempts {
+			break
+		}
+
+		wait := r.backoff(attempt)
+		logs.Infof("vault: read of %s failed, attempt %d of %d, retrying in %v: %v", path, attempt, r.Policy.MaxAttempts, wait, err)
+		r.mu.Lock()
+		r.stats.Retries++
+		r.mu.Unlock()
+		r.emit(RetryEvent{Path: path, Attempt: attempt, Wait: wait, Err: err, Kind: EventRetry})
+		r.sleep(wait)
+	}
+
+	r.failed(path, err)
+	return r.serveStale(path, err)
+}
+
+func (r *Resilient) backoff(attempt int) time.Duration {
+	wait := r.Policy.InitialBackoff << (attempt - 1)
+	if r.Policy.MaxBackoff > 0 && (wait > r.Policy.MaxBackoff || wait <= 0) {
+		wait = r.Policy.MaxBackoff
+	}
+	if r.Policy.Jitter > 0 {
+		spread := (rand.Float64()*2 - 1) * r.Policy.Jitter
+		wait = time.Duration(float64(wait) * (1 + spread))
+	}
+
+	return wait
+}
+
+func (r *Resilient) isOpen() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.now().Before(r.openUntil)
+}
+
+func (r *Resilient) succeeded(path string) {
+	kg := knownGood{
+		secrets: append([]vaultHelper.KVSecret(nil), r.VaultHelper.Secrets()...),
+		lease:   r.VaultHelper.LeaseDuration(),
+	}
+	if vh, ok := r.VaultHelper.(VersionedHelper); ok {
+		kg.version, kg.hasVer = vh.VersionOf(path)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.good[path] = kg
+	delete(r.stale, path)
+	r.current = path
+	r.failures = 0
+}
+
+func (r *Resilient) failed(path string, err error) {
+	r.mu.Lock()
+	r.failures++
+	r.stats.Failures++
+	opened := false
+	if r.Policy.BreakerThreshold > 0 && r.failures >= r.Policy.BreakerThreshold {
+		r.openUntil = r.now().Add(r.Policy.BreakerCooldown)
+		r.failures = 0
+		r.stats.BreakerOpens++
+		opened = true
+	}
+	r.mu.Unlock()
+
+	if opened {
+		logs.Infof("vault: circuit breaker open for %v after read of %s failed: %v", r.Policy.BreakerCooldown, path, err)
+		r.emit(RetryEvent{Path: path, Err: err, Kind: EventBreakerOpen})
+	}
+}
+
+// rejected returns a permanent error as is, vault answered so the known good copy isn't served and the breaker isn't moved
+func (r *Resilient) rejected(path string, err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Failures++
+	r.current = path
+	delete(r.stale, path)
+
+	return err
+}
+
+// serveStale falls back to the last known good secrets for the path, or returns the error when there are none
+func (r *Resilient) serveStale(path string, err error) error {
+	r.mu.Lock()
+	r.current = path
+	if _, ok := r.good[path]; !ok {
+		delete(r.stale, path)
+		r.mu.Unlock()
+		return err
+	}
+	r.stale[path] = true
+	r.stats.StaleReads++
+	r.mu.Unlock()
+
+	logs.Infof("vault: serving last known good secrets for %s: %v", path, err)
+	r.emit(RetryEvent{Path: path, Err: err, Kind: EventStale})
+
+	return nil
+}
+
+func (r *Resilient) emit(e RetryEvent) {
+	if r.OnEvent != nil {
+		r.OnEvent(e)
+	}
+}
+
+// served is the last known good entry for the current path while it is stale, nil when the helper has the answer
+func (r *Resilient) served() *knownGood {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.stale[r.current] {
+		return nil
+	}
+
+	kg := r.good[r.current]
+	return &kg
+}
+
+func (r *Resilient) Secrets() []vaultHelper.KVSecret {
+	if stale := r.served(); stale != nil {
+		return stale.secrets
+	}
+
+	return r.VaultHelper.Secrets()
+}
+
+func (r *Resilient) GetSecret(key string) (string, error) {
+	stale := r.served()
+	if stale == nil {
+		return r.VaultHelper.GetSecret(key)
+	}
+
+	for _, s := range stale.secrets {
+		if s.Key == key {
+			return s.Value, nil
+		}
+	}
+
+	return "", logs.Errorf("key: '%s' not found", key)
+}
+
+func (r *Resilient) LeaseDuration() int {
+	if stale := r.served(); stale != nil {
+		return stale.lease
+	}
+
+	return r.VaultHelper.LeaseDuration()
+}
+
+func (r *Resilient) LastVersion() (SecretVersion, bool) {
+	if stale := r.served(); stale != nil {
+		return stale.version, stale.hasVer
+	}
+
+	if vh, ok := r.VaultHelper.(VersionedHelper); ok {
+		return vh.LastVersion()
+	}
+
+	return SecretVersion{}, false
+}
+
+func (r *Resilient) VersionOf(path string) (SecretVersion, bool) {
+	r.mu.Lock()
+	kg, stale := r.good[path]
+	stale = stale && r.stale[path]
+	r.mu.Unlock()
+	if stale {
+		return kg.version, kg.hasVer
+	}
+
+	if vh, ok := r.VaultHelper.(VersionedHelper); ok {
+		return vh.VersionOf(path)
+	}
+
+	return SecretVersion{}, false
+}
+
+func (r *Resilient) Stats() RetryStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.stats
+	stats.BreakerOpen = r.now().Before(r.openUntil)
+	return stats
+}
+
+// isRetryable treats anything that is not a missing path, missing key or denied token as transient
+func isRetryable(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, permanent := range []string{"no path provided", "no data returned", "not found", "permission denied", "code: 403", "code: 404", "code: 400"} {
+		if strings.Contains(msg, permanent) {
+			return false
+		}
+	}
+
+	return true
+}
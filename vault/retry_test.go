@@ -0,0 +1,203 @@
+package vault
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	vaultHelper "github.com/keloran/vault-helper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyHelper fails the next `fail` reads with err before serving its secrets
+type flakyHelper struct {
+	vaultHelper.MockVaultHelper
+	fail  int
+	err   error
+	reads int
+}
+
+func (f *flakyHelper) GetSecrets(path string) error {
+	f.reads++
+	if f.fail > 0 {
+		f.fail--
+		return f.err
+	}
+
+	return f.MockVaultHelper.GetSecrets(path)
+}
+
+func newTestResilient(vh vaultHelper.VaultHelper, p RetryPolicy) (*Resilient, *[]time.Duration) {
+	r := NewResilient(vh, p)
+	waits := &[]time.Duration{}
+	r.sleep = func(d time.Duration) {
+		*waits = append(*waits, d)
+	}
+
+	return r, waits
+}
+
+func TestResilientRetries(t *testing.T) {
+	flaky := &flakyHelper{
+		MockVaultHelper: vaultHelper.MockVaultHelper{
+			KVSecrets: []vaultHelper.KVSecret{{Key: "password", Value: "first"}},
+		},
+		fail: 2,
+		err:  errors.New("Code: 503. Errors: vault is sealed"),
+	}
+
+	var events []RetryEvent
+	r, waits := newTestResilient(flaky, RetryPolicy{MaxAttempts: 3, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 150 * time.Millisecond})
+	r.OnEvent = func(e RetryEvent) {
+		events = append(events, e)
+	}
+
+	require.NoError(t, r.GetSecrets("secret/data/app"))
+	assert.Equal(t, 3, flaky.reads)
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 150 * time.Millisecond}, *waits)
+	assert.Len(t, events, 2)
+	assert.Equal(t, EventRetry, events[0].Kind)
+	assert.Equal(t, 2, r.Stats().Retries)
+
+	pw, err := r.GetSecret("password")
+	assert.NoError(t, err)
+	assert.Equal(t, "first", pw)
+}
+
+func TestResilientPermanentError(t *testing.T) {
+	flaky := &flakyHelper{fail: 5, err: errors.New("path: x, err: no data returned")}
+	r, waits := newTestResilient(flaky, RetryPolicy{MaxAttempts: 3})
+
+	assert.Error(t, r.GetSecrets("secret/data/app"))
+	assert.Equal(t, 1, flaky.reads)
+	assert.Empty(t, *waits)
+}
+
+func TestResilientPermanentErrorAfterGoodRead(t *testing.T) {
+	flaky := &flakyHelper{
+		MockVaultHelper: vaultHelper.MockVaultHelper{
+			KVSecrets: []vaultHelper.KVSecret{{Key: "password", Value: "first"}},
+		},
+	}
+	r, _ := newTestResilient(flaky, RetryPolicy{MaxAttempts: 3, BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	require.NoError(t, r.GetSecrets("secret/data/app"))
+
+	flaky.fail = 1
+	flaky.err = errors.New("Code: 403. Errors: permission denied")
+	assert.Error(t, r.GetSecrets("secret/data/app"), "a revoked token is not hidden behind the last good read")
+	assert.Equal(t, 2, flaky.reads)
+	assert.Nil(t, r.served())
+	assert.Equal(t, 0, r.Stats().StaleReads)
+	assert.False(t, r.Stats().BreakerOpen)
+}
+
+func TestResilientJitter(t *testing.T) {
+	r := NewResilient(&vaultHelper.MockVaultHelper{}, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Minute, Jitter: 0.5})
+	for i := 0; i < 20; i++ {
+		wait := r.backoff(2)
+		assert.GreaterOrEqual(t, wait, time.Second)
+		assert.LessOrEqual(t, wait, 3*time.Second)
+	}
+}
+
+func TestResilientLastKnownGood(t *testing.T) {
+	flaky := &flakyHelper{
+		MockVaultHelper: vaultHelper.MockVaultHelper{
+			KVSecrets: []vaultHelper.KVSecret{{Key: "password", Value: "first"}},
+			Lease:     60,
+		},
+		err: errors.New("Code: 503. Errors: vault is sealed"),
+	}
+	r, _ := newTestResilient(flaky, RetryPolicy{MaxAttempts: 2, BreakerThreshold: 2, BreakerCooldown: time.Minute})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	t.Run("initial read fails without a known good copy", func(t *testing.T) {
+		flaky.fail = 2
+		assert.Error(t, r.GetSecrets("secret/data/app"))
+	})
+
+	t.Run("refresh serves the last known good copy", func(t *testing.T) {
+		require.NoError(t, r.GetSecrets("secret/data/app"))
+
+		flaky.KVSecrets = nil
+		flaky.fail = 4
+		require.NoError(t, r.GetSecrets("secret/data/app"))
+		pw, err := r.GetSecret("password")
+		assert.NoError(t, err)
+		assert.Equal(t, "first", pw)
+		assert.Equal(t, 60, r.LeaseDuration())
+		assert.False(t, r.Stats().BreakerOpen)
+
+		require.NoError(t, r.GetSecrets("secret/data/app"))
+		assert.True(t, r.Stats().BreakerOpen)
+		assert.Equal(t, 2, r.Stats().StaleReads)
+	})
+
+	t.Run("breaker skips vault while open", func(t *testing.T) {
+		reads := flaky.reads
+		require.NoError(t, r.GetSecrets("secret/data/app"))
+		assert.Equal(t, reads, flaky.reads)
+		assert.Error(t, r.GetSecrets("secret/data/other"))
+	})
+
+	t.Run("breaker closes after cooldown", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+		flaky.KVSecrets = []vaultHelper.KVSecret{{Key: "password", Value: "second"}}
+		require.NoError(t, r.GetSecrets("secret/data/app"))
+		pw, _ := r.GetSecret("password")
+		assert.Equal(t, "second", pw)
+		assert.False(t, r.Stats().BreakerOpen)
+	})
+}
+
+// pathHelper serves different secrets per path and fails reads of the paths marked down
+type pathHelper struct {
+	vaultHelper.MockVaultHelper
+	paths map[string][]vaultHelper.KVSecret
+	down  map[string]bool
+}
+
+func (p *pathHelper) GetSecrets(path string) error {
+	if p.down[path] {
+		return errors.New("Code: 503. Errors: vault is sealed")
+	}
+	p.KVSecrets = p.paths[path]
+
+	return nil
+}
+
+func TestResilientStalePerPath(t *testing.T) {
+	vh := &pathHelper{
+		paths: map[string][]vaultHelper.KVSecret{
+			"secret/data/a": {{Key: "password", Value: "a1"}},
+			"secret/data/b": {{Key: "password", Value: "b1"}},
+		},
+		down: map[string]bool{},
+	}
+	r, _ := newTestResilient(vh, RetryPolicy{MaxAttempts: 1})
+	password := func(path string) string {
+		t.Helper()
+		require.NoError(t, r.GetSecrets(path))
+		pw, err := r.GetSecret("password")
+		require.NoError(t, err)
+		return pw
+	}
+
+	assert.Equal(t, "a1", password("secret/data/a"))
+	assert.Equal(t, "b1", password("secret/data/b"))
+
+	vh.down["secret/data/a"] = true
+	vh.paths["secret/data/b"] = []vaultHelper.KVSecret{{Key: "password", Value: "b2"}}
+	assert.Equal(t, "a1", password("secret/data/a"), "a is served from its own known good copy")
+	assert.Equal(t, "b2", password("secret/data/b"), "b is read live while a is stale")
+	assert.Equal(t, "a1", password("secret/data/a"))
+
+	vh.down = map[string]bool{"secret/data/b": true}
+	vh.paths["secret/data/a"] = []vaultHelper.KVSecret{{Key: "password", Value: "a2"}}
+	assert.Equal(t, "b2", password("secret/data/b"), "b falls back to its last good read, not a's")
+	assert.Equal(t, "a2", password("secret/data/a"))
+	assert.Equal(t, "b2", password("secret/data/b"))
+	assert.Equal(t, 4, r.Stats().StaleReads)
+}
@@ -0,0 +1,149 @@
+package vault
+
+import (
+	"strings"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/caarlos0/env/v8"
+)
+
+const (
+	DefaultMount     = "secret"
+	DefaultBase      = "chewedfeed"
+	DefaultKVVersion = 2
+)
+
+// Root is the KV mount and base path that every subsystem's default secret paths derive from
+type Root struct {
+	Mount     string
+	Base      string
+	KVVersion int
+}
+
+type rootEnv struct {
+	Prefix    string `env:"VAULT_PATH_PREFIX" envDefault:""`
+	KVVersion int    `env:"VAULT_KV_VERSION" envDefault:"0"`
+}
+
+func NewRoot(mount, base string) Root {
+	return Root{
+		Mount: strings.Trim(mount, "/"),
+		Base:  strings.Trim(base, "/"),
+	}
+}
+
+// ParseRoot splits a prefix such as "secret/data/team" or "kv/team" into a Root,
+// a "data" segment after the mount marks the mount as KV v2
+func ParseRoot(prefix string) Root {
+	parts := strings.SplitN(strings.Trim(prefix, "/"), "/", 2)
+	r := Root{
+		Mount: parts[0],
+	}
+	if len(parts) == 1 {
+		return r
+	}
+
+	base := parts[1]
+	if base == "data" || strings.HasPrefix(base, "data/") {
+		r.KVVersion = 2
+		base = strings.TrimPrefix(strings.TrimPrefix(base, "data"), "/")
+	}
+	r.Base = base
+
+	return r
+}
+
+// BuildRoot reads VAULT_PATH_PREFIX and VAULT_KV_VERSION, falling back to the defaults
+func BuildRoot() (Root, error) {
+	re := &rootEnv{}
+	if err := env.Parse(re); err != nil {
+		return Root{}, logs.Errorf("vault: unable to parse root env: %v", err)
+	}
+
+	r := Root{}
+	if re.Prefix != "" {
+		r = ParseRoot(re.Prefix)
+	}
+	if re.KVVersion != 0 {
+		if re.KVVersion != 1 && re.KVVersion != 2 {
+			return Root{}, logs.Errorf("vault: unable to use kv version: %d", re.KVVersion)
+		}
+		r.KVVersion = re.KVVersion
+	}
+
+	return r.withDefaults(), nil
+}
+
+// IsDefault is whether the root is the one used when nothing is configured
+func (r Root) IsDefault() bool {
+	return r.withDefaults() == Root{}.withDefaults()
+}
+
+func (r Root) IsZero() bool {
+	return r.Mount == "" && r.Base == "" && r.KVVersion == 0
+}
+
+func (r Root) withDefaults() Root {
+	if r.Mount == "" {
+		r.Mount = DefaultMount
+		if r.Base == "" {
+			r.Base = DefaultBase
+		}
+	}
+	if r.KVVersion == 0 {
+		r.KVVersion = DefaultKVVersion
+	}
+
+	return r
+}
+
+// Path returns the full read path for a secret name under the root
+func (r Root) Path(name string) string {
+	r = r.withDefaults()
+
+	parts := []string{r.Mount}
+	if r.KVVersion == 2 {
+		parts = append(parts, "data")
+	}
+	if r.Base != "" {
+		parts = append(parts, r.Base)
+	}
+	if name = strings.Trim(name, "/"); name != "" {
+		parts = append(parts, name)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// Normalize adds or removes the KV v2 "data" segment on a path under the root mount,
+// paths on other mounts and local file paths are returned untouched
+func (r Root) Normalize(path string) string {
+	if path == "" || strings.HasPrefix(path, ".") || strings.HasPrefix(path, "/") {
+		return path
+	}
+	r = r.withDefaults()
+
+	parts := strings.Split(path, "/")
+	if parts[0] != r.Mount || len(parts) < 2 {
+		return path
+	}
+
+	hasData := parts[1] == "data"
+	switch {
+	case r.KVVersion == 2 && !hasData:
+		parts = append([]string{parts[0], "data"}, parts[1:]...)
+	case r.KVVersion == 1 && hasData:
+		parts = append([]string{parts[0]}, parts[2:]...)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// Resolve picks the explicit path when set, otherwise the default secret name under the root
+func (r Root) Resolve(explicit, name string) string {
+	if explicit != "" {
+		return r.Normalize(explicit)
+	}
+
+	return r.Path(name)
+}
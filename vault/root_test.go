@@ -0,0 +1,77 @@
+package vault
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRootPath(t *testing.T) {
+	t.Run("default root", func(t *testing.T) {
+		assert.Equal(t, "secret/data/chewedfeed/postgres", Root{}.Path("postgres"))
+	})
+
+	t.Run("kv v1", func(t *testing.T) {
+		r := NewRoot("kv", "team")
+		r.KVVersion = 1
+		assert.Equal(t, "kv/team/details", r.Path("details"))
+	})
+
+	t.Run("mount without base", func(t *testing.T) {
+		r := NewRoot("kv/", "")
+		assert.Equal(t, "kv/data/details", r.Path("details"))
+	})
+}
+
+func TestRootIsDefault(t *testing.T) {
+	assert.True(t, Root{}.IsDefault())
+	assert.True(t, NewRoot(DefaultMount, DefaultBase).IsDefault())
+	assert.False(t, NewRoot("kv", "team").IsDefault())
+	assert.False(t, Root{KVVersion: 1}.IsDefault())
+}
+
+func TestParseRoot(t *testing.T) {
+	assert.Equal(t, Root{Mount: "secret", Base: "team", KVVersion: 2}, ParseRoot("secret/data/team"))
+	assert.Equal(t, Root{Mount: "kv", Base: "team/app"}, ParseRoot("/kv/team/app/"))
+	assert.Equal(t, Root{Mount: "kv"}, ParseRoot("kv"))
+}
+
+func TestRootNormalize(t *testing.T) {
+	v2 := NewRoot("secret", "team")
+	v1 := Root{Mount: "secret", Base: "team", KVVersion: 1}
+
+	assert.Equal(t, "secret/data/team/app", v2.Normalize("secret/team/app"))
+	assert.Equal(t, "secret/data/team/app", v2.Normalize("secret/data/team/app"))
+	assert.Equal(t, "secret/team/app", v1.Normalize("secret/data/team/app"))
+	assert.Equal(t, "other/team/app", v2.Normalize("other/team/app"))
+	assert.Equal(t, "./secrets.json", v2.Normalize("./secrets.json"))
+}
+
+func TestBuildRoot(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		os.Clearenv()
+
+		r, err := BuildRoot()
+		assert.NoError(t, err)
+		assert.Equal(t, Root{Mount: "secret", Base: "chewedfeed", KVVersion: 2}, r)
+	})
+
+	t.Run("prefix and version", func(t *testing.T) {
+		os.Clearenv()
+		assert.NoError(t, os.Setenv("VAULT_PATH_PREFIX", "kv/team"))
+		assert.NoError(t, os.Setenv("VAULT_KV_VERSION", "1"))
+
+		r, err := BuildRoot()
+		assert.NoError(t, err)
+		assert.Equal(t, "kv/team/rabbitmq", r.Path("rabbitmq"))
+	})
+
+	t.Run("invalid version", func(t *testing.T) {
+		os.Clearenv()
+		assert.NoError(t, os.Setenv("VAULT_KV_VERSION", "3"))
+
+		_, err := BuildRoot()
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,519 @@
+package transit
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bugfixes/go-bugfixes/logs"
+	"github.com/caarlos0/env/v8"
+	"github.com/hashicorp/vault/api"
+)
+
+// envelopeSeparator splits the wrapped data key from the locally sealed payload,
+// it never appears in vault ciphertext or base64
+const envelopeSeparator = "|"
+
+// Logical is the part of the vault api the transit engine needs
+type Logical interface {
+	WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*api.Secret, error)
+}
+
+type Details struct {
+	Mount   string `env:"VAULT_TRANSIT_MOUNT" envDefault:"transit"`
+	KeyName string `env:"VAULT_TRANSIT_KEY"`
+
+	// DataKeyTTL is how long envelope data keys are cached locally, 0 disables the cache
+	DataKeyTTL time.Duration `env:"VAULT_TRANSIT_DATA_KEY_TTL" envDefault:"0s"`
+}
+
+type System struct {
+	Context context.Context
+
+	Details
+
+	Logical Logical
+
+	keys *keyCache
+}
+
+// keyCache sits behind a pointer so the System can be copied into the config
+type keyCache struct {
+	mu   sync.Mutex
+	seal *dataKey
+	open map[string]*dataKey
+}
+
+type dataKey struct {
+	plaintext  []byte
+	ciphertext string
+	expires    time.Time
+}
+
+func NewSystem() *System {
+	return &System{
+		Context: context.Background(),
+		keys:    &keyCache{},
+	}
+}
+
+func (s *System) Setup(client *api.Client) {
+	s.Logical = client.Logical()
+}
+
+func (s *System) Build() (*Details, error) {
+	tr := &Details{}
+	if err := env.Parse(tr); err != nil {
+		return nil, logs.Errorf("transit: unable to parse env: %v", err)
+	}
+
+	if s.Details.Mount != "" {
+		tr.Mount = s.Details.Mount
+	}
+	if s.Details.KeyName != "" {
+		tr.KeyName = s.Details.KeyName
+	}
+	if s.Details.DataKeyTTL != 0 {
+		tr.DataKeyTTL = s.Details.DataKeyTTL
+	}
+
+	if tr.KeyName == "" {
+		return nil, logs.Error("transit: unable to use empty key name")
+	}
+	if s.Logical == nil {
+		return nil, logs.Error("transit: unable to build without a vault client")
+	}
+
+	if s.keys == nil {
+		s.keys = &keyCache{}
+	}
+
+	s.Details = *tr
+	return tr, nil
+}
+
+func (s *System) path(op string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.Trim(s.Mount, "/"), op, s.KeyName)
+}
+
+func (s *System) write(ctx context.Context, op string, data map[string]interface{}) (map[string]interface{}, error) {
+	if s.Logical == nil {
+		return nil, logs.Error("transit: unable to use transit without a vault client")
+	}
+
+	secret, err := s.Logical.WriteWithContext(ctx, s.path(op), data)
+	if err != nil {
+		return nil, logs.Errorf("transit: unable to %s: %v", op, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, logs.Errorf("transit: unable to %s: no data returned", op)
+	}
+
+	return secret.Data, nil
+}
+
+func stringField(data map[string]interface{}, key string) (string, error) {
+	v, ok := data[key].(string)
+	if !ok {
+		return "", logs.Errorf("transit: unable to find %s in response", key)
+	}
+
+	return v, nil
+}
+
+func (s *System) Encrypt(ctx context.Context, plaintext []byte) (string, error) {
+	data, err := s.write(ctx, "encrypt", map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return stringField(data, "ciphertext")
+}
+
+func (s *System) Decrypt(ctx context.Context, ciphertext string) ([]byte, error) {
+	data, err := s.write(ctx, "decrypt", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := stringField(data, "plaintext")
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, logs.Errorf("transit: unable to decode plaintext: %v", err)
+	}
+
+	return plaintext, nil
+}
+
+// Rewrap re-encrypts ciphertext with the latest version of the key without exposing the plaintext
+func (s *System) Rewrap(ctx context.Context, ciphertext string) (string, error) {
+	data, err := s.write(ctx, "rewrap", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return stringField(data, "ciphertext")
+}
+
+func (s *System) Sign(ctx context.Context, input []byte) (string, error) {
+	data, err := s.write(ctx, "sign", map[string]interface{}{
+		"input": base64.StdEncoding.EncodeToString(input),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return stringField(data, "signature")
+}
+
+func (s *System) Verify(ctx context.Context, input []byte, signature string) (bool, error) {
+	data, err := s.write(ctx, "verify", map[string]interface{}{
+		"input":     base64.StdEncoding.EncodeToString(input),
+		"signature": signature,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	valid, ok := data["valid"].(bool)
+	if !ok {
+		return false, logs.Error("transit: unable to find valid in response")
+	}
+
+	return valid, nil
+}
+
+func (s *System) batch(ctx context.Context, op string, items []map[string]interface{}) ([]map[string]interface{}, error) {
+	input := make([]interface{}, len(items))
+	for i, item := range items {
+		input[i] = item
+	}
+
+	data, err := s.write(ctx, op, map[string]interface{}{
+		"batch_input": input,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	raw, ok := data["batch_results"].([]interface{})
+	if !ok || len(raw) != len(items) {
+		return nil, logs.Errorf("transit: unable to %s batch: unexpected results", op)
+	}
+
+	results := make([]map[string]interface{}, len(raw))
+	for i, r := range raw {
+		result, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, logs.Errorf("transit: unable to %s batch: unexpected result %d", op, i)
+		}
+		if msg, ok := result["error"].(string); ok && msg != "" {
+			return nil, logs.Errorf("transit: unable to %s batch item %d: %s", op, i, msg)
+		}
+		results[i] = result
+	}
+
+	return results, nil
+}
+
+func (s *System) EncryptBatch(ctx context.Context, plaintexts [][]byte) ([]string, error) {
+	items := make([]map[string]interface{}, len(plaintexts))
+	for i, p := range plaintexts {
+		items[i] = map[string]interface{}{"plaintext": base64.StdEncoding.EncodeToString(p)}
+	}
+
+	results, err := s.batch(ctx, "encrypt", items)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertexts := make([]string, len(results))
+	for i, r := range results {
+		if ciphertexts[i], err = stringField(r, "ciphertext"); err != nil {
+			return nil, err
+		}
+	}
+
+	return ciphertexts, nil
+}
+
+func (s *System) DecryptBatch(ctx context.Context, ciphertexts []string) ([][]byte, error) {
+	items := make([]map[string]interface{}, len(ciphertexts))
+	for i, c := range ciphertexts {
+		items[i] = map[string]interface{}{"ciphertext": c}
+	}
+
+	results, err := s.batch(ctx, "decrypt", items)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintexts := make([][]byte, len(results))
+	for i, r := range results {
+		encoded, err := stringField(r, "plaintext")
+		if err != nil {
+			return nil, err
+		}
+		if plaintexts[i], err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, logs.Errorf("transit: unable to decode plaintext %d: %v", i, err)
+		}
+	}
+
+	return plaintexts, nil
+}
+
+func (s *System) RewrapBatch(ctx context.Context, ciphertexts []string) ([]string, error) {
+	items := make([]map[string]interface{}, len(ciphertexts))
+	for i, c := range ciphertexts {
+		items[i] = map[string]interface{}{"ciphertext": c}
+	}
+
+	results, err := s.batch(ctx, "rewrap", items)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrapped := make([]string, len(results))
+	for i, r := range results {
+		if rewrapped[i], err = stringField(r, "ciphertext"); err != nil {
+			return nil, err
+		}
+	}
+
+	return rewrapped, nil
+}
+
+func (s *System) SignBatch(ctx context.Context, inputs [][]byte) ([]string, error) {
+	items := make([]map[string]interface{}, len(inputs))
+	for i, in := range inputs {
+		items[i] = map[string]interface{}{"input": base64.StdEncoding.EncodeToString(in)}
+	}
+
+	results, err := s.batch(ctx, "sign", items)
+	if err != nil {
+		return nil, err
+	}
+
+	signatures := make([]string, len(results))
+	for i, r := range results {
+		if signatures[i], err = stringField(r, "signature"); err != nil {
+			return nil, err
+		}
+	}
+
+	return signatures, nil
+}
+
+func (s *System) VerifyBatch(ctx context.Context, inputs [][]byte, signatures []string) ([]bool, error) {
+	if len(inputs) != len(signatures) {
+		return nil, logs.Error("transit: unable to verify batch: inputs and signatures differ in length")
+	}
+
+	items := make([]map[string]interface{}, len(inputs))
+	for i, in := range inputs {
+		items[i] = map[string]interface{}{
+			"input":     base64.StdEncoding.EncodeToString(in),
+			"signature": signatures[i],
+		}
+	}
+
+	results, err := s.batch(ctx, "verify", items)
+	if err != nil {
+		return nil, err
+	}
+
+	valid := make([]bool, len(results))
+	for i, r := range results {
+		v, ok := r["valid"].(bool)
+		if !ok {
+			return nil, logs.Errorf("transit: unable to find valid in result %d", i)
+		}
+		valid[i] = v
+	}
+
+	return valid, nil
+}
+
+// EnvelopeEncrypt seals plaintext locally with AES-GCM under a vault issued data key,
+// the result carries the wrapped data key so only vault can open it again
+func (s *System) EnvelopeEncrypt(ctx context.Context, plaintext []byte) (string, error) {
+	key, err := s.sealDataKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(key.plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", logs.Errorf("transit: unable to create nonce: %v", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, []byte(key.ciphertext))
+
+	return key.ciphertext + envelopeSeparator + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *System) EnvelopeDecrypt(ctx context.Context, envelope string) ([]byte, error) {
+	wrapped, encoded, found := strings.Cut(envelope, envelopeSeparator)
+	if !found {
+		return nil, logs.Error("transit: unable to parse envelope")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, logs.Errorf("transit: unable to decode envelope: %v", err)
+	}
+
+	key, err := s.openDataKey(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, logs.Error("transit: unable to open envelope: too short")
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(wrapped))
+	if err != nil {
+		return nil, logs.Errorf("transit: unable to open envelope: %v", err)
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, logs.Errorf("transit: unable to create cipher: %v", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, logs.Errorf("transit: unable to create gcm: %v", err)
+	}
+
+	return gcm, nil
+}
+
+func (s *System) sealDataKey(ctx context.Context) (*dataKey, error) {
+	if s.keys == nil {
+		return nil, logs.Error("transit: unable to use envelopes before build")
+	}
+	s.keys.mu.Lock()
+	defer s.keys.mu.Unlock()
+
+	if s.keys.seal != nil && time.Now().Before(s.keys.seal.expires) {
+		return s.keys.seal, nil
+	}
+
+	data, err := s.write(ctx, "datakey/plaintext", map[string]interface{}{
+		"bits": 256,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := stringField(data, "plaintext")
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, logs.Errorf("transit: unable to decode data key: %v", err)
+	}
+	ciphertext, err := stringField(data, "ciphertext")
+	if err != nil {
+		return nil, err
+	}
+
+	key := &dataKey{
+		plaintext:  plaintext,
+		ciphertext: ciphertext,
+		expires:    time.Now().Add(s.DataKeyTTL),
+	}
+	if s.DataKeyTTL > 0 {
+		s.keys.seal = key
+		s.keys.add(key)
+	}
+
+	return key, nil
+}
+
+func (s *System) openDataKey(ctx context.Context, wrapped string) ([]byte, error) {
+	if s.keys == nil {
+		return nil, logs.Error("transit: unable to use envelopes before build")
+	}
+	s.keys.mu.Lock()
+	if key, ok := s.keys.open[wrapped]; ok && time.Now().Before(key.expires) {
+		s.keys.mu.Unlock()
+		return key.plaintext, nil
+	}
+	s.keys.mu.Unlock()
+
+	plaintext, err := s.Decrypt(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.DataKeyTTL > 0 {
+		s.keys.mu.Lock()
+		s.keys.add(&dataKey{
+			plaintext:  plaintext,
+			ciphertext: wrapped,
+			expires:    time.Now().Add(s.DataKeyTTL),
+		})
+		s.keys.mu.Unlock()
+	}
+
+	return plaintext, nil
+}
+
+// add must be called with the lock held
+func (c *keyCache) add(key *dataKey) {
+	if c.open == nil {
+		c.open = make(map[string]*dataKey)
+	}
+
+	now := time.Now()
+	for k, v := range c.open {
+		if now.After(v.expires) {
+			delete(c.open, k)
+		}
+	}
+	c.open[key.ciphertext] = key
+}
+
+// FlushDataKeys drops every cached data key, the next envelope call goes back to vault
+func (s *System) FlushDataKeys() {
+	if s.keys == nil {
+		return
+	}
+	s.keys.mu.Lock()
+	defer s.keys.mu.Unlock()
+
+	s.keys.seal = nil
+	s.keys.open = nil
+}
@@ -0,0 +1,216 @@
+package transit
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTransit "encrypts" by prefixing the base64 plaintext, which is enough to check the wiring
+type fakeTransit struct {
+	calls map[string]int
+}
+
+func (f *fakeTransit) WriteWithContext(_ context.Context, path string, data map[string]interface{}) (*api.Secret, error) {
+	if f.calls == nil {
+		f.calls = make(map[string]int)
+	}
+	f.calls[path]++
+
+	op := strings.TrimSuffix(strings.TrimPrefix(path, "transit/"), "/test-key")
+	if batch, ok := data["batch_input"].([]interface{}); ok {
+		results := make([]interface{}, len(batch))
+		for i, item := range batch {
+			r, err := f.single(op, item.(map[string]interface{}))
+			if err != nil {
+				results[i] = map[string]interface{}{"error": err.Error()}
+				continue
+			}
+			results[i] = r
+		}
+		return &api.Secret{Data: map[string]interface{}{"batch_results": results}}, nil
+	}
+
+	r, err := f.single(op, data)
+	if err != nil {
+		return nil, err
+	}
+	return &api.Secret{Data: r}, nil
+}
+
+func (f *fakeTransit) single(op string, data map[string]interface{}) (map[string]interface{}, error) {
+	switch op {
+	case "encrypt":
+		return map[string]interface{}{"ciphertext": "vault:v1:" + data["plaintext"].(string)}, nil
+	case "decrypt":
+		ct := data["ciphertext"].(string)
+		if !strings.HasPrefix(ct, "vault:") {
+			return nil, errors.New("invalid ciphertext")
+		}
+		return map[string]interface{}{"plaintext": ct[strings.LastIndex(ct, ":")+1:]}, nil
+	case "rewrap":
+		return map[string]interface{}{"ciphertext": strings.Replace(data["ciphertext"].(string), "vault:v1:", "vault:v2:", 1)}, nil
+	case "sign":
+		return map[string]interface{}{"signature": "vault:v1:sig-" + data["input"].(string)}, nil
+	case "verify":
+		return map[string]interface{}{"valid": data["signature"] == "vault:v1:sig-"+data["input"].(string)}, nil
+	case "datakey/plaintext":
+		key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+		return map[string]interface{}{"plaintext": key, "ciphertext": "vault:v1:" + key}, nil
+	}
+
+	return nil, errors.New("unknown op " + op)
+}
+
+func newTestSystem(t *testing.T, fake *fakeTransit) *System {
+	t.Helper()
+	os.Clearenv()
+
+	s := NewSystem()
+	s.Logical = fake
+	s.KeyName = "test-key"
+	_, err := s.Build()
+	require.NoError(t, err)
+
+	return s
+}
+
+func TestBuild(t *testing.T) {
+	os.Clearenv()
+
+	s := NewSystem()
+	s.Logical = &fakeTransit{}
+	_, err := s.Build()
+	assert.Error(t, err, "key name is required")
+
+	assert.NoError(t, os.Setenv("VAULT_TRANSIT_KEY", "env-key"))
+	tr, err := s.Build()
+	assert.NoError(t, err)
+	assert.Equal(t, "env-key", tr.KeyName)
+	assert.Equal(t, "transit", tr.Mount)
+
+	_, err = NewSystem().Build()
+	assert.Error(t, err, "vault client is required")
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSystem(t, &fakeTransit{})
+
+	ct, err := s.Encrypt(ctx, []byte("secret"))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(ct, "vault:v1:"))
+
+	pt, err := s.Decrypt(ctx, ct)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", string(pt))
+
+	rewrapped, err := s.Rewrap(ctx, ct)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rewrapped, "vault:v2:"))
+
+	_, err = s.Decrypt(ctx, "garbage")
+	assert.Error(t, err)
+}
+
+func TestSignVerify(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSystem(t, &fakeTransit{})
+
+	sig, err := s.Sign(ctx, []byte("payload"))
+	assert.NoError(t, err)
+
+	valid, err := s.Verify(ctx, []byte("payload"), sig)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	valid, err = s.Verify(ctx, []byte("tampered"), sig)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSystem(t, &fakeTransit{})
+
+	cts, err := s.EncryptBatch(ctx, [][]byte{[]byte("a"), []byte("b")})
+	assert.NoError(t, err)
+	assert.Len(t, cts, 2)
+
+	pts, err := s.DecryptBatch(ctx, cts)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, pts)
+
+	rewrapped, err := s.RewrapBatch(ctx, cts)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rewrapped[1], "vault:v2:"))
+
+	sigs, err := s.SignBatch(ctx, [][]byte{[]byte("a"), []byte("b")})
+	assert.NoError(t, err)
+	valid, err := s.VerifyBatch(ctx, [][]byte{[]byte("a"), []byte("c")}, sigs)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true, false}, valid)
+
+	_, err = s.DecryptBatch(ctx, []string{cts[0], "garbage"})
+	assert.Error(t, err)
+}
+
+func TestEnvelope(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("no cache", func(t *testing.T) {
+		fake := &fakeTransit{}
+		s := newTestSystem(t, fake)
+
+		env, err := s.EnvelopeEncrypt(ctx, []byte("card number"))
+		assert.NoError(t, err)
+		pt, err := s.EnvelopeDecrypt(ctx, env)
+		assert.NoError(t, err)
+		assert.Equal(t, "card number", string(pt))
+
+		_, err = s.EnvelopeEncrypt(ctx, []byte("again"))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, fake.calls["transit/datakey/plaintext/test-key"])
+		assert.Equal(t, 1, fake.calls["transit/decrypt/test-key"])
+	})
+
+	t.Run("cached data key", func(t *testing.T) {
+		fake := &fakeTransit{}
+		s := newTestSystem(t, fake)
+		s.DataKeyTTL = time.Minute
+
+		for i := 0; i < 3; i++ {
+			env, err := s.EnvelopeEncrypt(ctx, []byte("card number"))
+			assert.NoError(t, err)
+			pt, err := s.EnvelopeDecrypt(ctx, env)
+			assert.NoError(t, err)
+			assert.Equal(t, "card number", string(pt))
+		}
+		assert.Equal(t, 1, fake.calls["transit/datakey/plaintext/test-key"])
+		assert.Equal(t, 0, fake.calls["transit/decrypt/test-key"])
+
+		s.FlushDataKeys()
+		_, err := s.EnvelopeEncrypt(ctx, []byte("card number"))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, fake.calls["transit/datakey/plaintext/test-key"])
+	})
+
+	t.Run("tampered envelope", func(t *testing.T) {
+		s := newTestSystem(t, &fakeTransit{})
+
+		env, err := s.EnvelopeEncrypt(ctx, []byte("card number"))
+		assert.NoError(t, err)
+		_, err = s.EnvelopeDecrypt(ctx, env[:len(env)-4]+"AAAA")
+		assert.Error(t, err)
+		_, err = s.EnvelopeDecrypt(ctx, "no-separator")
+		assert.Error(t, err)
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/bugfixes/go-bugfixes/logs"
 
 	"github.com/caarlos0/env/v8"
+	"github.com/keloran/go-config/secrets"
 )
 
 type Path struct {
@@ -18,6 +19,8 @@ type Path struct {
 }
 
 type Paths struct {
+	Root Root
+
 	Database Path
 	Keycloak Path
 	Mongo    Path
@@ -30,17 +33,18 @@ type Paths struct {
 
 // System is the vault config
 type System struct {
-	Host       string `env:"VAULT_HOST" envDefault:"vault.vault"`
-	Port       string `env:"VAULT_PORT" envDefault:""`
-	Token      string `env:"VAULT_TOKEN" envDefault:"root"`
+	Host       string         `env:"VAULT_HOST" envDefault:"vault.vault"`
+	Port       string         `env:"VAULT_PORT" envDefault:""`
+	Token      secrets.Secret `env:"VAULT_TOKEN" envDefault:"root"`
 	Address    string
+	Root       Root
 	ExpireTime time.Time
 }
 
 func NewSystem(address, token string) *System {
 	return &System{
 		Address: address,
-		Token:   token,
+		Token:   secrets.New(token),
 	}
 }
 
@@ -63,7 +67,21 @@ func Build() (*System, vaultHelper.VaultHelper, error) {
 		v.Address = fmt.Sprintf("https://%s", v.Host)
 	}
 
-	vh := vaultHelper.NewVault(v.Address, v.Token)
+	root, err := BuildRoot()
+	if err != nil {
+		return v, nil, err
+	}
+	v.Root = root
+
+	policy, err := BuildRetryPolicy()
+	if err != nil {
+		return v, nil, err
+	}
+	h, err := NewHelper(v.Address, v.Token.Reveal())
+	if err != nil {
+		return v, nil, err
+	}
+	vh := NewResilient(h, policy)
 
 	return v, vh, nil
 }
@@ -15,7 +15,7 @@ func TestBuild(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, "vault.vault", l.Host)
 		assert.Equal(t, "", l.Port)
-		assert.Equal(t, "root", l.Token)
+		assert.Equal(t, "root", l.Token.Reveal())
 		assert.Equal(t, "https://vault.vault", l.Address)
 	})
 
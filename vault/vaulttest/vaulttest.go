@@ -0,0 +1,354 @@
+// Package vaulttest runs an in-process fake vault for tests, it speaks enough of the HTTP API
+// for KV v1/v2 reads, token lookup and renewal, AppRole login and injected failures
+package vaulttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keloran/go-config/vault"
+)
+
+const (
+	DefaultToken = "root"
+	DefaultLease = 3600
+)
+
+type Option func(*Server)
+
+type version struct {
+	data    map[string]interface{}
+	created time.Time
+}
+
+type failure struct {
+	status int
+	times  int
+}
+
+type appRole struct {
+	secretID string
+	policies []string
+}
+
+// Server is a fake vault, secrets are seeded by logical path without the KV v2 "data" segment
+type Server struct {
+	*httptest.Server
+	t testing.TB
+
+	Token string
+
+	mu       sync.Mutex
+	kv       map[string][]version
+	v1Mounts map[string]bool
+	leases   map[string]int
+	tokens   map[string]time.Time
+	roles    map[string]appRole
+	failures map[string]*failure
+	requests []string
+	tokenTTL int
+}
+
+// WithKVv1 serves the mount as KV v1, every other mount is KV v2
+func WithKVv1(mount string) Option {
+	return func(s *Server) {
+		s.v1Mounts[strings.Trim(mount, "/")] = true
+	}
+}
+
+func WithToken(token string) Option {
+	return func(s *Server) {
+		s.Token = token
+	}
+}
+
+// WithLease sets the lease_duration returned for a secret path
+func WithLease(path string, seconds int) Option {
+	return func(s *Server) {
+		s.leases[strings.Trim(path, "/")] = seconds
+	}
+}
+
+func WithTokenTTL(seconds int) Option {
+	return func(s *Server) {
+		s.tokenTTL = seconds
+	}
+}
+
+func WithAppRole(roleID, secretID string, policies ...string) Option {
+	return func(s *Server) {
+		s.roles[roleID] = appRole{secretID: secretID, policies: policies}
+	}
+}
+
+// NewServer starts a fake vault seeded with secrets keyed by logical path, e.g. "secret/chewedfeed/postgres",
+// and stops it when the test ends
+func NewServer(t testing.TB, seed map[string]map[string]interface{}, opts ...Option) *Server {
+	t.Helper()
+
+	s := &Server{
+		t:        t,
+		Token:    DefaultToken,
+		kv:       make(map[string][]version),
+		v1Mounts: make(map[string]bool),
+		leases:   make(map[string]int),
+		tokens:   make(map[string]time.Time),
+		roles:    make(map[string]appRole),
+		failures: make(map[string]*failure),
+		tokenTTL: DefaultLease,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.tokens[s.Token] = time.Now().Add(time.Duration(s.tokenTTL) * time.Second)
+
+	for path, data := range seed {
+		s.Put(path, data)
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Helper is a vault helper pointed at the fake with its root token
+func (s *Server) Helper() *vault.Helper {
+	h, err := vault.NewHelper(s.URL, s.Token)
+	if err != nil {
+		s.t.Fatalf("vaulttest: unable to create helper: %v", err)
+	}
+
+	return h
+}
+
+// Put writes a new version of a secret
+func (s *Server) Put(path string, data map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path = strings.Trim(path, "/")
+	s.kv[path] = append(s.kv[path], version{data: data, created: time.Now().UTC()})
+}
+
+// FailNext makes the next n requests whose logical path starts with prefix answer with status,
+// an empty prefix matches every request
+func (s *Server) FailNext(prefix string, status, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures[strings.Trim(prefix, "/")] = &failure{status: status, times: n}
+}
+
+// Requests lists "METHOD path" for every request received, including failed ones
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.requests...)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1"), "/")
+
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+path)
+	if status, ok := s.injected(path); ok {
+		s.mu.Unlock()
+		writeErrors(w, status, fmt.Sprintf("injected failure: %d", status))
+		return
+	}
+	s.mu.Unlock()
+
+	if path == "auth/approle/login" && (r.Method == http.MethodPost || r.Method == http.MethodPut) {
+		s.appRoleLogin(w, r)
+		return
+	}
+
+	token := r.Header.Get("X-Vault-Token")
+	if !s.validToken(token) {
+		writeErrors(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	switch {
+	case path == "auth/token/lookup-self":
+		s.lookupSelf(w, token)
+	case path == "auth/token/renew-self" && (r.Method == http.MethodPost || r.Method == http.MethodPut):
+		s.renewSelf(w, token)
+	case r.Method == http.MethodGet:
+		s.read(w, r, path)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+// injected must be called with the lock held
+func (s *Server) injected(path string) (int, bool) {
+	for prefix, f := range s.failures {
+		if f.times <= 0 || !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		f.times--
+		return f.status, true
+	}
+
+	return 0, false
+}
+
+func (s *Server) validToken(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires, ok := s.tokens[token]
+	return ok && time.Now().Before(expires)
+}
+
+func (s *Server) read(w http.ResponseWriter, r *http.Request, path string) {
+	mount, rest, _ := strings.Cut(path, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.v1Mounts[mount] {
+		versions, ok := s.kv[path]
+		if !ok {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"lease_duration": s.lease(path),
+			"renewable":      false,
+			"data":           versions[len(versions)-1].data,
+		})
+		return
+	}
+
+	rest, ok := strings.CutPrefix(rest, "data/")
+	if !ok {
+		writeErrors(w, http.StatusNotFound)
+		return
+	}
+	logical := mount + "/" + rest
+	versions, ok := s.kv[logical]
+	if !ok {
+		writeErrors(w, http.StatusNotFound)
+		return
+	}
+
+	v := len(versions)
+	if q := r.URL.Query().Get("version"); q != "" && q != "0" {
+		n, err := strconv.Atoi(q)
+		if err != nil || n < 1 || n > len(versions) {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		v = n
+	}
+	secret := versions[v-1]
+
+	writeJSON(w, map[string]interface{}{
+		"lease_duration": s.lease(logical),
+		"renewable":      false,
+		"data": map[string]interface{}{
+			"data": secret.data,
+			"metadata": map[string]interface{}{
+				"created_time":  secret.created.Format(time.RFC3339Nano),
+				"deletion_time": "",
+				"destroyed":     false,
+				"version":       v,
+			},
+		},
+	})
+}
+
+// lease must be called with the lock held
+func (s *Server) lease(path string) int {
+	if l, ok := s.leases[path]; ok {
+		return l
+	}
+
+	return 0
+}
+
+func (s *Server) lookupSelf(w http.ResponseWriter, token string) {
+	s.mu.Lock()
+	ttl := int(time.Until(s.tokens[token]).Seconds())
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"data": map[string]interface{}{
+			"id":        token,
+			"ttl":       ttl,
+			"renewable": true,
+			"policies":  []string{"default"},
+		},
+	})
+}
+
+func (s *Server) renewSelf(w http.ResponseWriter, token string) {
+	s.mu.Lock()
+	s.tokens[token] = time.Now().Add(time.Duration(s.tokenTTL) * time.Second)
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"auth": map[string]interface{}{
+			"client_token":   token,
+			"lease_duration": s.tokenTTL,
+			"renewable":      true,
+			"policies":       []string{"default"},
+		},
+	})
+}
+
+func (s *Server) appRoleLogin(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RoleID   string `json:"role_id"`
+		SecretID string `json:"secret_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErrors(w, http.StatusBadRequest, "unable to parse body")
+		return
+	}
+
+	s.mu.Lock()
+	role, ok := s.roles[body.RoleID]
+	if !ok || role.secretID != body.SecretID {
+		s.mu.Unlock()
+		writeErrors(w, http.StatusBadRequest, "invalid role or secret ID")
+		return
+	}
+	token := fmt.Sprintf("approle-%s-%d", body.RoleID, len(s.tokens))
+	s.tokens[token] = time.Now().Add(time.Duration(s.tokenTTL) * time.Second)
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"auth": map[string]interface{}{
+			"client_token":   token,
+			"lease_duration": s.tokenTTL,
+			"renewable":      true,
+			"policies":       append([]string{"default"}, role.policies...),
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeErrors(w http.ResponseWriter, status int, errs ...string) {
+	if errs == nil {
+		errs = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": errs})
+}
@@ -0,0 +1,99 @@
+package vaulttest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/keloran/go-config/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVv2(t *testing.T) {
+	s := NewServer(t, map[string]map[string]interface{}{
+		"secret/app/details": {"rds-hostname": "v1-host"},
+	}, WithLease("secret/app/details", 120))
+	s.Put("secret/app/details", map[string]interface{}{"rds-hostname": "v2-host"})
+
+	h := s.Helper()
+	require.NoError(t, h.GetSecrets("secret/data/app/details"))
+	host, err := h.GetSecret("rds-hostname")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2-host", host)
+	assert.Equal(t, 120, h.LeaseDuration())
+
+	sv, ok := h.LastVersion()
+	assert.True(t, ok)
+	assert.Equal(t, 2, sv.Version)
+	assert.False(t, sv.CreatedTime.IsZero())
+
+	require.NoError(t, h.GetSecrets("secret/data/app/details?version=1"))
+	host, _ = h.GetSecret("rds-hostname")
+	assert.Equal(t, "v1-host", host)
+
+	assert.Error(t, h.GetSecrets("secret/data/app/missing"))
+	assert.Error(t, h.GetSecrets("secret/data/app/details?version=9"))
+}
+
+func TestKVv1(t *testing.T) {
+	s := NewServer(t, map[string]map[string]interface{}{
+		"kv/app/details": {"rds-hostname": "host"},
+	}, WithKVv1("kv"))
+
+	h := s.Helper()
+	require.NoError(t, h.GetSecrets("kv/app/details"))
+	host, err := h.GetSecret("rds-hostname")
+	assert.NoError(t, err)
+	assert.Equal(t, "host", host)
+
+	sv, _ := h.LastVersion()
+	assert.Equal(t, 0, sv.Version)
+}
+
+func TestTokens(t *testing.T) {
+	s := NewServer(t, nil, WithToken("s.test"), WithTokenTTL(60), WithAppRole("role", "secret", "app"))
+
+	client, err := api.NewClient(&api.Config{Address: s.URL})
+	require.NoError(t, err)
+
+	client.SetToken("wrong")
+	_, err = client.Auth().Token().LookupSelf()
+	assert.Error(t, err)
+
+	client.SetToken("s.test")
+	lookup, err := client.Auth().Token().LookupSelf()
+	require.NoError(t, err)
+	ttl, err := lookup.TokenTTL()
+	assert.NoError(t, err)
+	assert.InDelta(t, 60, ttl.Seconds(), 2)
+
+	renewed, err := client.Auth().Token().RenewSelf(0)
+	require.NoError(t, err)
+	assert.Equal(t, 60, renewed.Auth.LeaseDuration)
+
+	client.ClearToken()
+	login, err := client.Logical().Write("auth/approle/login", map[string]interface{}{"role_id": "role", "secret_id": "secret"})
+	require.NoError(t, err)
+	assert.Contains(t, login.Auth.Policies, "app")
+
+	_, err = client.Logical().Write("auth/approle/login", map[string]interface{}{"role_id": "role", "secret_id": "nope"})
+	assert.Error(t, err)
+
+	client.SetToken(login.Auth.ClientToken)
+	_, err = client.Auth().Token().LookupSelf()
+	assert.NoError(t, err)
+}
+
+func TestFailNext(t *testing.T) {
+	s := NewServer(t, map[string]map[string]interface{}{
+		"secret/app/details": {"rds-hostname": "host"},
+	})
+	s.FailNext("secret/data/app", http.StatusServiceUnavailable, 2)
+
+	r := vault.NewResilient(s.Helper(), vault.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	require.NoError(t, r.GetSecrets("secret/data/app/details"))
+	assert.Equal(t, 2, r.Stats().Retries)
+	assert.Len(t, s.Requests(), 3)
+}